@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// prometheus http api style json responses, see:
+// 	https://prometheus.io/docs/prometheus/latest/querying/api/
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// apiData writes a successful api response
+func apiData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(apiResponse{Status: "success", Data: data}); err != nil {
+		fmt.Printf("Error: api: encoding response: %s\n", err.Error())
+	}
+}
+
+// apiError writes an error api response, read errors keep their status
+func apiError(w http.ResponseWriter, status int, err error) {
+	errType := "bad_data"
+	if rerr, ok := err.(*p2cReadError); ok {
+		status = rerr.status
+	}
+	switch {
+	case status == http.StatusGatewayTimeout:
+		errType = "timeout"
+	case status == http.StatusServiceUnavailable:
+		errType = "canceled"
+	case status == http.StatusUnprocessableEntity:
+		errType = "execution"
+	case status >= 500:
+		errType = "internal"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiResponse{Status: "error", ErrorType: errType, Error: err.Error()})
+}
+
+// parseTime parses an api timestamp, either RFC3339 or unix seconds with
+// an optional fraction. An empty string returns def.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseTimeRange parses the start and end parameters of an api request,
+// defaulting to the hour up to now
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	end, err := parseTime(r.FormValue("end"), time.Now())
+	if err != nil {
+		return end, end, err
+	}
+	start, err := parseTime(r.FormValue("start"), end.Add(-time.Hour))
+	if err != nil {
+		return start, end, err
+	}
+	if end.Before(start) {
+		return start, end, fmt.Errorf("end timestamp must not be before start time")
+	}
+	return start, end, nil
+}
+
+// formatValue formats a sample value the way the prometheus api does
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// apiTime is a timestamp in milliseconds marshalled as unix seconds
+type apiTime int64
+
+func (t apiTime) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(float64(t)/1000, 'f', -1, 64)), nil
+}
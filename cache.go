@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// p2cCache is an LRU cache of remote read query results. Its size is
+// bounded by the total number of samples held rather than entries since
+// result sizes vary wildly. Cached results must not be modified.
+type p2cCache struct {
+	mtx        sync.Mutex
+	maxSamples int
+	ttl        time.Duration
+	samples    int
+	ll         *list.List
+	items      map[string]*list.Element
+	hits       prometheus.Counter
+	misses     prometheus.Counter
+	evictions  prometheus.Counter
+	size       prometheus.Gauge
+}
+
+type cacheEntry struct {
+	key     string
+	series  []*remote.TimeSeries
+	samples int
+	expires time.Time
+}
+
+func NewP2CCache(maxSamples int, ttl time.Duration) *p2cCache {
+	c := new(p2cCache)
+	c.maxSamples = maxSamples
+	c.ttl = ttl
+	c.ll = list.New()
+	c.items = make(map[string]*list.Element)
+
+	c.hits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "read_cache_hits_total",
+			Help: "Total number of remote read queries served from the cache.",
+		},
+	)
+
+	c.misses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "read_cache_misses_total",
+			Help: "Total number of cacheable remote read queries not found in the cache.",
+		},
+	)
+
+	c.evictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "read_cache_evictions_total",
+			Help: "Total number of remote read query results evicted from the cache.",
+		},
+	)
+
+	c.size = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "read_cache_samples",
+			Help: "Number of samples currently held in the remote read cache.",
+		},
+	)
+	prometheus.MustRegister(c.hits)
+	prometheus.MustRegister(c.misses)
+	prometheus.MustRegister(c.evictions)
+	prometheus.MustRegister(c.size)
+
+	return c
+}
+
+// get returns the cached result for key if there is one and it hasn't expired
+func (c *p2cCache) get(key string) ([]*remote.TimeSeries, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		c.misses.Inc()
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits.Inc()
+	return e.series, true
+}
+
+// set adds a result to the cache, evicting the least recently used
+// results as needed to stay within maxSamples
+func (c *p2cCache) set(key string, series []*remote.TimeSeries) {
+	n := 0
+	for _, ts := range series {
+		n += len(ts.Samples)
+	}
+	// don't let one huge result flush everything else
+	if n > c.maxSamples/2 {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	for c.samples+n > c.maxSamples && c.ll.Len() > 0 {
+		c.remove(c.ll.Back())
+		c.evictions.Inc()
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{
+		key:     key,
+		series:  series,
+		samples: n,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.samples += n
+	c.size.Set(float64(c.samples))
+}
+
+// remove drops an element, the lock must be held
+func (c *p2cCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.samples -= e.samples
+	c.size.Set(float64(c.samples))
+}
+
+// cacheKey normalizes a query into a cache key: matchers are sorted so
+// their order doesn't matter, the time range is already step aligned
+func (r *p2cReader) cacheKey(query *remote.Query, tr timeRange) string {
+	ms := make([]string, 0, len(query.Matchers))
+	for _, m := range query.Matchers {
+		ms = append(ms, fmt.Sprintf("%s\xfe%d\xfe%s", m.Name, m.Type, m.Value))
+	}
+	sort.Strings(ms)
+	return fmt.Sprintf("%d:%d:%d:%f:%s", tr.start, tr.end, tr.step,
+		r.conf.CHQuantile, strings.Join(ms, "\xff"))
+}
+
+// cacheable returns true if tr is entirely in the past, ie. old enough
+// that all of its samples should have been written
+func (r *p2cReader) cacheable(tr timeRange) bool {
+	if r.cache == nil {
+		return false
+	}
+	return tr.end < time.Now().Add(-r.conf.ReadCacheMinAge).Unix()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// downsampled tables are AggregatingMergeTrees fed by materialized views
+// on the samples table, holding min/max/sum/count/last per series per
+// bucket, eg. samples_5m and samples_1h for ch.downsample=5m,1h. NaN and
+// +/-Inf samples (including staleness markers) are left out.
+
+var downsampleTableSQL = `CREATE TABLE IF NOT EXISTS %s.%s
+	(
+		date Date,
+		name String,
+		tags Array(String),
+		bucket DateTime,
+		min_val AggregateFunction(min, Float64),
+		max_val AggregateFunction(max, Float64),
+		sum_val AggregateFunction(sum, Float64),
+		cnt AggregateFunction(count, Float64),
+		last_val AggregateFunction(argMax, Float64, DateTime)
+	)
+	ENGINE = AggregatingMergeTree(date, (name, tags, bucket), 8192)`
+
+var downsampleViewSQL = `CREATE MATERIALIZED VIEW IF NOT EXISTS %s.%s_mv
+	TO %s.%s
+	AS SELECT
+		toDate(ts) AS date,
+		name,
+		tags,
+		toDateTime(intDiv(toUInt32(ts), %d) * %d) AS bucket,
+		minState(val) AS min_val,
+		maxState(val) AS max_val,
+		sumState(val) AS sum_val,
+		countState(val) AS cnt,
+		argMaxState(val, ts) AS last_val
+	FROM %s.%s
+	WHERE isFinite(val)
+	GROUP BY date, name, tags, bucket`
+
+// downsampleTable is a downsampled table with its bucket size in seconds
+// and the first full bucket fed by its view, unix seconds
+type downsampleTable struct {
+	res   int64
+	table string
+	since int64
+}
+
+// readSource describes the table and expressions a remote read selects from
+type readSource struct {
+	// raw samples rather than aggregated buckets
+	raw   bool
+	table string
+	// time column
+	tcol string
+	// number of raw samples and the aggregated value per bucket
+	cnt   string
+	value string
+}
+
+// parseDownsample parses a comma separated list of bucket durations, eg.
+// 5m,1h, into tables named <table>_<duration> sorted by resolution
+func parseDownsample(s, table string) ([]downsampleTable, error) {
+	var dts []downsampleTable
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		res, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid downsample resolution %q: %s", d, err.Error())
+		}
+		if res < time.Second || res%time.Second != 0 {
+			return nil, fmt.Errorf("downsample resolution %q must be a whole number of seconds", d)
+		}
+		dts = append(dts, downsampleTable{
+			res:   int64(res / time.Second),
+			table: fmt.Sprintf("%s_%s", table, d),
+		})
+	}
+	sort.Slice(dts, func(i, j int) bool { return dts[i].res < dts[j].res })
+	return dts, nil
+}
+
+// createDownsampleTables creates the downsampled tables and the
+// materialized views populating them from ch.table if they don't exist.
+// Only rows inserted after the view is created are downsampled.
+func (r *p2cReader) createDownsampleTables() error {
+	for _, dt := range r.downsample {
+		stmts := []string{
+			fmt.Sprintf(downsampleTableSQL, r.conf.ChDB, dt.table),
+			fmt.Sprintf(downsampleViewSQL, r.conf.ChDB, dt.table, r.conf.ChDB, dt.table,
+				dt.res, dt.res, r.conf.ChDB, r.conf.ChTable),
+		}
+		for _, stmt := range stmts {
+			if _, err := r.db.Exec(stmt); err != nil {
+				return fmt.Errorf("creating %s: %s", dt.table, err.Error())
+			}
+		}
+		fmt.Fprintf(r.log, "Downsampled table %s.%s ready (%ds buckets)\n", r.conf.ChDB, dt.table, dt.res)
+	}
+	return nil
+}
+
+// loadDownsampleViews sets when each downsampled table's view was created,
+// reads of earlier data go to ch.table. Tables without a view are assumed
+// to have been filled some other way and cover all time.
+func (r *p2cReader) loadDownsampleViews() error {
+	for i := range r.downsample {
+		dt := &r.downsample[i]
+		var created time.Time
+		err := r.db.QueryRow(fmt.Sprintf("SELECT metadata_modification_time FROM system.tables "+
+			"WHERE database = '%s' AND name = '%s_mv'",
+			sqlEscaper.Replace(r.conf.ChDB), sqlEscaper.Replace(dt.table))).Scan(&created)
+		if err == sql.ErrNoRows {
+			fmt.Fprintf(r.log, "Downsampled table %s.%s has no view, reading it for all time\n", r.conf.ChDB, dt.table)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("loading %s_mv: %s", dt.table, err.Error())
+		}
+		// the bucket the view was created in is partial
+		dt.since = created.Unix() - created.Unix()%dt.res + dt.res
+	}
+	return nil
+}
+
+// source returns where to read a query over tr from: the coarsest
+// downsampled table whose buckets evenly divide the step and whose view
+// was created before the start, or the raw samples table. Downsampled
+// tables return the mean of each bucket rather than ch.quantile since
+// quantiles can't be merged.
+func (r *p2cReader) source(tr timeRange) readSource {
+	if r.conf.ReadRaw {
+		return readSource{
+			raw:   true,
+			table: r.conf.ChTable,
+			tcol:  "ts",
+		}
+	}
+
+	for i := len(r.downsample) - 1; i >= 0; i-- {
+		dt := r.downsample[i]
+		if tr.step%dt.res == 0 && tr.start >= dt.since {
+			return readSource{
+				table: dt.table,
+				tcol:  "bucket",
+				cnt:   "countMerge(cnt)",
+				value: "sumMerge(sum_val) / countMerge(cnt)",
+			}
+		}
+	}
+	// NaN (including staleness markers) and +/-Inf would poison the quantile
+	return readSource{
+		table: r.conf.ChTable,
+		tcol:  "ts",
+		cnt:   "countIf(isFinite(val))",
+		value: fmt.Sprintf("quantileIf(%f)(val, isFinite(val))", r.conf.CHQuantile),
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/kshvakov/clickhouse"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// with ch.exemplars exemplars are stored in ch.exemplartable, one row per
+// exemplar with the name and tags of the series it belongs to so they can
+// be selected the same way as samples
+
+var insertExemplarSQL = `INSERT INTO %s.%s
+	(date, name, tags, labels, val, ts, ts_ms)
+	VALUES	(?, ?, ?, ?, ?, ?, ?)`
+
+// exemplar is a prompb.Exemplar
+type exemplar struct {
+	Labels      []*remote.LabelPair `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Value       float64             `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	TimestampMs int64               `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *exemplar) Reset()         { *m = exemplar{} }
+func (m *exemplar) String() string { return proto.CompactTextString(m) }
+func (*exemplar) ProtoMessage()    {}
+
+// p2cExemplar is one exemplar row
+type p2cExemplar struct {
+	// exemplar labels, eg. trace_id, in <key>=<value> format
+	labels []string
+	val    float64
+	tsMs   int64
+}
+
+// exemplarTable returns the writers table for exemplar rows
+func (w *p2cWriter) exemplarTable() *p2cTable {
+	return &p2cTable{
+		sql: fmt.Sprintf(insertExemplarSQL, w.conf.ChDB, w.conf.ChExemplarTable),
+		exec: func(smt *sql.Stmt, req *p2cRequest) error {
+			e := req.exemplar
+			_, err := smt.Exec(req.ts, req.name, clickhouse.Array(req.tags),
+				clickhouse.Array(e.labels), e.val, req.ts, e.tsMs)
+			return err
+		},
+	}
+}
+
+// enqueueExemplars queues a request per exemplar of series
+func (c *p2cServer) enqueueExemplars(series *p2cTimeSeries) {
+	name, tags := seriesTags(series.Labels)
+	for _, e := range series.Exemplars {
+		_, labels := seriesTags(e.Labels)
+		c.requests <- &p2cRequest{
+			name: name,
+			tags: tags,
+			ts:   time.Unix(e.TimestampMs/1000, 0),
+			exemplar: &p2cExemplar{
+				labels: labels,
+				val:    e.Value,
+				tsMs:   e.TimestampMs,
+			},
+		}
+	}
+}
+
+// exemplar query results as returned by the prometheus api
+type exemplarSeries struct {
+	SeriesLabels map[string]string `json:"seriesLabels"`
+	Exemplars    []exemplarData    `json:"exemplars"`
+}
+
+type exemplarData struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp apiTime           `json:"timestamp"`
+}
+
+// tagsMap returns <key>=<value> tags as a map
+func tagsMap(tags []string) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if vals := strings.SplitN(tag, "=", 2); len(vals) == 2 && vals[1] != "" {
+			m[vals[0]] = vals[1]
+		}
+	}
+	return m
+}
+
+// QueryExemplars returns the exemplars of series matching matchers between
+// start and end, subject to the read limits
+func (r *p2cReader) QueryExemplars(ctx context.Context, matchers []*remote.LabelMatcher,
+	start, end time.Time) ([]*exemplarSeries, error) {
+
+	whereSQL := fmt.Sprintf("WHERE date >= toDate(%d) AND ts >= toDateTime(%d) AND ts <= toDateTime(%d)",
+		start.Unix(), start.Unix(), end.Unix())
+	if where := getMatchersSQL(matchers); len(where) > 0 {
+		whereSQL += " AND " + strings.Join(where, " AND ")
+	}
+	sqlStr := fmt.Sprintf("SELECT tags, labels, val, ts_ms FROM %s.%s %s AND ts_ms >= %d AND ts_ms <= %d "+
+		"ORDER BY name, tags, ts_ms", r.conf.ChDB, r.conf.ChExemplarTable, whereSQL,
+		start.UnixNano()/1e6, end.UnixNano()/1e6) + r.getSettings()
+	fmt.Fprintf(r.log, "query: running sql: %s\n\n", sqlStr)
+
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		fmt.Fprintf(r.log, "Error: query failed: %s", sqlStr)
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return nil, r.queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var (
+		series = make([]*exemplarSeries, 0)
+		keys   = make(map[string]*exemplarSeries)
+		limits = r.newReadLimits()
+	)
+	for rows.Next() {
+		var (
+			tags   []string
+			labels []string
+			val    float64
+			tsMs   int64
+		)
+		if err = rows.Scan(&tags, &labels, &val, &tsMs); err != nil {
+			fmt.Fprintf(r.log, "Error: scan: %s\n", err.Error())
+			continue
+		}
+
+		sort.Strings(tags)
+		key := strings.Join(tags, "\xff")
+		es, ok := keys[key]
+		if !ok {
+			if err = r.addSeries(limits); err != nil {
+				return nil, err
+			}
+			es = &exemplarSeries{SeriesLabels: tagsMap(tags)}
+			keys[key] = es
+			series = append(series, es)
+		}
+		if err = r.addSamples(limits, 1); err != nil {
+			return nil, err
+		}
+		es.Exemplars = append(es.Exemplars, exemplarData{
+			Labels:    tagsMap(labels),
+			Value:     formatValue(val),
+			Timestamp: apiTime(tsMs),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return nil, r.queryError(ctx, err)
+	}
+	return series, nil
+}
+
+// queryExemplars serves /api/v1/query_exemplars. Only plain series
+// selectors are supported as query, not PromQL expressions.
+func (c *p2cServer) queryExemplars(w http.ResponseWriter, r *http.Request) {
+	matchers, err := parseSelector(r.FormValue("query"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !c.conf.ChExemplars {
+		apiData(w, []*exemplarSeries{})
+		return
+	}
+
+	ctx := r.Context()
+	if c.conf.CHMaxQueryTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.conf.CHMaxQueryTime)
+		defer cancel()
+	}
+
+	series, err := c.reader.QueryExemplars(ctx, matchers, start, end)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiData(w, series)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// raw sample export as csv, json lines or openmetrics text. Unlike remote
+// read nothing is aggregated or downsampled, samples are exported exactly
+// as written to ch.table. Series in ch.histtable and native histograms
+// aren't exported.
+
+// exportFormats are the content types of the export formats
+var exportFormats = map[string]string{
+	"csv":         "text/csv; charset=utf-8",
+	"jsonl":       "application/x-ndjson",
+	"openmetrics": "application/openmetrics-text; version=1.0.0; charset=utf-8",
+}
+
+// exportWriter writes exported series in some format
+type exportWriter interface {
+	series(labels []*remote.LabelPair, samples []*remote.Sample) error
+	close() error
+}
+
+func newExportWriter(format string, w io.Writer) (exportWriter, error) {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		return &csvExport{w: cw}, cw.Write([]string{"name", "labels", "timestamp_ms", "value"})
+	case "jsonl":
+		return &jsonlExport{enc: json.NewEncoder(w)}, nil
+	case "openmetrics":
+		return &openMetricsExport{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// labelValueEscaper escapes label values as the exposition formats do
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// exportLabels formats labels other than the name as name="value",...
+func exportLabels(labels []*remote.LabelPair) (string, string) {
+	var (
+		name  string
+		pairs []string
+	)
+	for _, l := range labels {
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+			continue
+		}
+		pairs = append(pairs, l.Name+`="`+labelValueEscaper.Replace(l.Value)+`"`)
+	}
+	return name, strings.Join(pairs, ",")
+}
+
+// csvExport writes a row per sample
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) series(labels []*remote.LabelPair, samples []*remote.Sample) error {
+	name, lbls := exportLabels(labels)
+	for _, s := range samples {
+		e.w.Write([]string{name, lbls, strconv.FormatInt(s.TimestampMs, 10), formatValue(s.Value)})
+	}
+	return e.w.Error()
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExport writes a line per series, values are strings as in the
+// prometheus api so NaN and +/-Inf survive
+type jsonlExport struct {
+	enc *json.Encoder
+}
+
+type jsonlSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []string          `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+func (e *jsonlExport) series(labels []*remote.LabelPair, samples []*remote.Sample) error {
+	s := jsonlSeries{
+		Metric:     make(map[string]string, len(labels)),
+		Values:     make([]string, 0, len(samples)),
+		Timestamps: make([]int64, 0, len(samples)),
+	}
+	for _, l := range labels {
+		s.Metric[l.Name] = l.Value
+	}
+	for _, sample := range samples {
+		s.Values = append(s.Values, formatValue(sample.Value))
+		s.Timestamps = append(s.Timestamps, sample.TimestampMs)
+	}
+	return e.enc.Encode(&s)
+}
+
+func (e *jsonlExport) close() error {
+	return nil
+}
+
+// openMetricsExport writes a line per sample with timestamps in seconds,
+// which import openmetrics reads back
+type openMetricsExport struct {
+	w io.Writer
+}
+
+func (e *openMetricsExport) series(labels []*remote.LabelPair, samples []*remote.Sample) error {
+	name, lbls := exportLabels(labels)
+	if lbls != "" {
+		name += "{" + lbls + "}"
+	}
+	for _, s := range samples {
+		_, err := fmt.Fprintf(e.w, "%s %s %s\n", name, formatValue(s.Value),
+			strconv.FormatFloat(float64(s.TimestampMs)/1000, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *openMetricsExport) close() error {
+	_, err := io.WriteString(e.w, "# EOF\n")
+	return err
+}
+
+// Export calls fn with the raw samples of each series matching any of
+// selectors between start and end, one series at a time in name order so
+// a metric family is contiguous, returning the number of rows read. The
+// read limits don't apply, an export is never truncated by them.
+func (r *p2cReader) Export(ctx context.Context, selectors [][]*remote.LabelMatcher, start, end time.Time,
+	fn func(labels []*remote.LabelPair, samples []*remote.Sample) error) (int, error) {
+
+	tr := timeRange{start: start.Unix(), end: end.Unix(), step: 1}
+	src := readSource{raw: true, table: r.conf.ChTable, tcol: "ts"}
+	_, whereSQL := r.getTimePeriod(tr, src)
+	sqlStr := fmt.Sprintf("SELECT 1 AS CNT, toUInt32(ts) * 1000 AS t, name, tags, val as value "+
+		"FROM %s.%s %s AND %s ORDER BY name, tags, t", r.conf.ChDB, src.table, whereSQL,
+		selectorsSQL(selectors))
+	fmt.Fprintf(r.log, "export: running sql: %s\n\n", sqlStr)
+
+	var (
+		key     string
+		labels  []*remote.LabelPair
+		samples []*remote.Sample
+	)
+	flush := func() error {
+		if labels == nil {
+			return nil
+		}
+		err := fn(labels, samples)
+		labels, samples = nil, nil
+		return err
+	}
+	add := func(t int64, tags []string, value float64) error {
+		if k := strings.Join(tags, "\xff"); labels == nil || k != key {
+			if err := flush(); err != nil {
+				return err
+			}
+			key, labels = k, r.makeLabels(tags)
+		}
+		samples = append(samples, &remote.Sample{Value: value, TimestampMs: t})
+		return nil
+	}
+
+	n, err := r.scan(ctx, sqlStr, add)
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// export writes the series matching any of selectors through ew, which
+// is only closed (eg. the openmetrics # EOF written) if nothing failed
+func (r *p2cReader) export(ctx context.Context, selectors []string, start, end time.Time,
+	ew exportWriter) error {
+
+	var all [][]*remote.LabelMatcher
+	for _, s := range selectors {
+		matchers, err := parseSelector(s)
+		if err != nil {
+			return fmt.Errorf("invalid selector %q: %s", s, err.Error())
+		}
+		all = append(all, matchers)
+	}
+
+	if _, err := r.Export(ctx, all, start, end, ew.series); err != nil {
+		return err
+	}
+	return ew.close()
+}
+
+// exportErrorTrailer is the http trailer reporting an export that failed
+// after its first rows were sent
+const exportErrorTrailer = "X-Export-Error"
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// exportSeries serves /api/v1/export, taking match[] selectors, a start
+// and end (the last hour by default) and a format of csv (the default),
+// jsonl or openmetrics
+func (c *p2cServer) exportSeries(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	// validate the selectors before anything is written
+	for _, s := range selectors {
+		if _, err := parseSelector(s); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid selector %q: %s", s, err.Error()))
+			return
+		}
+	}
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("unknown export format %q", format))
+		return
+	}
+
+	// exports run until done or the client goes away, ch.maxquerytime
+	// would only cut them short
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Trailer", exportErrorTrailer)
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	ew, err := newExportWriter(format, bw)
+	if err == nil {
+		err = c.reader.export(r.Context(), selectors, start, end, ew)
+	}
+	if err == nil {
+		if err = bw.Flush(); err != nil {
+			fmt.Fprintf(c.reader.log, "Error: export: %s\n", err.Error())
+		}
+		return
+	}
+
+	fmt.Fprintf(c.reader.log, "Error: export: %s\n", err.Error())
+	// nothing sent yet, the buffered rows are dropped for an error.
+	// Otherwise the trailer reports it and openmetrics lacks its # EOF.
+	if cw.n == 0 {
+		w.Header().Del("Trailer")
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	bw.Flush()
+	w.Header().Set(exportErrorTrailer, err.Error())
+}
+
+// runExport runs `prom2click export`, writing the series matching the
+// -match selectors to stdout or -out
+func runExport(args []string) int {
+	cfg := new(config)
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	addFlags(fs, cfg)
+
+	var selectors stringsFlag
+	fs.Var(&selectors, "match", "Export series matching this selector, eg. '{job=\"node\"}'. "+
+		"May be given more than once.")
+	start := fs.String("start", "", "Export samples at or after this RFC3339 or unix time (default an hour before -end).")
+	end := fs.String("end", "", "Export samples at or before this RFC3339 or unix time (default now).")
+	format := fs.String("format", "csv", "The output format, csv, jsonl or openmetrics.")
+	out := fs.String("out", "-", "The file to write to, - for stdout.")
+	fs.Parse(args)
+
+	if len(selectors) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -match is required")
+		fs.Usage()
+		return 2
+	}
+	tend, err := parseTime(*end, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 2
+	}
+	tstart, err := parseTime(*start, tend.Add(-time.Hour))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		return 2
+	}
+	if tend.Before(tstart) {
+		fmt.Fprintln(os.Stderr, "Error: -end is before -start")
+		return 2
+	}
+
+	// sql and errors go to stderr when the export goes to stdout
+	dst, log := io.Writer(os.Stdout), io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			return 1
+		}
+		defer f.Close()
+		dst = f
+	} else {
+		log = os.Stderr
+	}
+
+	reader, err := NewP2CReader(cfg, log)
+	if err != nil {
+		return 1
+	}
+	bw := bufio.NewWriter(dst)
+	ew, err := newExportWriter(*format, bw)
+	if err == nil {
+		err = reader.export(context.Background(), selectors, tstart, tend, ew)
+	}
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintf(log, "Error: export: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
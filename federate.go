@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// federateContentType is the prometheus text exposition format
+const federateContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Latest calls fn with the most recent sample of each series matching any
+// of selectors written in the lookback window before t, ordered by name.
+// Series whose latest sample is a staleness marker have ended and are
+// skipped. With ch.histograms the series in ch.histtable are expanded as
+// remote reads do.
+func (r *p2cReader) Latest(ctx context.Context, selectors [][]*remote.LabelMatcher, t time.Time,
+	lookback time.Duration, fn func(labels []*remote.LabelPair, sample *remote.Sample) error) (int, error) {
+
+	tr := timeRange{start: t.Add(-lookback).Unix(), end: t.Unix(), step: 1}
+	src := readSource{raw: true, table: r.conf.ChTable, tcol: "ts"}
+	_, whereSQL := r.getTimePeriod(tr, src)
+	sqlStr := fmt.Sprintf("SELECT 1 AS CNT, toUInt32(max(ts)) * 1000 AS t, name, tags, argMax(val, ts) AS value "+
+		"FROM %s.%s %s AND %s GROUP BY name, tags ORDER BY name, tags", r.conf.ChDB, src.table, whereSQL,
+		selectorsSQL(selectors))
+	sqlStr += r.getSettings()
+	fmt.Fprintf(r.log, "federate: running sql: %s\n\n", sqlStr)
+
+	if !r.conf.ChHistograms {
+		return r.scan(ctx, sqlStr, func(t int64, tags []string, value float64) error {
+			if math.Float64bits(value) == staleNaN {
+				return nil
+			}
+			return fn(r.makeLabels(tags), &remote.Sample{Value: value, TimestampMs: t})
+		})
+	}
+
+	// the parts of a histogram may be in either table, keep the latest
+	// sample of each series from both and sort them
+	type latestSample struct {
+		name   string
+		key    string
+		labels []*remote.LabelPair
+		sample *remote.Sample
+	}
+	latest := make(map[string]*latestSample)
+	add := func(t int64, tags []string, value float64) error {
+		key := strings.Join(tags, "\xff")
+		if l, ok := latest[key]; ok {
+			if t >= l.sample.TimestampMs {
+				l.sample = &remote.Sample{Value: value, TimestampMs: t}
+			}
+			return nil
+		}
+		l := &latestSample{key: key, labels: r.makeLabels(tags),
+			sample: &remote.Sample{Value: value, TimestampMs: t}}
+		for _, lp := range l.labels {
+			if lp.Name == model.MetricNameLabel {
+				l.name = lp.Value
+			}
+		}
+		latest[key] = l
+		return nil
+	}
+
+	n, err := r.scan(ctx, sqlStr, add)
+	if err != nil {
+		return n, err
+	}
+	// raw rows so an ended histograms staleness markers are seen. A series
+	// matching several selectors is kept once.
+	for _, matchers := range selectors {
+		hn, err := r.scanHistograms(ctx, &remote.Query{Matchers: matchers}, tr, true, add)
+		n += hn
+		if err != nil {
+			return n, err
+		}
+	}
+
+	series := make([]*latestSample, 0, len(latest))
+	for _, l := range latest {
+		if math.Float64bits(l.sample.Value) != staleNaN {
+			series = append(series, l)
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].key < series[j].key
+	})
+	for _, l := range series {
+		if err = fn(l.labels, l.sample); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// federate serves /federate, the latest sample of each series matching any
+// of the match[] selectors within federate.lookback, in the text format.
+// Series are grouped by name under an untyped TYPE line as metric types
+// aren't known.
+func (c *p2cServer) federate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var all [][]*remote.LabelMatcher
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parseSelector(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid selector %q: %s", s, err.Error()), http.StatusBadRequest)
+			return
+		}
+		all = append(all, matchers)
+	}
+
+	ctx := r.Context()
+	if c.conf.CHMaxQueryTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.conf.CHMaxQueryTime)
+		defer cancel()
+	}
+
+	// rows are buffered so a failed query can still return an error, all
+	// selectors are queried at once so each family's series are together
+	var (
+		buf   strings.Builder
+		typed = make(map[string]bool)
+	)
+	_, err := c.reader.Latest(ctx, all, time.Now(), c.conf.FederateLookback,
+		func(labels []*remote.LabelPair, sample *remote.Sample) error {
+			name, lbls := exportLabels(labels)
+			if !typed[name] {
+				fmt.Fprintf(&buf, "# TYPE %s untyped\n", name)
+				typed[name] = true
+			}
+			if lbls != "" {
+				name += "{" + lbls + "}"
+			}
+			fmt.Fprintf(&buf, "%s %s %d\n", name, formatValue(sample.Value), sample.TimestampMs)
+			return nil
+		})
+	if err != nil {
+		fmt.Printf("Error: federate: %s\n", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", federateContentType)
+	io.WriteString(w, buf.String())
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// forwarding of accepted writes to other remote write receivers. Every
+// request passed to process (remote write, and the influx, graphite,
+// otlp and opentsdb endpoints) is sent on as remote write 1.0 requests,
+// remote write 2.0 requests as converted for clickhouse. Each destination
+// has its own queues, when they're full series are dropped rather than
+// holding up writes to clickhouse. Series are spread over the queues by
+// their labels so each is sent in order, and batched like the kafka
+// producer: up to batch samples or whatever's queued after linger.
+
+// forwardTarget is a destination and its queues and retry policy
+type forwardTarget struct {
+	url        string
+	queues     []chan *forwardItem
+	queue      int
+	shards     int
+	batch      int
+	linger     time.Duration
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	client     *http.Client
+}
+
+// forwardItem is a queued series or metadata
+type forwardItem struct {
+	series *p2cTimeSeries
+	meta   *metricMetadata
+}
+
+// defaultForwardTarget holds the options of a destination not given
+func defaultForwardTarget() forwardTarget {
+	return forwardTarget{
+		queue:      10000,
+		shards:     4,
+		batch:      500,
+		linger:     time.Second,
+		retries:    10,
+		minBackoff: 100 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// parseForwardTargets reads a file of destinations, one
+// '<url> [option=value ...]' per line. The options are queue (series
+// buffered), shards (requests in flight), batch (samples per request),
+// linger (longest a series waits for a batch to fill), retries (attempts
+// after the first, -1 retries forever), minbackoff and maxbackoff
+// (doubling delay between attempts) and timeout (per attempt).
+func parseForwardTargets(file string) ([]*forwardTarget, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []*forwardTarget
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if u, err := url.Parse(fields[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("%s:%d: invalid url %q", file, lineno, fields[0])
+		}
+		t := defaultForwardTarget()
+		t.url = fields[0]
+		for _, opt := range fields[1:] {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected option=value, got %q", file, lineno, opt)
+			}
+			var (
+				n   int
+				d   time.Duration
+				err error
+			)
+			switch kv[0] {
+			case "queue", "shards", "batch":
+				if n, err = strconv.Atoi(kv[1]); err == nil && n < 1 {
+					err = fmt.Errorf("must be at least 1")
+				}
+				switch kv[0] {
+				case "queue":
+					t.queue = n
+				case "shards":
+					t.shards = n
+				case "batch":
+					t.batch = n
+				}
+			case "linger":
+				if d, err = time.ParseDuration(kv[1]); err == nil && d <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+				t.linger = d
+			case "retries":
+				t.retries, err = strconv.Atoi(kv[1])
+			case "minbackoff":
+				d, err = time.ParseDuration(kv[1])
+				t.minBackoff = d
+			case "maxbackoff":
+				d, err = time.ParseDuration(kv[1])
+				t.maxBackoff = d
+			case "timeout":
+				d, err = time.ParseDuration(kv[1])
+				t.client = &http.Client{Timeout: d}
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %s", file, lineno, kv[0], err.Error())
+			}
+		}
+		// the queue is split between the shards
+		size := t.queue / t.shards
+		if size < 1 {
+			size = 1
+		}
+		for i := 0; i < t.shards; i++ {
+			t.queues = append(t.queues, make(chan *forwardItem, size))
+		}
+		targets = append(targets, &t)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s: no forwarding urls", file)
+	}
+	return targets, nil
+}
+
+type p2cForwarder struct {
+	conf    *config
+	targets []*forwardTarget
+	wg      sync.WaitGroup
+	quit    chan struct{}
+	sent    *prometheus.CounterVec
+	failed  *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+	retried *prometheus.CounterVec
+}
+
+func NewP2CForwarder(conf *config) (*p2cForwarder, error) {
+	var err error
+	f := new(p2cForwarder)
+	f.conf = conf
+	f.quit = make(chan struct{})
+
+	f.targets, err = parseForwardTargets(conf.ForwardConfig)
+	if err != nil {
+		fmt.Printf("Error loading forwarding urls: %s\n", err.Error())
+		return f, err
+	}
+
+	f.sent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forward_sent_requests_total",
+			Help: "Total number of write requests forwarded to each url.",
+		},
+		[]string{"url"},
+	)
+	f.failed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forward_failed_requests_total",
+			Help: "Total number of write requests that could not be forwarded to each url after retrying.",
+		},
+		[]string{"url"},
+	)
+	f.dropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forward_dropped_series_total",
+			Help: "Total number of series and metadata dropped as the queue of each url was full.",
+		},
+		[]string{"url"},
+	)
+	f.retried = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "forward_retried_requests_total",
+			Help: "Total number of attempts to forward write requests to each url that were retried.",
+		},
+		[]string{"url"},
+	)
+	prometheus.MustRegister(f.sent)
+	prometheus.MustRegister(f.failed)
+	prometheus.MustRegister(f.dropped)
+	prometheus.MustRegister(f.retried)
+
+	return f, nil
+}
+
+// forward queues the series and metadata of req for every destination
+func (f *p2cForwarder) forward(req *p2cWriteRequest) {
+	for _, t := range f.targets {
+		for _, ts := range req.Timeseries {
+			t.enqueue(f, sipHash64([]byte(labelsKey(ts.Labels))), &forwardItem{series: ts})
+		}
+		for _, md := range req.Metadata {
+			t.enqueue(f, sipHash64([]byte(md.MetricFamilyName)), &forwardItem{meta: md})
+		}
+	}
+}
+
+// enqueue queues item on the queue picked by hash, or drops it if full
+func (t *forwardTarget) enqueue(f *p2cForwarder, hash uint64, item *forwardItem) {
+	select {
+	case t.queues[hash%uint64(len(t.queues))] <- item:
+	default:
+		f.dropped.WithLabelValues(t.url).Inc()
+	}
+}
+
+// run batches the items of a queue and sends them to t, until the queue
+// is closed
+func (f *p2cForwarder) run(t *forwardTarget, queue chan *forwardItem) {
+	defer f.wg.Done()
+	tick := time.NewTicker(t.linger)
+	defer tick.Stop()
+
+	var (
+		batch   = new(p2cWriteRequest)
+		samples = 0
+	)
+	flush := func() {
+		if len(batch.Timeseries) == 0 && len(batch.Metadata) == 0 {
+			return
+		}
+		data, err := proto.Marshal(batch)
+		if err != nil {
+			fmt.Printf("Error: forward: marshal: %s\n", err.Error())
+			f.failed.WithLabelValues(t.url).Inc()
+		} else {
+			f.send(t, snappy.Encode(nil, data))
+		}
+		batch = new(p2cWriteRequest)
+		samples = 0
+	}
+	for {
+		select {
+		case item, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			if item.meta != nil {
+				batch.Metadata = append(batch.Metadata, item.meta)
+				samples++
+			} else {
+				batch.Timeseries = append(batch.Timeseries, item.series)
+				samples += len(item.series.Samples) + len(item.series.Histograms)
+			}
+			if samples >= t.batch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// send posts body to t, retrying with backoff on errors that may be
+// temporary: connection errors, 5xx and 429 responses
+func (f *p2cForwarder) send(t *forwardTarget, body []byte) {
+	backoff := t.minBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := t.post(body)
+		if err == nil {
+			f.sent.WithLabelValues(t.url).Inc()
+			return
+		}
+		if !retry || (t.retries >= 0 && attempt >= t.retries) {
+			fmt.Printf("Error: forward: %s: %s\n", t.url, err.Error())
+			f.failed.WithLabelValues(t.url).Inc()
+			return
+		}
+
+		f.retried.WithLabelValues(t.url).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-f.quit:
+			f.failed.WithLabelValues(t.url).Inc()
+			return
+		}
+		if backoff *= 2; backoff > t.maxBackoff {
+			backoff = t.maxBackoff
+		}
+	}
+}
+
+// post makes a single attempt, returning whether a failure may be retried
+func (t *forwardTarget) post(body []byte) (bool, error) {
+	hreq, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	hreq.Header.Set("Content-Encoding", "snappy")
+	hreq.Header.Set("Content-Type", "application/x-protobuf")
+	hreq.Header.Set("User-Agent", "prom2click/"+Version)
+	hreq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := t.client.Do(hreq)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Start starts a sender per queue of each destination
+func (f *p2cForwarder) Start() {
+	for _, t := range f.targets {
+		fmt.Printf("Forwarding writes to %s\n", t.url)
+		for _, queue := range t.queues {
+			f.wg.Add(1)
+			go f.run(t, queue)
+		}
+	}
+}
+
+// Stop sends what's queued with one attempt per batch, retries give up
+// once quit is closed, and waits up to web.timeout for it
+func (f *p2cForwarder) Stop() {
+	for _, t := range f.targets {
+		for _, queue := range t.queues {
+			close(queue)
+		}
+	}
+	close(f.quit)
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(f.conf.HTTPTimeout):
+		fmt.Println("Forwarding shutdown timed out, queued requests will be lost..")
+	}
+}
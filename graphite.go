@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// graphite plaintext (tcp and udp) and pickle (tcp) listeners. Dotted
+// paths are converted to a metric name and labels by the first matching
+// template, or by replacing dots with underscores if none match. Graphite
+// 1.1 tagged paths (path;tag=value) keep their tags as labels.
+
+// maxPickleFrame limits the size of a pickle frame we'll allocate
+const maxPickleFrame = 16 * 1024 * 1024
+
+// graphiteInvalidLogInterval is how often an invalid line or pickle entry
+// is logged, the rest are only counted
+const graphiteInvalidLogInterval = 10 * time.Second
+
+// graphiteTemplate maps the nodes of paths matching filter to a name and
+// labels, eg. the template
+//
+//	.host.measurement.field*
+//
+// converts servers.web1.cpu.user.total to cpu_user_total{host="web1"}.
+// Nodes for measurement are joined with _ to form the name, then those for
+// field, measurement* and field* take all remaining nodes, empty parts
+// skip a node and any other part is the label a node becomes.
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   []*remote.LabelPair
+}
+
+type p2cGraphite struct {
+	// unix nanoseconds an invalid line or entry was last logged, first
+	// for 64 bit alignment
+	invalidLogged int64
+	conf          *config
+	process       func(req *p2cWriteRequest) writeStats
+	templates     []graphiteTemplate
+	tcp           net.Listener
+	udp           net.PacketConn
+	pickle        net.Listener
+	wg            sync.WaitGroup
+	quit          chan struct{}
+	rx            *prometheus.CounterVec
+	invalid       *prometheus.CounterVec
+}
+
+// parseGraphiteTemplates reads templates from a file with one per line:
+//
+//	[filter] <template> [tag=value,...]
+//
+// eg.
+//
+//	servers.* .host.measurement.field*
+//	stats.counters.* ..measurement* type=counter
+//	measurement*
+//
+// where * in a filter matches a single node. Blank lines and # comments
+// are ignored, templates are tried in order.
+func parseGraphiteTemplates(file string) ([]graphiteTemplate, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var templates []graphiteTemplate
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var filter, tmpl, tags string
+		switch {
+		case len(fields) == 1:
+			tmpl = fields[0]
+		case len(fields) == 2 && strings.Contains(fields[1], "="):
+			tmpl, tags = fields[0], fields[1]
+		case len(fields) == 2:
+			filter, tmpl = fields[0], fields[1]
+		case len(fields) == 3:
+			filter, tmpl, tags = fields[0], fields[1], fields[2]
+		default:
+			return nil, fmt.Errorf("%s:%d: expected [filter] <template> [tags]", file, lineno)
+		}
+
+		t := graphiteTemplate{parts: strings.Split(tmpl, ".")}
+		if filter != "" {
+			t.filter = strings.Split(filter, ".")
+		}
+		if !t.hasName() {
+			return nil, fmt.Errorf("%s:%d: template %q has no measurement", file, lineno, tmpl)
+		}
+		for _, tag := range strings.Split(tags, ",") {
+			if tag == "" {
+				continue
+			}
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("%s:%d: invalid tag %q", file, lineno, tag)
+			}
+			t.tags = append(t.tags, &remote.LabelPair{Name: sanitizeName(kv[0], false), Value: kv[1]})
+		}
+		templates = append(templates, t)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+func (t *graphiteTemplate) hasName() bool {
+	for _, p := range t.parts {
+		if strings.HasPrefix(p, "measurement") {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the filter matches the nodes of a path
+func (t *graphiteTemplate) matches(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, nodes[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the metric name and labels for the nodes of a path
+func (t *graphiteTemplate) apply(nodes []string) (string, []*remote.LabelPair) {
+	var (
+		name, field []string
+		labels      []*remote.LabelPair
+	)
+	for i, p := range t.parts {
+		if i >= len(nodes) {
+			break
+		}
+		switch p {
+		case "":
+		case "measurement":
+			name = append(name, nodes[i])
+		case "measurement*":
+			name = append(name, nodes[i:]...)
+		case "field":
+			field = append(field, nodes[i])
+		case "field*":
+			field = append(field, nodes[i:]...)
+		default:
+			labels = append(labels, &remote.LabelPair{Name: sanitizeName(p, false), Value: nodes[i]})
+		}
+		if strings.HasSuffix(p, "*") {
+			break
+		}
+	}
+	return strings.Join(append(name, field...), "_"), append(labels, t.tags...)
+}
+
+func NewP2CGraphite(conf *config, process func(req *p2cWriteRequest) writeStats) (*p2cGraphite, error) {
+	var err error
+	g := new(p2cGraphite)
+	g.conf = conf
+	g.process = process
+	g.quit = make(chan struct{})
+
+	if conf.GraphiteTemplates != "" {
+		g.templates, err = parseGraphiteTemplates(conf.GraphiteTemplates)
+		if err != nil {
+			fmt.Printf("Error loading graphite templates: %s\n", err.Error())
+			return g, err
+		}
+	}
+
+	if conf.GraphiteAddress != "" {
+		if g.tcp, err = net.Listen("tcp", conf.GraphiteAddress); err != nil {
+			return g, err
+		}
+		if g.udp, err = net.ListenPacket("udp", conf.GraphiteAddress); err != nil {
+			g.tcp.Close()
+			return g, err
+		}
+	}
+	if conf.GraphitePickleAddress != "" {
+		if g.pickle, err = net.Listen("tcp", conf.GraphitePickleAddress); err != nil {
+			g.close()
+			return g, err
+		}
+	}
+
+	g.rx = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_received_samples_total",
+			Help: "Total number of samples received by each graphite listener.",
+		},
+		[]string{"protocol"},
+	)
+	g.invalid = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_invalid_samples_total",
+			Help: "Total number of invalid lines or pickle entries received by each graphite listener.",
+		},
+		[]string{"protocol"},
+	)
+	prometheus.MustRegister(g.rx)
+	prometheus.MustRegister(g.invalid)
+
+	return g, nil
+}
+
+// series converts a graphite path and sample to a series
+func (g *p2cGraphite) series(gpath string, val float64, ts int64) (*p2cTimeSeries, error) {
+	var labels []*remote.LabelPair
+
+	// graphite 1.1 tags
+	if i := strings.IndexByte(gpath, ';'); i >= 0 {
+		for _, tag := range strings.Split(gpath[i+1:], ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			labels = append(labels, &remote.LabelPair{Name: sanitizeName(kv[0], false), Value: kv[1]})
+		}
+		gpath = gpath[:i]
+	}
+	if gpath == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+
+	name := gpath
+	nodes := strings.Split(gpath, ".")
+	for i := range g.templates {
+		if t := &g.templates[i]; t.matches(nodes) {
+			var tlabels []*remote.LabelPair
+			name, tlabels = t.apply(nodes)
+			labels = append(tlabels, labels...)
+			break
+		}
+	}
+
+	// later labels win, eg. graphite tags over template ones
+	seen := make(map[string]bool)
+	slabels := []*remote.LabelPair{{Name: model.MetricNameLabel, Value: sanitizeName(name, true)}}
+	for i := len(labels) - 1; i >= 0; i-- {
+		l := labels[i]
+		if seen[l.Name] || l.Name == model.MetricNameLabel || l.Value == "" {
+			continue
+		}
+		seen[l.Name] = true
+		slabels = append(slabels, l)
+	}
+	return &p2cTimeSeries{
+		Labels:  slabels,
+		Samples: []*remote.Sample{{Value: val, TimestampMs: ts}},
+	}, nil
+}
+
+// parseLine parses a plaintext line: <path> <value> [<timestamp>]
+func (g *p2cGraphite) parseLine(line string, now int64) (*p2cTimeSeries, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("expected <path> <value> [<timestamp>]")
+	}
+	val, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[1])
+	}
+	ts := now
+	if len(fields) == 3 && fields[2] != "-1" {
+		t, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		ts = int64(t * 1000)
+	}
+	return g.series(fields[0], val, ts)
+}
+
+// plaintext reads lines from r and processes each one
+func (g *p2cGraphite) plaintext(r io.Reader, protocol string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		series, err := g.parseLine(line, time.Now().UnixNano()/1e6)
+		if err != nil {
+			g.invalid.WithLabelValues(protocol).Inc()
+			g.logInvalid("Error: graphite %s: %q: %s\n", protocol, line, err.Error())
+			continue
+		}
+		g.rx.WithLabelValues(protocol).Inc()
+		g.process(&p2cWriteRequest{Timeseries: []*p2cTimeSeries{series}})
+	}
+}
+
+// logInvalid logs an invalid line or pickle entry unless one was logged
+// in the last graphiteInvalidLogInterval, graphite_invalid_samples_total
+// counts them all
+func (g *p2cGraphite) logInvalid(format string, args ...interface{}) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&g.invalidLogged)
+	if now-last < int64(graphiteInvalidLogInterval) ||
+		!atomic.CompareAndSwapInt64(&g.invalidLogged, last, now) {
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// pickled processes a pickle frame: a list of (path, (timestamp, value))
+func (g *p2cGraphite) pickled(frame []byte) error {
+	v, err := unpickle(frame)
+	if err != nil {
+		return err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("pickle: expected a list, got %T", v)
+	}
+
+	now := time.Now().UnixNano() / 1e6
+	req := &p2cWriteRequest{}
+	for _, item := range list {
+		series, err := g.pickledItem(item, now)
+		if err != nil {
+			g.invalid.WithLabelValues("pickle").Inc()
+			g.logInvalid("Error: graphite pickle: %s\n", err.Error())
+			continue
+		}
+		req.Timeseries = append(req.Timeseries, series)
+	}
+	g.rx.WithLabelValues("pickle").Add(float64(len(req.Timeseries)))
+	g.process(req)
+	return nil
+}
+
+func (g *p2cGraphite) pickledItem(item interface{}, now int64) (*p2cTimeSeries, error) {
+	tuple, ok := item.([]interface{})
+	if !ok || len(tuple) != 2 {
+		return nil, fmt.Errorf("expected (path, (timestamp, value)), got %v", item)
+	}
+	gpath, ok := tuple[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a string path, got %v", tuple[0])
+	}
+	point, ok := tuple[1].([]interface{})
+	if !ok || len(point) != 2 {
+		return nil, fmt.Errorf("%s: expected (timestamp, value), got %v", gpath, tuple[1])
+	}
+	t, ok := pickleFloat(point[0])
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid timestamp %v", gpath, point[0])
+	}
+	val, ok := pickleFloat(point[1])
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid value %v", gpath, point[1])
+	}
+	ts := int64(t * 1000)
+	if t <= 0 {
+		ts = now
+	}
+	return g.series(gpath, val, ts)
+}
+
+// servePickle reads length prefixed pickle frames from conn
+func (g *p2cGraphite) servePickle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n > maxPickleFrame {
+			fmt.Printf("Error: graphite pickle: %s: frame of %d bytes too large\n", conn.RemoteAddr(), n)
+			return
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return
+		}
+		if err := g.pickled(frame); err != nil {
+			g.invalid.WithLabelValues("pickle").Inc()
+			fmt.Printf("Error: graphite pickle: %s: %s\n", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
+
+// accept serves connections from l with serve until stopped
+func (g *p2cGraphite) accept(l net.Listener, serve func(conn net.Conn)) {
+	defer g.wg.Done()
+	var conns sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-g.quit:
+			default:
+				fmt.Printf("Error: graphite: accept: %s\n", err.Error())
+			}
+			break
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close()
+			// close idle connections on shutdown
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-g.quit:
+					conn.Close()
+				case <-done:
+				}
+			}()
+			serve(conn)
+		}()
+	}
+	conns.Wait()
+}
+
+// Start starts the configured listeners
+func (g *p2cGraphite) Start() {
+	fmt.Println("Graphite listener starting..")
+	if g.tcp != nil {
+		g.wg.Add(2)
+		go g.accept(g.tcp, func(conn net.Conn) { g.plaintext(conn, "tcp") })
+		go func() {
+			defer g.wg.Done()
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := g.udp.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				g.plaintext(strings.NewReader(string(buf[:n])), "udp")
+			}
+		}()
+	}
+	if g.pickle != nil {
+		g.wg.Add(1)
+		go g.accept(g.pickle, g.servePickle)
+	}
+}
+
+func (g *p2cGraphite) close() {
+	for _, c := range []io.Closer{g.tcp, g.udp, g.pickle} {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+// Stop closes the listeners and waits for connections to finish
+func (g *p2cGraphite) Stop() {
+	close(g.quit)
+	g.close()
+	g.wg.Wait()
+	fmt.Println("Graphite listener stopped..")
+}
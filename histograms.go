@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// with ch.histograms the _bucket, _sum and _count series of a classic
+// histogram (and the quantile, _sum and _count series of a summary) are
+// stored as one row per series per timestamp in ch.histtable rather than
+// a row per bucket, and expanded back into the original series on read.
+
+// histAbsent is the value of sum or count when it wasn't received in the
+// same write request as the buckets/quantiles. Prometheus shards series
+// across write requests so the components of a histogram can be split up.
+// It's a NaN but not the staleness marker, so reads compare the bits.
+const histAbsent uint64 = 0x7ff8000000000001
+
+// histPresentSQL returns an sql expression true if column holds a received
+// sum or count
+func histPresentSQL(column string) string {
+	return fmt.Sprintf("reinterpretAsUInt64(reinterpretAsString(%s)) != %d", column, histAbsent)
+}
+
+// histValueSQL returns an sql expression true if column holds a received
+// sum or count other than a staleness marker
+func histValueSQL(column string) string {
+	return fmt.Sprintf("%s AND reinterpretAsUInt64(reinterpretAsString(%s)) != %d",
+		histPresentSQL(column), column, staleNaN)
+}
+
+// p2cHistogram is one structured histogram or summary row
+type p2cHistogram struct {
+	// histogram or summary
+	kind string
+	// bucket upper bounds (le) or quantiles
+	bounds []float64
+	// the le or quantile label values as received, eg. 1.0 parses to 1
+	labels []string
+	// cumulative bucket counts or quantile values
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// histGroup collects the points of a histogram or summary series
+type histGroup struct {
+	base   string
+	tags   []string
+	kind   string
+	points map[int64]*p2cHistogram
+}
+
+func (g *histGroup) point(ts int64) *p2cHistogram {
+	p, ok := g.points[ts]
+	if !ok {
+		p = &p2cHistogram{
+			kind:  g.kind,
+			sum:   math.Float64frombits(histAbsent),
+			count: math.Float64frombits(histAbsent),
+		}
+		g.points[ts] = p
+	}
+	return p
+}
+
+// histBuilder groups histogram and summary series of a write request
+type histBuilder struct {
+	groups map[string]*histGroup
+	// _sum and _count series, only grouped if their histogram or summary
+	// is in the same request
+	pending []*remote.TimeSeries
+}
+
+func newHistBuilder() *histBuilder {
+	return &histBuilder{groups: make(map[string]*histGroup)}
+}
+
+// histTags returns the tags of a histogram series without le/quantile and
+// named base, and a key identifying the series
+func histTags(base string, labels []*remote.LabelPair) (string, []string) {
+	var tags []string
+	for _, label := range labels {
+		switch label.Name {
+		case model.BucketLabel, model.QuantileLabel:
+			continue
+		case model.MetricNameLabel:
+			tags = append(tags, fmt.Sprintf("%s=%s", label.Name, base))
+		default:
+			tags = append(tags, fmt.Sprintf("%s=%s", label.Name, label.Value))
+		}
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, "\xff"), tags
+}
+
+func (b *histBuilder) group(base, kind string, labels []*remote.LabelPair) *histGroup {
+	key, tags := histTags(base, labels)
+	g, ok := b.groups[key]
+	if !ok {
+		g = &histGroup{base: base, tags: tags, points: make(map[int64]*p2cHistogram)}
+		b.groups[key] = g
+	}
+	if g.kind == "" {
+		g.kind = kind
+	}
+	return g
+}
+
+// add takes series if it is part of a histogram or summary, returning
+// false if it should be stored as plain samples
+func (b *histBuilder) add(name string, series *remote.TimeSeries) bool {
+	var le, quantile *string
+	for _, label := range series.Labels {
+		switch label.Name {
+		case model.BucketLabel:
+			le = &label.Value
+		case model.QuantileLabel:
+			quantile = &label.Value
+		}
+	}
+
+	var (
+		g     *histGroup
+		bound float64
+		label string
+		err   error
+	)
+	switch {
+	case le != nil && strings.HasSuffix(name, "_bucket"):
+		if bound, err = strconv.ParseFloat(*le, 64); err != nil {
+			return false
+		}
+		label = *le
+		g = b.group(strings.TrimSuffix(name, "_bucket"), "histogram", series.Labels)
+	case quantile != nil:
+		if bound, err = strconv.ParseFloat(*quantile, 64); err != nil {
+			return false
+		}
+		label = *quantile
+		g = b.group(name, "summary", series.Labels)
+	case strings.HasSuffix(name, "_sum"), strings.HasSuffix(name, "_count"):
+		b.pending = append(b.pending, series)
+		return true
+	default:
+		return false
+	}
+
+	for _, sample := range series.Samples {
+		p := g.point(sample.TimestampMs)
+		p.bounds = append(p.bounds, bound)
+		p.labels = append(p.labels, label)
+		p.counts = append(p.counts, sample.Value)
+	}
+	return true
+}
+
+// finish returns the structured rows for the request. _sum and _count
+// series without a histogram or summary are passed to plain.
+func (b *histBuilder) finish(plain func(series *remote.TimeSeries)) []*p2cRequest {
+	for _, series := range b.pending {
+		name := seriesName(series)
+		suffix := "_sum"
+		if strings.HasSuffix(name, "_count") {
+			suffix = "_count"
+		}
+		key, _ := histTags(strings.TrimSuffix(name, suffix), series.Labels)
+		g, ok := b.groups[key]
+		if !ok {
+			plain(series)
+			continue
+		}
+		for _, sample := range series.Samples {
+			p := g.point(sample.TimestampMs)
+			if suffix == "_sum" {
+				p.sum = sample.Value
+			} else {
+				p.count = sample.Value
+			}
+		}
+	}
+
+	var reqs []*p2cRequest
+	for _, g := range b.groups {
+		for ts, p := range g.points {
+			sort.Sort(byBound{p})
+			reqs = append(reqs, &p2cRequest{
+				name: g.base,
+				tags: g.tags,
+				ts:   time.Unix(ts/1000, 0),
+				hist: p,
+			})
+		}
+	}
+	return reqs
+}
+
+// byBound sorts a histograms buckets by upper bound
+type byBound struct{ *p2cHistogram }
+
+func (h byBound) Len() int           { return len(h.bounds) }
+func (h byBound) Less(i, j int) bool { return h.bounds[i] < h.bounds[j] }
+func (h byBound) Swap(i, j int) {
+	h.bounds[i], h.bounds[j] = h.bounds[j], h.bounds[i]
+	h.labels[i], h.labels[j] = h.labels[j], h.labels[i]
+	h.counts[i], h.counts[j] = h.counts[j], h.counts[i]
+}
+
+// seriesName returns the __name__ label value of series
+func seriesName(series *remote.TimeSeries) string {
+	for _, label := range series.Labels {
+		if label.Name == model.MetricNameLabel {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// formatBound formats a bucket bound or quantile the way client libraries
+// do, for rows written before the label values were kept
+func formatBound(b float64) string {
+	if math.IsInf(b, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+// getHistSQL returns the select statement for the histogram rows that may
+// hold series matching query. Name matchers can only be applied in sql
+// for equality, as eg. foo_bucket is stored as foo. Bucket and quantile
+// matchers are left to scanHistograms. Unless raw, rows are aggregated
+// into tr.step buckets.
+func (r *p2cReader) getHistSQL(query *remote.Query, tr timeRange, raw bool, order string) string {
+	var (
+		matchers []*remote.LabelMatcher
+		names    []string
+	)
+	for _, m := range query.Matchers {
+		switch m.Name {
+		case model.BucketLabel, model.QuantileLabel:
+			continue
+		case model.MetricNameLabel:
+			if m.Type == remote.MatchType_EQUAL {
+				for _, n := range []string{m.Value, strings.TrimSuffix(m.Value, "_bucket"),
+					strings.TrimSuffix(m.Value, "_sum"), strings.TrimSuffix(m.Value, "_count")} {
+					names = append(names, fmt.Sprintf("'%s'", sqlEscaper.Replace(n)))
+				}
+			}
+			continue
+		}
+		matchers = append(matchers, m)
+	}
+
+	where := getMatchersSQL(matchers)
+	if len(names) > 0 {
+		where = append(where, fmt.Sprintf("name IN (%s)", strings.Join(names, ", ")))
+	}
+	whereSQL := fmt.Sprintf("WHERE date >= toDate(%d) AND ts >= toDateTime(%d) AND ts <= toDateTime(%d)",
+		tr.start, tr.start, tr.end)
+	if len(where) > 0 {
+		whereSQL += " AND " + strings.Join(where, " AND ")
+	}
+
+	// sum and count are followed by whether they were received
+	if raw {
+		hasSum, hasCount := histPresentSQL("sum"), histPresentSQL("count")
+		tempSQL := "SELECT toUInt32(ts) * 1000 AS t, name, tags, kind, bounds, bound_labels, counts, " +
+			"sum, %s, count, %s FROM %s.%s %s ORDER BY %s"
+		return fmt.Sprintf(tempSQL, hasSum, hasCount, r.conf.ChDB, r.conf.ChHistTable, whereSQL, order) +
+			r.getSettings()
+	}
+
+	// latest row per bucket, rows missing a component don't count for it
+	// and staleness markers are dropped as they are for plain samples
+	hasSum, hasCount := histValueSQL("sum"), histValueSQL("count")
+	hasBuckets := fmt.Sprintf("notEmpty(bounds) AND "+
+		"arrayAll(c -> reinterpretAsUInt64(reinterpretAsString(c)) != %d, counts)", staleNaN)
+	tempSQL := "SELECT (intDiv(toUInt32(ts), %d) * %d) * 1000 AS t, name, tags, kind, " +
+		"argMaxIf(bounds, ts, %s), argMaxIf(bound_labels, ts, %s), argMaxIf(counts, ts, %s), " +
+		"argMaxIf(sum, ts, %s), countIf(%s) > 0, " +
+		"argMaxIf(count, ts, %s), countIf(%s) > 0 " +
+		"FROM %s.%s %s GROUP BY t, name, tags, kind ORDER BY %s"
+	return fmt.Sprintf(tempSQL, tr.step, tr.step, hasBuckets, hasBuckets, hasBuckets,
+		hasSum, hasSum, hasCount, hasCount,
+		r.conf.ChDB, r.conf.ChHistTable, whereSQL, order) + r.getSettings()
+}
+
+// scanHistograms expands the histogram rows matching query into their
+// original series and calls fn for each sample that matches
+func (r *p2cReader) scanHistograms(ctx context.Context, query *remote.Query, tr timeRange, raw bool,
+	fn func(t int64, tags []string, value float64) error) (int, error) {
+
+	lms, err := newLabelMatchers(query.Matchers)
+	if err != nil {
+		return 0, err
+	}
+
+	sqlStr := r.getHistSQL(query, tr, raw, "t")
+	fmt.Fprintf(r.log, "query: running sql: %s\n\n", sqlStr)
+
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		fmt.Fprintf(r.log, "Error: query failed: %s", sqlStr)
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return 0, r.queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	rcount := 0
+	for rows.Next() {
+		rcount++
+		var (
+			t        int64
+			name     string
+			tags     []string
+			kind     string
+			bounds   []float64
+			blabels  []string
+			counts   []float64
+			sum      float64
+			hasSum   uint8
+			count    float64
+			hasCount uint8
+		)
+		err = rows.Scan(&t, &name, &tags, &kind, &bounds, &blabels, &counts, &sum, &hasSum, &count, &hasCount)
+		if err != nil {
+			fmt.Fprintf(r.log, "Error: scan: %s\n", err.Error())
+			continue
+		}
+
+		labels := make(map[string]string, len(tags)+1)
+		for _, tag := range tags {
+			if vals := strings.SplitN(tag, "=", 2); len(vals) == 2 {
+				labels[vals[0]] = vals[1]
+			}
+		}
+
+		// emit a sample for a component series if it matches the query
+		emit := func(cname, extra, extraVal string, value float64) error {
+			labels[model.MetricNameLabel] = cname
+			if extra != "" {
+				labels[extra] = extraVal
+				defer delete(labels, extra)
+			}
+			if !matchLabels(lms, labels) {
+				return nil
+			}
+			ctags := make([]string, 0, len(labels))
+			for k, v := range labels {
+				ctags = append(ctags, fmt.Sprintf("%s=%s", k, v))
+			}
+			sort.Strings(ctags)
+			return fn(t, ctags, value)
+		}
+
+		bname, le := name+"_bucket", model.BucketLabel
+		if kind == "summary" {
+			bname, le = name, model.QuantileLabel
+		}
+		for i := range bounds {
+			if i >= len(counts) {
+				break
+			}
+			bound := formatBound(bounds[i])
+			if i < len(blabels) {
+				bound = blabels[i]
+			}
+			if err = emit(bname, le, bound, counts[i]); err != nil {
+				return rcount, err
+			}
+		}
+		// a NaN sum or count that was received is a staleness marker
+		if hasSum == 1 {
+			if err = emit(name+"_sum", "", "", sum); err != nil {
+				return rcount, err
+			}
+		}
+		if hasCount == 1 {
+			if err = emit(name+"_count", "", "", count); err != nil {
+				return rcount, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return rcount, r.queryError(ctx, err)
+	}
+	return rcount, nil
+}
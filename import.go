@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// `prom2click import <format>` bulk loads existing data through the same
+// batching writer as the server. The clickhouse flags of the server apply.
+
+// importUsage lists the import formats
+const importUsage = `Usage: prom2click import <format> [flags]
+
+Formats:
+  tsdb         prometheus tsdb block directories
+  openmetrics  openmetrics or prometheus text format files
+`
+
+// stringsFlag is a flag that may be given more than once
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// importFilter selects the samples to import
+type importFilter struct {
+	start, end int64
+	matchers   [][]labelMatcher
+}
+
+// newImportFilter parses the start and end times and series selectors, a
+// series is imported if it matches any selector
+func newImportFilter(start, end string, selectors []string) (*importFilter, error) {
+	f := &importFilter{start: math.MinInt64, end: math.MaxInt64}
+	if start != "" {
+		t, err := parseTime(start, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		f.start = t.UnixNano() / 1e6
+	}
+	if end != "" {
+		t, err := parseTime(end, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		f.end = t.UnixNano() / 1e6
+	}
+	for _, s := range selectors {
+		matchers, err := parseSelector(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", s, err.Error())
+		}
+		lms, err := newLabelMatchers(matchers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", s, err.Error())
+		}
+		f.matchers = append(f.matchers, lms)
+	}
+	return f, nil
+}
+
+// overlaps returns whether [mint, maxt] overlaps the time range
+func (f *importFilter) overlaps(mint, maxt int64) bool {
+	return mint <= f.end && maxt >= f.start
+}
+
+// contains returns whether t is in the time range
+func (f *importFilter) contains(t int64) bool {
+	return t >= f.start && t <= f.end
+}
+
+// matches returns whether a series is selected
+func (f *importFilter) matches(labels []*remote.LabelPair) bool {
+	if len(f.matchers) == 0 {
+		return true
+	}
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	for _, lms := range f.matchers {
+		if matchLabels(lms, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// p2cImporter feeds imported samples to a writer
+type p2cImporter struct {
+	samples  uint64
+	series   uint64
+	requests chan *p2cRequest
+	writer   *p2cWriter
+	// the part being imported and the writer failures before it
+	ack    *importAck
+	failed uint64
+}
+
+// importAck counts the requests of a part of an import still to be written
+type importAck struct {
+	pending int64
+	done    chan struct{}
+}
+
+func newImportAck() *importAck {
+	// one pending until the part is ended
+	return &importAck{pending: 1, done: make(chan struct{})}
+}
+
+func (a *importAck) written(ok bool) {
+	if atomic.AddInt64(&a.pending, -1) == 0 {
+		close(a.done)
+	}
+}
+
+// NewP2CImporter starts a writer for an import, its metrics are registered
+// with reg
+func NewP2CImporter(conf *config, reg prometheus.Registerer) (*p2cImporter, error) {
+	im := new(p2cImporter)
+	im.requests = make(chan *p2cRequest, conf.ChanSize)
+	var err error
+	if im.writer, err = NewP2CWriter(conf, im.requests, reg); err != nil {
+		return nil, err
+	}
+	// imports can wait for a slow shard, nothing else is held up
+	im.writer.block = true
+	im.writer.Start()
+	im.begin()
+	return im, nil
+}
+
+// begin starts a part of the import, eg. a block, resetting the counts
+func (im *p2cImporter) begin() {
+	im.ack = newImportAck()
+	im.failed = im.writer.Failed()
+	atomic.StoreUint64(&im.samples, 0)
+	atomic.StoreUint64(&im.series, 0)
+}
+
+// end waits for the samples added since begin to be written, returning how
+// many of them failed
+func (im *p2cImporter) end() uint64 {
+	im.ack.written(true)
+	<-im.ack.done
+	return im.writer.Failed() - im.failed
+}
+
+// add queues the samples of a series
+func (im *p2cImporter) add(labels []*remote.LabelPair, samples []*remote.Sample) {
+	name, tags := seriesTags(labels)
+	atomic.AddInt64(&im.ack.pending, int64(len(samples)))
+	for _, s := range samples {
+		req := new(p2cRequest)
+		req.name = name
+		req.tags = tags
+		req.val = s.Value
+		req.ts = time.Unix(s.TimestampMs/1000, 0)
+		req.ack = im.ack
+		im.requests <- req
+	}
+	atomic.AddUint64(&im.samples, uint64(len(samples)))
+	atomic.AddUint64(&im.series, 1)
+}
+
+// finish waits for everything queued to be written and stops the writer,
+// returning the number of samples that failed since begin
+func (im *p2cImporter) finish() uint64 {
+	failed := im.end()
+	close(im.requests)
+	im.writer.Wait()
+	im.writer.Close()
+	return failed
+}
+
+// progress prints the samples and series imported every interval until
+// stop is closed
+func (im *p2cImporter) progress(what string, interval time.Duration, stop chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	tstart := time.Now()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			samples := atomic.LoadUint64(&im.samples)
+			fmt.Printf("%s: %d series, %d samples imported (%.0f samples/s)\n", what,
+				atomic.LoadUint64(&im.series), samples, float64(samples)/time.Since(tstart).Seconds())
+		}
+	}
+}
+
+// importState records what has been imported so an import can resume
+type importState struct {
+	path string
+	done map[string]bool
+}
+
+// readImportState reads the ids recorded in path, an empty path disables
+// resuming
+func readImportState(path string) (*importState, error) {
+	st := &importState{path: path, done: make(map[string]bool)}
+	if path == "" {
+		return st, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			st.done[id] = true
+		}
+	}
+	return st, scanner.Err()
+}
+
+// mark records id as imported
+func (st *importState) mark(id string) error {
+	st.done[id] = true
+	if st.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(st.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, id); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImport runs an import subcommand, returning the exit code
+func runImport(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Print(importUsage)
+		return 2
+	}
+	switch args[0] {
+	case "tsdb":
+		return importTSDB(args[1:])
+	case "openmetrics":
+		return importOpenMetrics(args[1:])
+	}
+	fmt.Printf("Error: unknown import format %q\n", args[0])
+	fmt.Print(importUsage)
+	return 2
+}
+
+// importTSDB imports the blocks of a prometheus data directory. Blocks are
+// imported one at a time and recorded in the state file once written, so
+// an interrupted import resumes with the first block not fully written.
+// The head block and wal aren't imported, snapshot or stop prometheus so
+// they're compacted into blocks first.
+func importTSDB(args []string) int {
+	cfg := new(config)
+	fs := flag.NewFlagSet("import tsdb", flag.ExitOnError)
+	addFlags(fs, cfg)
+
+	var selectors stringsFlag
+	dir := fs.String("dir", "", "The prometheus data directory (or a single block directory) to import.")
+	start := fs.String("start", "", "Only import samples at or after this RFC3339 or unix time.")
+	end := fs.String("end", "", "Only import samples at or before this RFC3339 or unix time.")
+	fs.Var(&selectors, "match", "Only import series matching this selector, eg. '{job=\"node\"}'. "+
+		"May be given more than once to import series matching any of them.")
+	state := fs.String("state", "tsdb-import.state", "File the ulids of imported blocks are recorded "+
+		"in, blocks already recorded are skipped. Empty disables resuming.")
+	progress := fs.Duration("progress", 10*time.Second, "How often to report progress, 0 disables it.")
+	fs.Parse(args)
+
+	if *dir == "" {
+		fmt.Println("Error: -dir is required")
+		fs.Usage()
+		return 2
+	}
+	filter, err := newImportFilter(*start, *end, selectors)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return 2
+	}
+	st, err := readImportState(*state)
+	if err != nil {
+		fmt.Printf("Error: reading import state: %s\n", err.Error())
+		return 1
+	}
+
+	blocks, err := listTSDBBlocks(*dir)
+	if err == nil && len(blocks) == 0 {
+		if _, serr := os.Stat(filepath.Join(*dir, "meta.json")); serr == nil {
+			blocks = []string{*dir}
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: listing blocks: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Found %d blocks in %s\n", len(blocks), *dir)
+
+	// one writer for all the blocks, its metrics aren't served
+	im, err := NewP2CImporter(cfg, prometheus.NewRegistry())
+	if err != nil {
+		return 1
+	}
+	defer im.finish()
+
+	var total, failed uint64
+	for i, path := range blocks {
+		meta, err := readTSDBMeta(path)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			return 1
+		}
+		what := fmt.Sprintf("block %s (%d/%d)", meta.ULID, i+1, len(blocks))
+		switch {
+		case st.done[meta.ULID]:
+			fmt.Printf("Skipping %s, already imported\n", what)
+			continue
+		case !filter.overlaps(meta.MinTime, meta.MaxTime-1):
+			fmt.Printf("Skipping %s, outside the time range\n", what)
+			continue
+		}
+
+		fmt.Printf("Importing %s: %s to %s, %d series, %d samples\n", what,
+			time.Unix(0, meta.MinTime*1e6).UTC().Format(time.RFC3339),
+			time.Unix(0, meta.MaxTime*1e6).UTC().Format(time.RFC3339),
+			meta.Stats.NumSeries, meta.Stats.NumSamples)
+		samples, nfailed, err := importTSDBBlock(im, path, filter, what, *progress)
+		total += samples
+		failed += nfailed
+		if err != nil {
+			fmt.Printf("Error: %s: %s\n", what, err.Error())
+			return 1
+		}
+		if nfailed > 0 {
+			fmt.Printf("Error: %s: %d of %d samples failed to write, not marking it imported\n",
+				what, nfailed, samples)
+			continue
+		}
+		if err = st.mark(meta.ULID); err != nil {
+			fmt.Printf("Error: recording import state: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("Imported %s: %d samples\n", what, samples)
+	}
+
+	fmt.Printf("Imported %d samples, %d failed\n", total-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// importTSDBBlock writes the selected samples of a block with im, returning
+// the number of samples queued and how many of them failed to write
+func importTSDBBlock(im *p2cImporter, path string, filter *importFilter, what string,
+	progress time.Duration) (uint64, uint64, error) {
+
+	b, err := openTSDBBlock(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer b.Close()
+
+	im.begin()
+	stop := make(chan struct{})
+	go im.progress(what, progress, stop)
+
+	var skipped int
+	for _, ref := range b.Series() {
+		labels, chunks, serr := b.SeriesAt(ref)
+		if serr != nil {
+			err = serr
+			break
+		}
+		if !filter.matches(labels) {
+			continue
+		}
+
+		var samples []*remote.Sample
+		for _, c := range chunks {
+			if !filter.overlaps(c.mint, c.maxt) {
+				continue
+			}
+			enc, data, cerr := b.Chunk(c.ref)
+			if cerr != nil {
+				err = cerr
+				break
+			}
+			// native histogram chunks aren't imported
+			if enc != chunkEncodingXOR {
+				skipped++
+				continue
+			}
+			it := newXORIterator(data)
+			for it.Next() {
+				t, v := it.At()
+				if filter.contains(t) && !b.Deleted(ref, t) {
+					samples = append(samples, &remote.Sample{Value: v, TimestampMs: t})
+				}
+			}
+			if it.Err() != nil {
+				err = fmt.Errorf("chunk %d: %s", c.ref, it.Err().Error())
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		if len(samples) > 0 {
+			im.add(labels, samples)
+		}
+	}
+
+	close(stop)
+	failed := im.end()
+	if skipped > 0 {
+		fmt.Printf("%s: skipped %d non float (native histogram) chunks\n", what, skipped)
+	}
+	return atomic.LoadUint64(&im.samples), failed, err
+}
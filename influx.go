@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// influx line protocol ingestion, see:
+// 	https://docs.influxdata.com/influxdb/v1/write_protocols/line_protocol_reference/
+// each numeric or boolean field becomes a sample of <measurement>_<field>
+// (or just <measurement> for a field named value, as telegrafs prometheus
+// output does) with the tags as labels. String fields are skipped.
+
+// influxPrecisions are the timestamp units in nanoseconds by precision
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"us": 1e3,
+	"µ":  1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60 * 1e9,
+	"h":  3600 * 1e9,
+}
+
+// influxWrite serves /influx/write and /api/v2/write. Valid lines are
+// written even if others fail to parse, the first error is returned.
+func (c *p2cServer) influxWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		influxError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	unit, ok := influxPrecisions[r.FormValue("precision")]
+	if !ok {
+		influxError(w, http.StatusBadRequest, fmt.Errorf("invalid precision %q", r.FormValue("precision")))
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			influxError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var (
+		req      p2cWriteRequest
+		firstErr error
+		lineno   = 0
+		now      = time.Now().UnixNano() / 1e6
+	)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineno++
+		series, err := parseInfluxLine(scanner.Text(), unit, now)
+		if err != nil {
+			c.influxInvalid.Inc()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("line %d: %s", lineno, err.Error())
+			}
+			continue
+		}
+		req.Timeseries = append(req.Timeseries, series...)
+	}
+	if err := scanner.Err(); err != nil {
+		influxError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c.process(&req)
+	if firstErr != nil {
+		influxError(w, http.StatusBadRequest, firstErr)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// influxError writes an influx style json error
+func influxError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": "invalid", "message": err.Error(), "error": err.Error()})
+}
+
+// parseInfluxLine parses a line of line protocol into a series per field,
+// unit is the timestamp unit in nanoseconds and now the default timestamp
+// in milliseconds. Blank and comment lines return no series.
+func parseInfluxLine(line string, unit, now int64) ([]*p2cTimeSeries, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+
+	sections := splitInflux(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("expected <measurement>[,<tags>] <fields> [<timestamp>]")
+	}
+
+	ts := now
+	if len(sections) == 3 {
+		t, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		if unit < 1e6 {
+			ts = t / (1e6 / unit)
+		} else {
+			ts = t * (unit / 1e6)
+		}
+	}
+
+	keys := splitInflux(sections[0], ',')
+	measurement := unescapeInflux(keys[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("missing measurement")
+	}
+	labels := make([]*remote.LabelPair, 0, len(keys))
+	for _, tag := range keys[1:] {
+		kv := splitInflux(tag, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		name := sanitizeName(unescapeInflux(kv[0]), false)
+		if name == model.MetricNameLabel {
+			continue
+		}
+		labels = append(labels, &remote.LabelPair{Name: name, Value: unescapeInflux(kv[1])})
+	}
+
+	var series []*p2cTimeSeries
+	for _, field := range splitInflux(sections[1], ',') {
+		kv := splitInflux(field, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		val, ok, err := parseInfluxValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %s", kv[0], err.Error())
+		}
+		if !ok {
+			continue
+		}
+
+		name := measurement
+		if key := unescapeInflux(kv[0]); key != "value" {
+			name += "_" + key
+		}
+		slabels := make([]*remote.LabelPair, 0, len(labels)+1)
+		slabels = append(slabels, &remote.LabelPair{Name: model.MetricNameLabel, Value: sanitizeName(name, true)})
+		series = append(series, &p2cTimeSeries{
+			Labels:  append(slabels, labels...),
+			Samples: []*remote.Sample{{Value: val, TimestampMs: ts}},
+		})
+	}
+	return series, nil
+}
+
+// parseInfluxValue parses a field value, returning false for strings
+func parseInfluxValue(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, fmt.Errorf("missing value")
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch s[len(s)-1] {
+	case '"':
+		return 0, false, nil
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil, err
+}
+
+// splitInflux splits s on sep where it isn't escaped or in a quoted string
+func splitInflux(s string, sep byte) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the escapes of commas, equals signs and spaces
+func unescapeInflux(s string) string {
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	return strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `, `\\`, `\`).Replace(s)
+}
+
+// sanitizeName replaces characters that aren't valid in a metric (or if
+// metric is unset, label) name with underscores
+func sanitizeName(s string, metric bool) string {
+	b := []byte(s)
+	for i := range b {
+		if !isNameChar(b[i], i == 0, metric) {
+			if b[i] >= '0' && b[i] <= '9' {
+				return sanitizeName("_"+s, metric)
+			}
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
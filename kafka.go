@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// kafkaBroker is a queueBroker on a kafka cluster
+type kafkaBroker struct {
+	topic    string
+	producer sarama.SyncProducer
+	group    sarama.ConsumerGroup
+}
+
+// newKafkaBroker connects a producer and/or a member of the kafka.group
+// consumer group to kafka.brokers
+func newKafkaBroker(conf *config, produce, consume bool) (*kafkaBroker, error) {
+	addrs := strings.Split(conf.KafkaBrokers, ",")
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "prom2click"
+	// consumer groups need 0.10.2 or later
+	cfg.Version = sarama.V1_0_0_0
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Compression = sarama.CompressionSnappy
+	cfg.Producer.Return.Successes = true
+	cfg.Consumer.Return.Errors = true
+	cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	var err error
+	b := &kafkaBroker{topic: conf.KafkaTopic}
+	if produce {
+		if b.producer, err = sarama.NewSyncProducer(addrs, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if consume {
+		if b.group, err = sarama.NewConsumerGroup(addrs, conf.KafkaGroup, cfg); err != nil {
+			b.close()
+			return nil, err
+		}
+		go func() {
+			for err := range b.group.Errors() {
+				fmt.Printf("Error: kafka: %s\n", err.Error())
+			}
+		}()
+	}
+	return b, nil
+}
+
+func (b *kafkaBroker) publish(value []byte) error {
+	_, _, err := b.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: b.topic,
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
+
+func (b *kafkaBroker) consume(ctx context.Context, fn func(ctx context.Context, claim queueClaim) error) error {
+	return b.group.Consume(ctx, []string{b.topic}, kafkaHandler(fn))
+}
+
+func (b *kafkaBroker) close() error {
+	var err error
+	if b.producer != nil {
+		err = b.producer.Close()
+	}
+	if b.group != nil {
+		if gerr := b.group.Close(); err == nil {
+			err = gerr
+		}
+	}
+	return err
+}
+
+// kafkaHandler runs a queue claim consumer for each claim of a session
+type kafkaHandler func(ctx context.Context, claim queueClaim) error
+
+func (h kafkaHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h kafkaHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h kafkaHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	c := &kafkaClaim{sess: sess, topic: claim.Topic(), msgs: make(chan *queueMessage)}
+	go func() {
+		defer close(c.msgs)
+		for m := range claim.Messages() {
+			select {
+			case c.msgs <- &queueMessage{partition: m.Partition, offset: m.Offset, value: m.Value}:
+			case <-sess.Context().Done():
+				return
+			}
+		}
+	}()
+	return h(sess.Context(), c)
+}
+
+// kafkaClaim is a partition claimed in a consumer group session
+type kafkaClaim struct {
+	sess  sarama.ConsumerGroupSession
+	topic string
+	msgs  chan *queueMessage
+}
+
+func (c *kafkaClaim) messages() <-chan *queueMessage {
+	return c.msgs
+}
+
+// commit marks the offset after msg, which sarama commits periodically and
+// when the session ends. Marks after the session ended are ignored.
+func (c *kafkaClaim) commit(msg *queueMessage) {
+	c.sess.MarkOffset(c.topic, msg.partition, msg.offset+1, "")
+}
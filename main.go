@@ -12,18 +12,59 @@ import (
 
 type config struct {
 	//tcp://host1:9000?username=user&password=qwerty&database=clicks&read_timeout=10&write_timeout=20&alt_hosts=host2:9000,host3:9000
-	ChDSN           string
-	ChDB            string
-	ChTable         string
-	ChBatch         int
-	ChanSize        int
-	CHQuantile      float64
-	CHMaxSamples    int
-	CHMinPeriod     int
-	HTTPTimeout     time.Duration
-	HTTPAddr        string
-	HTTPWritePath   string
-	HTTPMetricsPath string
+	ChDSN                 string
+	ChDB                  string
+	ChTable               string
+	ChShards              string
+	ChShardWeights        string
+	ChShardTable          string
+	ChBatch               int
+	ChBatchLinger         time.Duration
+	ChanSize              int
+	CHQuantile            float64
+	CHMaxSamples          int
+	CHMinPeriod           int
+	CHMaxQueryTime        time.Duration
+	CHMaxRowsToRead       int
+	CHRollup              string
+	CHRollupConfig        string
+	CHDownsample          string
+	CHDownsampleCreate    bool
+	ChHistograms          bool
+	ChHistTable           string
+	ChNativeHistograms    bool
+	ChNativeTable         string
+	ChExemplars           bool
+	ChExemplarTable       string
+	ChMetadata            bool
+	ChMetaTable           string
+	ReadRaw               bool
+	ReadMaxSeries         int
+	ReadMaxSamples        int
+	ReadCacheSize         int
+	ReadCacheTTL          time.Duration
+	ReadCacheMinAge       time.Duration
+	ReadSplitInterval     time.Duration
+	ReadSplitWorkers      int
+	RetentionRules        string
+	RetentionInterval     time.Duration
+	RetentionDryRun       bool
+	RetentionCluster      string
+	WriteCreatedZero      bool
+	GraphiteAddress       string
+	GraphitePickleAddress string
+	GraphiteTemplates     string
+	ForwardConfig         string
+	KafkaMode             string
+	KafkaBrokers          string
+	KafkaTopic            string
+	KafkaGroup            string
+	KafkaLinger           time.Duration
+	FederateLookback      time.Duration
+	HTTPTimeout           time.Duration
+	HTTPAddr              string
+	HTTPWritePath         string
+	HTTPMetricsPath       string
 }
 
 var (
@@ -33,6 +74,16 @@ var (
 func main() {
 	excode := 0
 
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		}
+	}
+
 	conf := parseFlags()
 
 	if versionFlag {
@@ -70,10 +121,19 @@ func parseFlags() *config {
 	// print version?
 	flag.BoolVar(&versionFlag, "version", false, "Version")
 
+	addFlags(flag.CommandLine, cfg)
+	flag.Parse()
+
+	return cfg
+}
+
+// addFlags registers the clickhouse, read, write and web flags on fs, these
+// are shared by the server and the import commands
+func addFlags(fs *flag.FlagSet, cfg *config) {
 	// clickhouse dsn
 	ddsn := "tcp://127.0.0.1:9000?username=&password=&database=metrics&" +
 		"read_timeout=10&write_timeout=10&alt_hosts="
-	flag.StringVar(&cfg.ChDSN, "ch.dsn", ddsn,
+	fs.StringVar(&cfg.ChDSN, "ch.dsn", ddsn,
 		"The clickhouse server DSN to write to eg."+
 			"tcp://host1:9000?username=user&password=qwerty&database=clicks&"+
 			"read_timeout=10&write_timeout=20&alt_hosts=host2:9000,host3:9000"+
@@ -81,34 +141,61 @@ func parseFlags() *config {
 	)
 
 	// clickhouse db
-	flag.StringVar(&cfg.ChDB, "ch.db", "metrics",
+	fs.StringVar(&cfg.ChDB, "ch.db", "metrics",
 		"The clickhouse database to write to.",
 	)
 
 	// clickhouse table
-	flag.StringVar(&cfg.ChTable, "ch.table", "samples",
+	fs.StringVar(&cfg.ChTable, "ch.table", "samples",
 		"The clickhouse table to write to.",
 	)
 
+	// clickhouse shards for client side sharding of writes
+	fs.StringVar(&cfg.ChShards, "ch.shards", "",
+		"Semicolon separated list of clickhouse shard DSNs. When set, samples are "+
+			"written directly to ch.shardtable on the shard selected by sipHash64(name), "+
+			"the same sharding key as the Distributed table in schema.sql. The shards "+
+			"must be listed in the same order as the clickhouse remote_servers config. "+
+			"Histogram, exemplar and metadata rows are still written via ch.dsn, shown "+
+			"as the shard after the last in the shard metrics.",
+	)
+
+	// clickhouse shard weights
+	fs.StringVar(&cfg.ChShardWeights, "ch.shardweights", "",
+		"Comma separated list of shard weights matching ch.shards (default 1 each).",
+	)
+
+	// clickhouse local table to write to on each shard
+	fs.StringVar(&cfg.ChShardTable, "ch.shardtable", "samples",
+		"The clickhouse table to write to on each shard when ch.shards is set.",
+	)
+
 	// clickhouse insertion batch size
-	flag.IntVar(&cfg.ChBatch, "ch.batch", 8192,
+	fs.IntVar(&cfg.ChBatch, "ch.batch", 8192,
 		"Clickhouse write batch size (n metrics).",
 	)
 
+	// clickhouse insertion batch linger
+	fs.DurationVar(&cfg.ChBatchLinger, "ch.batchlinger", 10*time.Second,
+		"Longest to wait for a clickhouse write batch to fill before writing it anyway.",
+	)
+
 	// channel buffer size between http server => clickhouse writer(s)
-	flag.IntVar(&cfg.ChanSize, "ch.buffer", 8192,
-		"Maximum internal channel buffer size (n requests).",
+	fs.IntVar(&cfg.ChanSize, "ch.buffer", 8192,
+		"Maximum internal channel buffer size (n requests). With ch.shards, requests for "+
+			"a shard whose buffer is full are dropped and counted as failed so the other "+
+			"shards aren't held up, otherwise writes wait for room.",
 	)
 
 	// quantile (eg. 0.9 for 90th) for aggregation of timeseries values from CH
-	flag.Float64Var(&cfg.CHQuantile, "ch.quantile", 0.75,
+	fs.Float64Var(&cfg.CHQuantile, "ch.quantile", 0.75,
 		"Quantile/Percentile for time series aggregation when the number "+
 			"of points exceeds ch.maxsamples.",
 	)
 
 	// maximum number of samples to return
 	// todo: fixup strings.. yuck.
-	flag.IntVar(&cfg.CHMaxSamples, "ch.maxsamples", 8192,
+	fs.IntVar(&cfg.CHMaxSamples, "ch.maxsamples", 8192,
 		"Maximum number of samples to return to Prometheus for a remote read "+
 			"request - the minimum accepted value is 50. "+
 			"Note: if you set this too low there can be issues displaying graphs in grafana. "+
@@ -122,31 +209,250 @@ func parseFlags() *config {
 	}
 
 	// http shutdown and request timeout
-	flag.IntVar(&cfg.CHMinPeriod, "ch.minperiod", 10,
+	fs.IntVar(&cfg.CHMinPeriod, "ch.minperiod", 10,
 		"The minimum time range for Clickhouse time aggregation in seconds.",
 	)
 
+	// graphite rollup retentions
+	fs.StringVar(&cfg.CHRollup, "ch.rollup", "",
+		"Comma separated age:precision pairs in seconds matching the graphite_rollup "+
+			"retentions of the samples table, eg. 0:10,86400:30,172800:300. Remote reads "+
+			"never aggregate finer than the precision data of a given age is stored at.",
+	)
+
+	// clickhouse config to read graphite rollup retentions from
+	fs.StringVar(&cfg.CHRollupConfig, "ch.rollupconfig", "",
+		"Path to a clickhouse server config.xml to read the default graphite_rollup "+
+			"retentions from instead of ch.rollup.",
+	)
+
+	// downsampled tables
+	fs.StringVar(&cfg.CHDownsample, "ch.downsample", "",
+		"Comma separated bucket sizes of downsampled tables named <ch.table>_<size>, "+
+			"eg. 5m,1h. Remote reads with a step that is a multiple of a bucket size "+
+			"read the mean of each bucket from the coarsest such table. Not supported "+
+			"with ch.shards.",
+	)
+
+	// create downsampled tables and views
+	fs.BoolVar(&cfg.CHDownsampleCreate, "ch.downsamplecreate", false,
+		"Create the ch.downsample tables and the materialized views feeding them "+
+			"from ch.table at startup if they don't exist. Only data written after the "+
+			"views are created is downsampled, older ranges are read from ch.table.",
+	)
+
+	// structured histograms
+	fs.BoolVar(&cfg.ChHistograms, "ch.histograms", false,
+		"Store the buckets, sum and count of histograms and the quantiles, sum and "+
+			"count of summaries as a single row per timestamp in ch.histtable rather "+
+			"than a row per series. Remote reads expand them back into the original series.",
+	)
+
+	// structured histogram table
+	fs.StringVar(&cfg.ChHistTable, "ch.histtable", "histograms",
+		"The clickhouse table to write histograms and summaries to with ch.histograms.",
+	)
+
+	// native histograms
+	fs.BoolVar(&cfg.ChNativeHistograms, "ch.nativehistograms", false,
+		"Store native histogram samples from remote writes in ch.nativetable and "+
+			"return them in remote reads. When disabled they are counted and dropped.",
+	)
+
+	// native histogram table
+	fs.StringVar(&cfg.ChNativeTable, "ch.nativetable", "native_histograms",
+		"The clickhouse table to write native histograms to with ch.nativehistograms.",
+	)
+
+	// exemplars
+	fs.BoolVar(&cfg.ChExemplars, "ch.exemplars", false,
+		"Store exemplars from remote writes in ch.exemplartable and serve them "+
+			"from /api/v1/query_exemplars.",
+	)
+
+	// exemplar table
+	fs.StringVar(&cfg.ChExemplarTable, "ch.exemplartable", "exemplars",
+		"The clickhouse table to write exemplars to with ch.exemplars.",
+	)
+
+	// metadata
+	fs.BoolVar(&cfg.ChMetadata, "ch.metadata", false,
+		"Store metric metadata (HELP, TYPE and UNIT) from remote writes in "+
+			"ch.metatable and serve it from /api/v1/metadata.",
+	)
+
+	// metadata table
+	fs.StringVar(&cfg.ChMetaTable, "ch.metatable", "metadata",
+		"The clickhouse table to write metric metadata to with ch.metadata.",
+	)
+
+	// maximum remote read query duration
+	fs.DurationVar(&cfg.CHMaxQueryTime, "ch.maxquerytime", 30*time.Second,
+		"Maximum duration of a remote read query. The query is cancelled and "+
+			"clickhouse max_execution_time is set accordingly. 0 disables the limit.",
+	)
+
+	// maximum rows clickhouse may read for a remote read query
+	fs.IntVar(&cfg.CHMaxRowsToRead, "ch.maxrowstoread", 0,
+		"Maximum number of rows clickhouse may read for a remote read query "+
+			"(max_rows_to_read setting). 0 disables the limit.",
+	)
+
+	// raw remote reads
+	fs.BoolVar(&cfg.ReadRaw, "read.raw", false,
+		"Return raw samples for remote read requests rather than aggregating them "+
+			"into ch.maxsamples buckets. Staleness markers are returned as written.",
+	)
+
+	// maximum series returned for a remote read request
+	fs.IntVar(&cfg.ReadMaxSeries, "read.maxseries", 0,
+		"Maximum number of series a remote read request may return before it "+
+			"is aborted with an error. 0 disables the limit.",
+	)
+
+	// maximum samples returned for a remote read request
+	fs.IntVar(&cfg.ReadMaxSamples, "read.maxsamples", 0,
+		"Maximum number of samples a remote read request may return before it "+
+			"is aborted with an error. 0 disables the limit.",
+	)
+
+	// remote read result cache size
+	fs.IntVar(&cfg.ReadCacheSize, "read.cachesize", 0,
+		"Maximum number of samples to hold in the remote read result cache. "+
+			"Only queries for time ranges older than read.cacheminage are cached. "+
+			"0 disables the cache.",
+	)
+
+	// remote read result cache ttl
+	fs.DurationVar(&cfg.ReadCacheTTL, "read.cachettl", 10*time.Minute,
+		"How long remote read results are cached for.",
+	)
+
+	// minimum age of a time range before it can be cached
+	fs.DurationVar(&cfg.ReadCacheMinAge, "read.cacheminage", 5*time.Minute,
+		"Minimum age of the end of a remote read query time range before its "+
+			"results are cached, this should cover the write batching delay.",
+	)
+
+	// remote read query split interval
+	fs.DurationVar(&cfg.ReadSplitInterval, "read.splitinterval", 24*time.Hour,
+		"Remote read queries spanning more than this are split into sub-queries "+
+			"aligned to this interval which run concurrently. 0 disables splitting.",
+	)
+
+	// remote read query split concurrency
+	fs.IntVar(&cfg.ReadSplitWorkers, "read.splitworkers", 4,
+		"Maximum number of sub-queries of a split remote read query to run concurrently.",
+	)
+
+	// retention rules
+	fs.StringVar(&cfg.RetentionRules, "retention.rules", "",
+		"Path to a file of retention rules, one '<selector> <retention>' per line "+
+			"eg. '{__name__=~\"node_.*\"} 90d'. The first rule a series matches "+
+			"applies, '{}' matches all series. Expired rows are deleted from the samples, "+
+			"downsampled, histogram, exemplar and metadata tables in use every "+
+			"retention.interval. Unset disables retention management.",
+	)
+
+	// retention interval
+	fs.DurationVar(&cfg.RetentionInterval, "retention.interval", time.Hour,
+		"How often retention rules are applied.",
+	)
+
+	// retention dry run
+	fs.BoolVar(&cfg.RetentionDryRun, "retention.dryrun", false,
+		"Report what retention rules would delete without deleting anything.",
+	)
+
+	// cluster to delete expired samples on
+	fs.StringVar(&cfg.RetentionCluster, "retention.cluster", "",
+		"Without ch.shards, the clickhouse cluster of a Distributed ch.table. Expired "+
+			"samples are deleted from ch.shardtable on each of its servers with ON CLUSTER, "+
+			"as mutations aren't supported on Distributed tables.",
+	)
+
+	// created timestamp zero samples
+	fs.BoolVar(&cfg.WriteCreatedZero, "write.createdzero", false,
+		"For remote write 2.0 requests, write a zero sample at the created timestamp "+
+			"of counters, histograms and summaries when it precedes their first sample.",
+	)
+
+	// graphite plaintext listen address
+	fs.StringVar(&cfg.GraphiteAddress, "graphite.address", "",
+		"Address to listen on for graphite plaintext protocol over tcp and udp, eg. :2003. "+
+			"Disabled if empty.",
+	)
+
+	// graphite pickle listen address
+	fs.StringVar(&cfg.GraphitePickleAddress, "graphite.pickleaddress", "",
+		"Address to listen on for graphite pickle protocol over tcp, eg. :2004. "+
+			"Disabled if empty.",
+	)
+
+	// graphite templates
+	fs.StringVar(&cfg.GraphiteTemplates, "graphite.templates", "",
+		"Path to a file of templates converting graphite paths to a metric name and "+
+			"labels, one '[filter] <template> [tag=value,...]' per line. Without a matching "+
+			"template the dots of a path are replaced with underscores.",
+	)
+
+	// federation lookback
+	fs.DurationVar(&cfg.FederateLookback, "federate.lookback", 5*time.Minute,
+		"How far back /federate looks for the latest sample of each series.",
+	)
+
+	// remote write forwarding
+	fs.StringVar(&cfg.ForwardConfig, "forward.config", "",
+		"Path to a file of remote write urls to forward accepted writes to, one "+
+			"'<url> [queue=10000] [shards=4] [batch=500] [linger=1s] [retries=10] [minbackoff=100ms] "+
+			"[maxbackoff=30s] [timeout=30s]' per line.",
+	)
+
+	// kafka mode
+	fs.StringVar(&cfg.KafkaMode, "kafka.mode", "",
+		"Write through a kafka topic: producer publishes what the write endpoints accept to "+
+			"kafka.topic instead of writing it to clickhouse, consumer writes what's published to "+
+			"clickhouse, both does both. Empty writes directly.",
+	)
+
+	// kafka brokers
+	fs.StringVar(&cfg.KafkaBrokers, "kafka.brokers", "localhost:9092",
+		"Comma separated kafka broker addresses, or memory for an in-process stand-in that "+
+			"only works with -kafka.mode=both and loses anything unwritten on restart.",
+	)
+
+	// kafka topic
+	fs.StringVar(&cfg.KafkaTopic, "kafka.topic", "prom2click",
+		"The kafka topic to publish to and consume from.",
+	)
+
+	// kafka consumer group
+	fs.StringVar(&cfg.KafkaGroup, "kafka.group", "prom2click",
+		"The kafka consumer group consumers commit their offsets in.",
+	)
+
+	// kafka producer linger
+	fs.DurationVar(&cfg.KafkaLinger, "kafka.linger", time.Second,
+		"How long a producer waits to fill a batch of ch.batch samples before publishing it.",
+	)
+
 	// http listen address
-	flag.StringVar(&cfg.HTTPAddr, "web.address", ":9201",
+	fs.StringVar(&cfg.HTTPAddr, "web.address", ":9201",
 		"Address to listen on for web endpoints.",
 	)
 
 	// http prometheus remote write endpoint
-	flag.StringVar(&cfg.HTTPWritePath, "web.write", "/write",
+	fs.StringVar(&cfg.HTTPWritePath, "web.write", "/write",
 		"Address to listen on for remote write requests.",
 	)
 
 	// http prometheus metrics endpoint
-	flag.StringVar(&cfg.HTTPMetricsPath, "web.metrics", "/metrics",
+	fs.StringVar(&cfg.HTTPMetricsPath, "web.metrics", "/metrics",
 		"Address to listen on for metric requests.",
 	)
 
 	// http shutdown and request timeout
-	flag.DurationVar(&cfg.HTTPTimeout, "web.timeout", 30*time.Second,
+	fs.DurationVar(&cfg.HTTPTimeout, "web.timeout", 30*time.Second,
 		"The timeout to use for HTTP requests and server shutdown. Defaults to 30s.",
 	)
-
-	flag.Parse()
-
-	return cfg
 }
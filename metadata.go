@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+)
+
+// with ch.metadata the HELP, TYPE and UNIT of metrics received via remote
+// write are stored in ch.metatable, a ReplacingMergeTree keyed on metric
+// name, and served from /api/v1/metadata
+
+var insertMetadataSQL = `INSERT INTO %s.%s
+	(date, name, type, help, unit, updated)
+	VALUES	(?, ?, ?, ?, ?, ?)`
+
+// metadataRefresh is how often unchanged metadata is written again, so it
+// is restored if the table is truncated while we are running
+const metadataRefresh = time.Hour
+
+// metricMetadata is a prompb.MetricMetadata
+type metricMetadata struct {
+	Type             int32  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
+	MetricFamilyName string `protobuf:"bytes,2,opt,name=metric_family_name,json=metricFamilyName,proto3" json:"metric_family_name,omitempty"`
+	Help             string `protobuf:"bytes,4,opt,name=help,proto3" json:"help,omitempty"`
+	Unit             string `protobuf:"bytes,5,opt,name=unit,proto3" json:"unit,omitempty"`
+}
+
+func (m *metricMetadata) Reset()         { *m = metricMetadata{} }
+func (m *metricMetadata) String() string { return proto.CompactTextString(m) }
+func (*metricMetadata) ProtoMessage()    {}
+
+// metricTypeNames are the names the prometheus api uses for metric types
+var metricTypeNames = map[int32]string{
+	metricTypeUnknown:        "unknown",
+	metricTypeCounter:        "counter",
+	metricTypeGauge:          "gauge",
+	metricTypeHistogram:      "histogram",
+	metricTypeGaugeHistogram: "gaugehistogram",
+	metricTypeSummary:        "summary",
+	metricTypeInfo:           "info",
+	metricTypeStateset:       "stateset",
+}
+
+// p2cMetadata is one metadata row, also the json of /api/v1/metadata
+type p2cMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+func newMetadata(m *metricMetadata) p2cMetadata {
+	typ, ok := metricTypeNames[m.Type]
+	if !ok {
+		typ = metricTypeNames[metricTypeUnknown]
+	}
+	return p2cMetadata{Type: typ, Help: m.Help, Unit: m.Unit}
+}
+
+// metadataCache remembers the metadata last written for each metric
+type metadataCache struct {
+	mtx  sync.Mutex
+	seen map[string]metadataSeen
+}
+
+type metadataSeen struct {
+	meta p2cMetadata
+	at   time.Time
+}
+
+func newMetadataCache() *metadataCache {
+	return &metadataCache{seen: make(map[string]metadataSeen)}
+}
+
+// changed returns true if meta should be written for name, ie. it differs
+// from what was last written or that was over metadataRefresh ago. It's
+// recorded as written so it isn't queued again meanwhile, a failed write
+// forgets it through metadataAck.
+func (mc *metadataCache) changed(name string, meta p2cMetadata, now time.Time) bool {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+	if s, ok := mc.seen[name]; ok && s.meta == meta && now.Sub(s.at) < metadataRefresh {
+		return false
+	}
+	mc.seen[name] = metadataSeen{meta, now}
+	return true
+}
+
+// forget removes the entry for name if it's still seen
+func (mc *metadataCache) forget(name string, seen metadataSeen) {
+	mc.mtx.Lock()
+	defer mc.mtx.Unlock()
+	if s, ok := mc.seen[name]; ok && s.meta == seen.meta && s.at.Equal(seen.at) {
+		delete(mc.seen, name)
+	}
+}
+
+// metadataAck forgets metadata that failed to write so the next request
+// carrying it writes it again
+type metadataAck struct {
+	cache *metadataCache
+	name  string
+	seen  metadataSeen
+}
+
+func (a *metadataAck) written(ok bool) {
+	if !ok {
+		a.cache.forget(a.name, a.seen)
+	}
+}
+
+// metadataTable returns the writers table for metadata rows
+func (w *p2cWriter) metadataTable() *p2cTable {
+	return &p2cTable{
+		sql: fmt.Sprintf(insertMetadataSQL, w.conf.ChDB, w.conf.ChMetaTable),
+		exec: func(smt *sql.Stmt, req *p2cRequest) error {
+			m := req.meta
+			// a fixed date keeps every row in one partition so they're
+			// all deduplicated
+			_, err := smt.Exec(time.Unix(0, 0), req.name, m.Type, m.Help, m.Unit, req.ts)
+			return err
+		},
+	}
+}
+
+// enqueueMetadata queues a request for each metadata entry that changed
+func (c *p2cServer) enqueueMetadata(metadata []*metricMetadata) {
+	now := time.Now()
+	for _, m := range metadata {
+		if m.MetricFamilyName == "" {
+			continue
+		}
+		meta := newMetadata(m)
+		if !c.metaCache.changed(m.MetricFamilyName, meta, now) {
+			continue
+		}
+		c.requests <- &p2cRequest{
+			name: m.MetricFamilyName,
+			ts:   now,
+			meta: &meta,
+			ack:  &metadataAck{c.metaCache, m.MetricFamilyName, metadataSeen{meta, now}},
+		}
+	}
+}
+
+// QueryMetadata returns the metadata of metric, or all metrics if empty,
+// limited to limit metrics if > 0
+func (r *p2cReader) QueryMetadata(ctx context.Context, metric string, limit int) (map[string][]p2cMetadata, error) {
+	sqlStr := fmt.Sprintf("SELECT name, type, help, unit FROM %s.%s FINAL", r.conf.ChDB, r.conf.ChMetaTable)
+	if metric != "" {
+		sqlStr += fmt.Sprintf(" WHERE name = '%s'", sqlEscaper.Replace(metric))
+	}
+	sqlStr += " ORDER BY name"
+	if limit > 0 {
+		sqlStr += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	sqlStr += r.getSettings()
+	fmt.Fprintf(r.log, "query: running sql: %s\n\n", sqlStr)
+
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		fmt.Fprintf(r.log, "Error: query failed: %s", sqlStr)
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return nil, r.queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	res := make(map[string][]p2cMetadata)
+	for rows.Next() {
+		var (
+			name string
+			meta p2cMetadata
+		)
+		if err = rows.Scan(&name, &meta.Type, &meta.Help, &meta.Unit); err != nil {
+			fmt.Fprintf(r.log, "Error: scan: %s\n", err.Error())
+			continue
+		}
+		res[name] = append(res[name], meta)
+	}
+	if err = rows.Err(); err != nil {
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return nil, r.queryError(ctx, err)
+	}
+	return res, nil
+}
+
+// queryMetadata serves /api/v1/metadata
+func (c *p2cServer) queryMetadata(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", s))
+			return
+		}
+	}
+	metric := r.FormValue("metric")
+	if metric != "" && !model.IsValidMetricName(model.LabelValue(metric)) {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid metric name %q", metric))
+		return
+	}
+	if !c.conf.ChMetadata {
+		apiData(w, map[string][]p2cMetadata{})
+		return
+	}
+
+	ctx := r.Context()
+	if c.conf.CHMaxQueryTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.conf.CHMaxQueryTime)
+		defer cancel()
+	}
+
+	meta, err := c.reader.QueryMetadata(ctx, metric, limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiData(w, meta)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kshvakov/clickhouse"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// with ch.nativehistograms native histogram samples are stored in
+// ch.nativetable, one row per sample with the bucket spans of each sign as
+// parallel offset/length arrays and the bucket counts as absolute values.
+
+var insertNativeSQL = `INSERT INTO %s.%s
+	(date, name, tags, schema, zero_threshold, zero_count, count, sum,
+	positive_offsets, positive_lengths, positive_buckets,
+	negative_offsets, negative_lengths, negative_buckets,
+	custom_values, reset_hint, float, ts)
+	VALUES	(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// p2cNativeHistogram is one native histogram row
+type p2cNativeHistogram struct {
+	schema        int32
+	zeroThreshold float64
+	zeroCount     float64
+	count         float64
+	sum           float64
+	posOffsets    []int32
+	posLengths    []uint32
+	posBuckets    []float64
+	negOffsets    []int32
+	negLengths    []uint32
+	negBuckets    []float64
+	customValues  []float64
+	resetHint     uint8
+	// 1 for float histograms, 0 for integer ones
+	float uint8
+}
+
+// newNativeHistogram converts a native histogram sample to a row
+func newNativeHistogram(h *histogram) *p2cNativeHistogram {
+	n := &p2cNativeHistogram{
+		schema:        h.Schema,
+		zeroThreshold: h.ZeroThreshold,
+		sum:           h.Sum,
+		customValues:  append([]float64(nil), h.CustomValues...),
+		resetHint:     uint8(h.ResetHint),
+	}
+	n.posOffsets, n.posLengths = splitSpans(h.PositiveSpans)
+	n.negOffsets, n.negLengths = splitSpans(h.NegativeSpans)
+
+	if h.isFloat() {
+		n.float = 1
+		n.count = h.CountFloat
+		n.zeroCount = h.ZeroCountFloat
+		n.posBuckets = append([]float64(nil), h.PositiveCounts...)
+		n.negBuckets = append([]float64(nil), h.NegativeCounts...)
+		return n
+	}
+	n.count = float64(h.CountInt)
+	n.zeroCount = float64(h.ZeroCountInt)
+	n.posBuckets = undelta(h.PositiveDeltas)
+	n.negBuckets = undelta(h.NegativeDeltas)
+	return n
+}
+
+// histogram converts the row back to a native histogram sample at t
+func (n *p2cNativeHistogram) histogram(t int64) *histogram {
+	h := &histogram{
+		Sum:           n.sum,
+		Schema:        n.schema,
+		ZeroThreshold: n.zeroThreshold,
+		NegativeSpans: joinSpans(n.negOffsets, n.negLengths),
+		PositiveSpans: joinSpans(n.posOffsets, n.posLengths),
+		CustomValues:  n.customValues,
+		ResetHint:     int32(n.resetHint),
+		TimestampMs:   t,
+	}
+	if n.float == 1 {
+		h.CountFloat = n.count
+		h.ZeroCountFloat = n.zeroCount
+		h.PositiveCounts = n.posBuckets
+		h.NegativeCounts = n.negBuckets
+		return h
+	}
+	h.CountInt = uint64(n.count)
+	h.ZeroCountInt = uint64(n.zeroCount)
+	h.PositiveDeltas = delta(n.posBuckets)
+	h.NegativeDeltas = delta(n.negBuckets)
+	return h
+}
+
+func splitSpans(spans []*bucketSpan) ([]int32, []uint32) {
+	offsets := make([]int32, 0, len(spans))
+	lengths := make([]uint32, 0, len(spans))
+	for _, s := range spans {
+		offsets = append(offsets, s.Offset)
+		lengths = append(lengths, s.Length)
+	}
+	return offsets, lengths
+}
+
+func joinSpans(offsets []int32, lengths []uint32) []*bucketSpan {
+	spans := make([]*bucketSpan, 0, len(offsets))
+	for i := range offsets {
+		if i >= len(lengths) {
+			break
+		}
+		spans = append(spans, &bucketSpan{Offset: offsets[i], Length: lengths[i]})
+	}
+	return spans
+}
+
+// undelta returns the absolute bucket counts of delta encoded ones
+func undelta(deltas []int64) []float64 {
+	buckets := make([]float64, 0, len(deltas))
+	var cur int64
+	for _, d := range deltas {
+		cur += d
+		buckets = append(buckets, float64(cur))
+	}
+	return buckets
+}
+
+// delta returns the delta encoding of absolute bucket counts
+func delta(buckets []float64) []int64 {
+	deltas := make([]int64, 0, len(buckets))
+	var prev int64
+	for _, b := range buckets {
+		cur := int64(b)
+		deltas = append(deltas, cur-prev)
+		prev = cur
+	}
+	return deltas
+}
+
+// nativeTable returns the writers table for native histogram rows
+func (w *p2cWriter) nativeTable() *p2cTable {
+	return &p2cTable{
+		sql: fmt.Sprintf(insertNativeSQL, w.conf.ChDB, w.conf.ChNativeTable),
+		exec: func(smt *sql.Stmt, req *p2cRequest) error {
+			n := req.native
+			_, err := smt.Exec(req.ts, req.name, clickhouse.Array(req.tags), n.schema,
+				n.zeroThreshold, n.zeroCount, n.count, n.sum,
+				clickhouse.Array(n.posOffsets), clickhouse.Array(n.posLengths), clickhouse.Array(n.posBuckets),
+				clickhouse.Array(n.negOffsets), clickhouse.Array(n.negLengths), clickhouse.Array(n.negBuckets),
+				clickhouse.Array(n.customValues), n.resetHint, n.float, req.ts)
+			return err
+		},
+	}
+}
+
+// enqueueNative queues a request per native histogram sample of series
+func (c *p2cServer) enqueueNative(series *p2cTimeSeries) {
+	name, tags := seriesTags(series.Labels)
+	for _, h := range series.Histograms {
+		c.requests <- &p2cRequest{
+			name:   name,
+			tags:   tags,
+			ts:     time.Unix(h.TimestampMs/1000, 0),
+			native: newNativeHistogram(h),
+		}
+	}
+}
+
+// getNativeSQL returns the select statement for the native histograms
+// matching query. Histograms can't be averaged so unless reading raw
+// samples the last one in each step is returned.
+func (r *p2cReader) getNativeSQL(query *remote.Query, tr timeRange) string {
+	whereSQL := fmt.Sprintf("WHERE date >= toDate(%d) AND ts >= toDateTime(%d) AND ts <= toDateTime(%d)",
+		tr.start, tr.start, tr.end)
+	if where := getMatchersSQL(query.Matchers); len(where) > 0 {
+		whereSQL += " AND " + strings.Join(where, " AND ")
+	}
+
+	tempSQL := "SELECT toUInt32(ts) * 1000 AS t, tags, schema, zero_threshold, zero_count, count, sum, " +
+		"positive_offsets, positive_lengths, positive_buckets, " +
+		"negative_offsets, negative_lengths, negative_buckets, custom_values, reset_hint, float " +
+		"FROM %s.%s %s "
+	if r.conf.ReadRaw {
+		tempSQL += "ORDER BY name, tags, t"
+		return fmt.Sprintf(tempSQL, r.conf.ChDB, r.conf.ChNativeTable, whereSQL) + r.getSettings()
+	}
+	tempSQL += "ORDER BY name, tags, t DESC LIMIT 1 BY name, tags, intDiv(toUInt32(ts), %d)"
+	return fmt.Sprintf(tempSQL, r.conf.ChDB, r.conf.ChNativeTable, whereSQL, tr.step) + r.getSettings()
+}
+
+// queryNative returns the native histogram series matching q over tr.
+// Unlike samples these are neither split, rolled up nor cached.
+func (r *p2cReader) queryNative(ctx context.Context, q *remote.Query, tr timeRange,
+	limits *readLimits) ([]*p2cTimeSeries, int, error) {
+
+	sqlStr := r.getNativeSQL(q, tr)
+	fmt.Fprintf(r.log, "query: running sql: %s\n\n", sqlStr)
+
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		fmt.Fprintf(r.log, "Error: query failed: %s", sqlStr)
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return nil, 0, r.queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	var (
+		series []*p2cTimeSeries
+		tsres  = make(map[string]*p2cTimeSeries)
+		rcount = 0
+	)
+	for rows.Next() {
+		rcount++
+		var (
+			t    int64
+			tags []string
+			n    p2cNativeHistogram
+		)
+		err = rows.Scan(&t, &tags, &n.schema, &n.zeroThreshold, &n.zeroCount, &n.count, &n.sum,
+			&n.posOffsets, &n.posLengths, &n.posBuckets,
+			&n.negOffsets, &n.negLengths, &n.negBuckets, &n.customValues, &n.resetHint, &n.float)
+		if err != nil {
+			fmt.Fprintf(r.log, "Error: scan: %s\n", err.Error())
+			continue
+		}
+
+		key := strings.Join(tags, "\xff")
+		ts, ok := tsres[key]
+		if !ok {
+			if err = r.addSeries(limits); err != nil {
+				return nil, rcount, err
+			}
+			ts = &p2cTimeSeries{Labels: r.makeLabels(tags)}
+			tsres[key] = ts
+			series = append(series, ts)
+		}
+		if err = r.addSamples(limits, 1); err != nil {
+			return nil, rcount, err
+		}
+		ts.Histograms = append(ts.Histograms, n.histogram(t))
+	}
+	if err = rows.Err(); err != nil {
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return nil, rcount, r.queryError(ctx, err)
+	}
+
+	// the last histogram per step is selected newest first
+	for _, ts := range series {
+		sort.Slice(ts.Histograms, func(i, j int) bool {
+			return ts.Histograms[i].TimestampMs < ts.Histograms[j].TimestampMs
+		})
+	}
+	return series, rcount, nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// openmetrics and prometheus text exposition format parsing for backfills,
+// see:
+// 	https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+// 	https://prometheus.io/docs/instrumenting/exposition_formats/
+// timestamps are seconds in openmetrics and milliseconds in the text
+// format. The whole input is validated before anything is written.
+
+// maxExpositionErrors is the number of invalid lines reported
+const maxExpositionErrors = 100
+
+// expositionParser parses exposition lines into a write request
+type expositionParser struct {
+	openMetrics bool
+	// default timestamp in milliseconds, samples need one if 0
+	defaultTs int64
+	lineno    int
+	eof       bool
+	req       p2cWriteRequest
+	series    map[string]*p2cTimeSeries
+	meta      map[string]*metricMetadata
+	typed     map[string]bool
+	samples   int
+	errs      []string
+	nerrs     int
+}
+
+// parseExposition parses r, returning the series and metadata and the
+// invalid lines
+func parseExposition(r io.Reader, openMetrics bool, defaultTs int64) (*p2cWriteRequest, int, []string) {
+	p := &expositionParser{
+		openMetrics: openMetrics,
+		defaultTs:   defaultTs,
+		series:      make(map[string]*p2cTimeSeries),
+		meta:        make(map[string]*metricMetadata),
+		typed:       make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		p.lineno++
+		if err := p.line(scanner.Text()); err != nil {
+			p.error(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		p.error(err)
+	}
+	if p.nerrs > len(p.errs) {
+		p.errs = append(p.errs, fmt.Sprintf("and %d more invalid lines", p.nerrs-len(p.errs)))
+	}
+
+	for _, m := range p.meta {
+		p.req.Metadata = append(p.req.Metadata, m)
+	}
+	sort.Slice(p.req.Metadata, func(i, j int) bool {
+		return p.req.Metadata[i].MetricFamilyName < p.req.Metadata[j].MetricFamilyName
+	})
+	return &p.req, p.samples, p.errs
+}
+
+func (p *expositionParser) error(err error) {
+	p.nerrs++
+	if len(p.errs) < maxExpositionErrors {
+		p.errs = append(p.errs, fmt.Sprintf("line %d: %s", p.lineno, err.Error()))
+	}
+}
+
+func (p *expositionParser) line(line string) error {
+	switch {
+	case strings.TrimSpace(line) == "":
+		return nil
+	case p.eof:
+		return fmt.Errorf("unexpected content after # EOF")
+	case line[0] == '#':
+		return p.comment(line)
+	}
+	return p.sample(line)
+}
+
+// comment parses HELP, TYPE and UNIT lines, other comments are ignored
+func (p *expositionParser) comment(line string) error {
+	if line == "# EOF" {
+		p.eof = true
+		return nil
+	}
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return nil
+	}
+	if fields[1] != "HELP" && fields[1] != "TYPE" && fields[1] != "UNIT" {
+		return nil
+	}
+
+	name := fields[2]
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid metric name %q in %s", name, fields[1])
+	}
+	text := ""
+	if len(fields) == 4 {
+		text = fields[3]
+	}
+	m, ok := p.meta[name]
+	if !ok {
+		m = &metricMetadata{MetricFamilyName: name}
+		p.meta[name] = m
+	}
+
+	switch fields[1] {
+	case "HELP":
+		m.Help = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`).Replace(text)
+	case "UNIT":
+		m.Unit = text
+	case "TYPE":
+		if p.typed[name] {
+			return fmt.Errorf("second TYPE line for %s", name)
+		}
+		found := false
+		for typ, typName := range metricTypeNames {
+			if typName == text {
+				m.Type, found = typ, true
+			}
+		}
+		// the text format calls unknown untyped
+		if text == "untyped" && !p.openMetrics {
+			m.Type, found = metricTypeUnknown, true
+		}
+		if !found {
+			return fmt.Errorf("invalid metric type %q", text)
+		}
+		p.typed[name] = true
+	}
+	return nil
+}
+
+// sample parses a sample line, with an exemplar in openmetrics
+func (p *expositionParser) sample(line string) error {
+	i := 0
+	for i < len(line) && isNameChar(line[i], i == 0, true) {
+		i++
+	}
+	if i == 0 {
+		return fmt.Errorf("expected a metric name")
+	}
+	labels := []*remote.LabelPair{{Name: model.MetricNameLabel, Value: line[:i]}}
+	rest := line[i:]
+	if strings.HasPrefix(rest, "{") {
+		lbls, r, err := parseExpositionLabels(rest)
+		if err != nil {
+			return err
+		}
+		for _, l := range lbls {
+			if l.Name == model.MetricNameLabel {
+				return fmt.Errorf("label %s not allowed", model.MetricNameLabel)
+			}
+		}
+		labels = append(labels, lbls...)
+		rest = r
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	for i := 1; i < len(labels); i++ {
+		if labels[i].Name == labels[i-1].Name {
+			return fmt.Errorf("duplicate label %s", labels[i].Name)
+		}
+	}
+
+	if !strings.HasPrefix(rest, " ") {
+		return fmt.Errorf("expected a space before the value")
+	}
+	var exemplarText string
+	if p.openMetrics {
+		if j := strings.Index(rest, " # "); j >= 0 {
+			rest, exemplarText = rest[:j], rest[j+3:]
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("expected a value and optional timestamp")
+	}
+
+	val, err := parseExpositionValue(fields[0])
+	if err != nil {
+		return err
+	}
+	ts := p.defaultTs
+	if len(fields) == 2 {
+		if ts, err = p.timestamp(fields[1]); err != nil {
+			return err
+		}
+	} else if ts == 0 {
+		return fmt.Errorf("sample without a timestamp")
+	}
+
+	var ex *exemplar
+	if exemplarText != "" {
+		if ex, err = p.exemplar(exemplarText, ts); err != nil {
+			return fmt.Errorf("exemplar: %s", err.Error())
+		}
+	}
+
+	key := labelsKey(labels)
+	series, ok := p.series[key]
+	if !ok {
+		series = &p2cTimeSeries{Labels: labels}
+		p.series[key] = series
+		p.req.Timeseries = append(p.req.Timeseries, series)
+	}
+	series.Samples = append(series.Samples, &remote.Sample{Value: val, TimestampMs: ts})
+	if ex != nil {
+		series.Exemplars = append(series.Exemplars, ex)
+	}
+	p.samples++
+	return nil
+}
+
+// timestamp parses a timestamp into milliseconds
+func (p *expositionParser) timestamp(s string) (int64, error) {
+	if p.openMetrics {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		return int64(math.Round(f * 1000)), nil
+	}
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return ts, nil
+}
+
+// exemplar parses `{labels} value [timestamp]`
+func (p *expositionParser) exemplar(s string, ts int64) (*exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, fmt.Errorf("expected labels")
+	}
+	labels, rest, err := parseExpositionLabels(s)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("expected a value and optional timestamp")
+	}
+	val, err := parseExpositionValue(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 2 {
+		if ts, err = p.timestamp(fields[1]); err != nil {
+			return nil, err
+		}
+	}
+	return &exemplar{Labels: labels, Value: val, TimestampMs: ts}, nil
+}
+
+// parseExpositionValue parses a sample value
+func parseExpositionValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// parseExpositionLabels parses `{name="value",...}` returning the labels
+// and the rest of s
+func parseExpositionLabels(s string) ([]*remote.LabelPair, string, error) {
+	var labels []*remote.LabelPair
+	i := 1
+	for {
+		if i < len(s) && s[i] == '}' {
+			return labels, s[i+1:], nil
+		}
+
+		start := i
+		for i < len(s) && isNameChar(s[i], i == start, false) {
+			i++
+		}
+		if i == start {
+			return nil, "", fmt.Errorf("expected a label name at %d", i+1)
+		}
+		name := s[start:i]
+		if i+1 >= len(s) || s[i] != '=' || s[i+1] != '"' {
+			return nil, "", fmt.Errorf("expected =\" after label %s", name)
+		}
+		i += 2
+
+		var val []byte
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				val = append(val, s[i])
+				continue
+			}
+			if i++; i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				val = append(val, '\n')
+			case '\\', '"':
+				val = append(val, s[i])
+			default:
+				return nil, "", fmt.Errorf("invalid escape \\%c in label %s", s[i], name)
+			}
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		i++
+		labels = append(labels, &remote.LabelPair{Name: name, Value: string(val)})
+
+		if i < len(s) && s[i] == ',' {
+			i++
+		} else if i >= len(s) || s[i] != '}' {
+			return nil, "", fmt.Errorf("expected , or } after label %s", name)
+		}
+	}
+}
+
+// importExposition serves /import/openmetrics, writing the samples of an
+// openmetrics (or, for text/plain, prometheus text format) body. Samples
+// without a timestamp take the timestamp parameter if given.
+func (c *p2cServer) importExposition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	var defaultTs int64
+	if s := r.FormValue("timestamp"); s != "" {
+		t, err := parseTime(s, time.Time{})
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		defaultTs = t.UnixNano() / 1e6
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	openMetrics := !strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain")
+	req, samples, errs := parseExposition(body, openMetrics, defaultTs)
+	if len(errs) > 0 {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("%s", strings.Join(errs, "; ")))
+		return
+	}
+	c.process(req)
+	apiData(w, map[string]int{"series": len(req.Timeseries), "samples": samples})
+}
+
+// importOpenMetrics imports an openmetrics or prometheus text format file,
+// or stdin for -. As with import tsdb only samples are written, exemplars
+// and metadata are only stored by /import/openmetrics.
+func importOpenMetrics(args []string) int {
+	cfg := new(config)
+	fs := flag.NewFlagSet("import openmetrics", flag.ExitOnError)
+	addFlags(fs, cfg)
+	format := fs.String("format", "openmetrics", "The file format, openmetrics (timestamps in seconds) "+
+		"or text (prometheus text format, timestamps in milliseconds).")
+	timestamp := fs.String("timestamp", "", "RFC3339 or unix time of samples without a timestamp. "+
+		"If unset every sample needs a timestamp.")
+	fs.Usage = func() {
+		fmt.Println("Usage: prom2click import openmetrics [flags] <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *format != "openmetrics" && *format != "text" {
+		fmt.Printf("Error: invalid format %q\n", *format)
+		return 2
+	}
+	var defaultTs int64
+	if *timestamp != "" {
+		t, err := parseTime(*timestamp, time.Time{})
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			return 2
+		}
+		defaultTs = t.UnixNano() / 1e6
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	req, samples, errs := parseExposition(in, *format == "openmetrics", defaultTs)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Printf("Error: %s: %s\n", fs.Arg(0), e)
+		}
+		fmt.Println("Nothing imported")
+		return 1
+	}
+
+	im, err := NewP2CImporter(cfg, prometheus.NewRegistry())
+	if err != nil {
+		return 1
+	}
+	for _, series := range req.Timeseries {
+		im.add(series.Labels, series.Samples)
+	}
+	failed := im.finish()
+	fmt.Printf("Imported %d series, %d samples, %d failed\n", len(req.Timeseries), samples-int(failed), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// opentsdb /api/put compatibility, see:
+// 	http://opentsdb.net/docs/build/html/api_http/put.html
+// the metric becomes the name (with invalid characters such as . replaced
+// by _) and the tags labels.
+
+// tsdbPoint is a data point as sent to /api/put
+type tsdbPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.RawMessage   `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// tsdbPutError is an entry of the details response
+type tsdbPutError struct {
+	Datapoint *tsdbPoint `json:"datapoint"`
+	Error     string     `json:"error"`
+}
+
+// tsdbResponse is the summary (or with Errors, details) response
+type tsdbResponse struct {
+	Errors  *[]tsdbPutError `json:"errors,omitempty"`
+	Failed  int             `json:"failed"`
+	Success int             `json:"success"`
+}
+
+// tsdbPut serves /api/put. Valid points are written even if others fail,
+// in which case the status is 400.
+func (c *p2cServer) tsdbPut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		tsdbError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			tsdbError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		tsdbError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// a single point or an array of them
+	var points []*tsdbPoint
+	buf = bytes.TrimSpace(buf)
+	if len(buf) > 0 && buf[0] == '[' {
+		err = json.Unmarshal(buf, &points)
+	} else {
+		var p tsdbPoint
+		err = json.Unmarshal(buf, &p)
+		points = append(points, &p)
+	}
+	if err != nil {
+		tsdbError(w, http.StatusBadRequest, fmt.Errorf("unable to parse the given JSON: %s", err.Error()))
+		return
+	}
+
+	var (
+		req    p2cWriteRequest
+		resp   tsdbResponse
+		errors []tsdbPutError
+	)
+	for _, p := range points {
+		series, err := p.series()
+		if err != nil {
+			c.tsdbInvalid.Inc()
+			resp.Failed++
+			errors = append(errors, tsdbPutError{Datapoint: p, Error: err.Error()})
+			continue
+		}
+		req.Timeseries = append(req.Timeseries, series)
+		resp.Success++
+	}
+	c.process(&req)
+
+	status := http.StatusNoContent
+	if resp.Failed > 0 {
+		status = http.StatusBadRequest
+	}
+	_, details := r.URL.Query()["details"]
+	_, summary := r.URL.Query()["summary"]
+	switch {
+	case details:
+		if errors == nil {
+			errors = []tsdbPutError{}
+		}
+		resp.Errors = &errors
+	case summary:
+	case resp.Failed > 0:
+		tsdbError(w, status, fmt.Errorf("one or more data points had errors"))
+		return
+	default:
+		w.WriteHeader(status)
+		return
+	}
+	if status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// tsdbError writes an opentsdb style json error
+func tsdbError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": err.Error()},
+	})
+}
+
+// series converts a point, timestamps are in seconds or (if more than 10
+// digits) milliseconds
+func (p *tsdbPoint) series() (*p2cTimeSeries, error) {
+	if p.Metric == "" {
+		return nil, fmt.Errorf("metric name was empty")
+	}
+	if len(p.Tags) == 0 {
+		return nil, fmt.Errorf("missing tags")
+	}
+
+	ts, err := strconv.ParseInt(p.Timestamp.String(), 10, 64)
+	if err != nil || ts <= 0 {
+		return nil, fmt.Errorf("invalid timestamp %q", p.Timestamp.String())
+	}
+	if ts < 1e10 {
+		ts *= 1000
+	}
+
+	// values are numbers or numeric strings
+	raw := string(p.Value)
+	if s, err := strconv.Unquote(raw); err == nil {
+		raw = s
+	}
+	val, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse value %s", string(p.Value))
+	}
+
+	labels := make([]*remote.LabelPair, 0, len(p.Tags)+1)
+	labels = append(labels, &remote.LabelPair{Name: model.MetricNameLabel, Value: sanitizeName(p.Metric, true)})
+	for k, v := range p.Tags {
+		name := sanitizeName(k, false)
+		if k == "" || v == "" || name == model.MetricNameLabel {
+			return nil, fmt.Errorf("invalid tag %s=%s", k, v)
+		}
+		labels = append(labels, &remote.LabelPair{Name: name, Value: v})
+	}
+	sort.Slice(labels[1:], func(i, j int) bool { return labels[i+1].Name < labels[j+1].Name })
+
+	return &p2cTimeSeries{
+		Labels:  labels,
+		Samples: []*remote.Sample{{Value: val, TimestampMs: ts}},
+	}, nil
+}
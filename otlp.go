@@ -0,0 +1,700 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// OTLP/HTTP metrics ingestion on /v1/metrics, translated the way the
+// prometheus otlp receiver does:
+//   - names are normalized, with unit and _total (monotonic sums) or _ratio
+//     (gauges with unit 1) suffixes
+//   - service.name (prefixed with service.namespace) becomes job and
+//     service.instance.id instance, all resource attributes are written to
+//     a target_info series
+//   - the instrumentation scope becomes otel_scope_name/otel_scope_version
+//   - points flagged as having no recorded value become staleness markers
+//
+// Delta sums and histograms are accumulated in memory into cumulative
+// ones, exponential histograms become native histograms.
+
+// otlpDeltaExpiry is how long delta series are accumulated for without
+// receiving a point
+const otlpDeltaExpiry = time.Hour
+
+// otlpUnits are the prometheus names of common ucum units
+var otlpUnits = map[string]string{
+	"d":    "days",
+	"h":    "hours",
+	"min":  "minutes",
+	"s":    "seconds",
+	"ms":   "milliseconds",
+	"us":   "microseconds",
+	"ns":   "nanoseconds",
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"GiBy": "gibibytes",
+	"TiBy": "tibibytes",
+	"KBy":  "kilobytes",
+	"MBy":  "megabytes",
+	"GBy":  "gigabytes",
+	"TBy":  "terabytes",
+	"m":    "meters",
+	"V":    "volts",
+	"A":    "amperes",
+	"J":    "joules",
+	"W":    "watts",
+	"g":    "grams",
+	"Cel":  "celsius",
+	"Hz":   "hertz",
+	"%":    "percent",
+	"1":    "",
+}
+
+// otlpPerUnits are the prometheus names of units after a /
+var otlpPerUnits = map[string]string{
+	"s":  "second",
+	"m":  "minute",
+	"h":  "hour",
+	"d":  "day",
+	"w":  "week",
+	"mo": "month",
+	"y":  "year",
+}
+
+// otlpDeltas accumulates delta points into cumulative values per series
+type otlpDeltas struct {
+	mtx    sync.Mutex
+	series map[string]*otlpCumulative
+	swept  time.Time
+}
+
+type otlpCumulative struct {
+	values []float64
+	seen   time.Time
+}
+
+func newOTLPDeltas() *otlpDeltas {
+	return &otlpDeltas{series: make(map[string]*otlpCumulative), swept: time.Now()}
+}
+
+// add adds values to the running totals of a series and returns them. If
+// the number of values changes (eg. histogram buckets) the totals restart.
+func (d *otlpDeltas) add(key string, values []float64) []float64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.swept) > otlpDeltaExpiry/6 {
+		for k, c := range d.series {
+			if now.Sub(c.seen) > otlpDeltaExpiry {
+				delete(d.series, k)
+			}
+		}
+		d.swept = now
+	}
+
+	c, ok := d.series[key]
+	if !ok || len(c.values) != len(values) {
+		c = &otlpCumulative{values: make([]float64, len(values))}
+		d.series[key] = c
+	}
+	for i, v := range values {
+		c.values[i] += v
+	}
+	c.seen = now
+	return append([]float64(nil), c.values...)
+}
+
+// otlpTranslator converts an export request into a write request
+type otlpTranslator struct {
+	deltas   *otlpDeltas
+	req      p2cWriteRequest
+	rejected int64
+	errs     []string
+}
+
+// otlpAttrValue returns an attribute value as a label value
+func otlpAttrValue(v *otlpAnyValue) string {
+	switch {
+	case v == nil:
+		return ""
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		if *v.BoolValue {
+			return "true"
+		}
+		return "false"
+	case v.IntValue != nil:
+		return fmt.Sprintf("%d", *v.IntValue)
+	case v.DoubleValue != nil:
+		return formatValue(*v.DoubleValue)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case v.ArrayValue != nil:
+		vals := make([]string, 0, len(v.ArrayValue.Values))
+		for _, av := range v.ArrayValue.Values {
+			b, _ := json.Marshal(otlpAttrValue(av))
+			vals = append(vals, string(b))
+		}
+		return "[" + strings.Join(vals, ",") + "]"
+	case v.KvlistValue != nil:
+		m := make(map[string]string)
+		for _, kv := range v.KvlistValue.Values {
+			m[kv.Key] = otlpAttrValue(kv.Value)
+		}
+		b, _ := json.Marshal(m)
+		return string(b)
+	}
+	return ""
+}
+
+// otlpLabelName normalizes an attribute key to a label name
+func otlpLabelName(key string) string {
+	name := sanitizeName(key, false)
+	if strings.HasPrefix(name, "__") && !strings.HasPrefix(key, "__") {
+		name = "key" + name
+	}
+	return name
+}
+
+// otlpLabels returns attrs as labels, values of keys that normalize to the
+// same name are joined with ;
+func otlpLabels(attrs []*otlpKeyValue) map[string]string {
+	labels := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		name := otlpLabelName(kv.Key)
+		val := otlpAttrValue(kv.Value)
+		if prev, ok := labels[name]; ok {
+			val = prev + ";" + val
+		}
+		labels[name] = val
+	}
+	return labels
+}
+
+// otlpResourceLabels returns the job and instance labels of a resource and
+// the labels of its target_info series
+func otlpResourceLabels(res *otlpResource) (map[string]string, map[string]string) {
+	var attrs []*otlpKeyValue
+	if res != nil {
+		attrs = res.Attributes
+	}
+
+	var service, namespace, instance string
+	info := make(map[string]string)
+	for _, kv := range attrs {
+		switch kv.Key {
+		case "service.name":
+			service = otlpAttrValue(kv.Value)
+		case "service.namespace":
+			namespace = otlpAttrValue(kv.Value)
+		case "service.instance.id":
+			instance = otlpAttrValue(kv.Value)
+		default:
+			info[otlpLabelName(kv.Key)] = otlpAttrValue(kv.Value)
+		}
+	}
+
+	job := service
+	if namespace != "" {
+		job = namespace + "/" + service
+	}
+	ids := make(map[string]string)
+	if job != "" {
+		ids["job"] = job
+	}
+	if instance != "" {
+		ids["instance"] = instance
+	}
+	for k, v := range ids {
+		info[k] = v
+	}
+	return ids, info
+}
+
+// otlpMetricName normalizes a metric name and adds its unit and type
+// suffixes
+func otlpMetricName(m *otlpMetric) string {
+	tokens := strings.FieldsFunc(m.Name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	has := func(t string) bool {
+		for _, tok := range tokens {
+			if tok == t {
+				return true
+			}
+		}
+		return false
+	}
+	without := func(t string) {
+		kept := tokens[:0]
+		for _, tok := range tokens {
+			if tok != t {
+				kept = append(kept, tok)
+			}
+		}
+		tokens = kept
+	}
+
+	// drop {annotations}
+	unit := m.Unit
+	for {
+		i := strings.IndexByte(unit, '{')
+		j := strings.IndexByte(unit, '}')
+		if i < 0 || j < i {
+			break
+		}
+		unit = unit[:i] + unit[j+1:]
+	}
+	unit = strings.TrimSpace(unit)
+
+	main, per := unit, ""
+	if i := strings.IndexByte(unit, '/'); i >= 0 {
+		main, per = strings.TrimSpace(unit[:i]), strings.TrimSpace(unit[i+1:])
+	}
+	if u, ok := otlpUnits[main]; ok {
+		main = u
+	}
+	if main = strings.Trim(sanitizeName(main, true), "_"); main != "" && !has(main) {
+		tokens = append(tokens, main)
+	}
+	if u, ok := otlpPerUnits[per]; ok {
+		per = u
+	}
+	if per = strings.Trim(sanitizeName(per, true), "_"); per != "" && !has(per) {
+		tokens = append(tokens, "per", per)
+	}
+
+	switch {
+	case m.Sum != nil && m.Sum.IsMonotonic:
+		without("total")
+		tokens = append(tokens, "total")
+	case m.Gauge != nil && unit == "1":
+		without("ratio")
+		tokens = append(tokens, "ratio")
+	}
+
+	name := strings.Join(tokens, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// otlpTimestamp returns a points timestamp in milliseconds
+func otlpTimestamp(t otlpUint64) int64 {
+	return int64(t / 1e6)
+}
+
+// otlpValue returns v, or a staleness marker if the point has no value
+func otlpValue(v float64, flags uint32) float64 {
+	if flags&otlpNoRecordedValue != 0 {
+		return math.Float64frombits(staleNaN)
+	}
+	return v
+}
+
+// otlpExemplars converts exemplars, trace and span ids become labels
+func otlpExemplars(exemplars []*otlpExemplar) []*exemplar {
+	var res []*exemplar
+	for _, e := range exemplars {
+		var labels []*remote.LabelPair
+		if len(e.TraceID) > 0 {
+			labels = append(labels, &remote.LabelPair{Name: "trace_id", Value: hex.EncodeToString(e.TraceID)})
+		}
+		if len(e.SpanID) > 0 {
+			labels = append(labels, &remote.LabelPair{Name: "span_id", Value: hex.EncodeToString(e.SpanID)})
+		}
+		for k, v := range otlpLabels(e.FilteredAttributes) {
+			labels = append(labels, &remote.LabelPair{Name: k, Value: v})
+		}
+		val := 0.0
+		if e.AsInt != nil {
+			val = float64(*e.AsInt)
+		} else if e.AsDouble != nil {
+			val = *e.AsDouble
+		}
+		res = append(res, &exemplar{Labels: labels, Value: val, TimestampMs: otlpTimestamp(e.TimeUnixNano)})
+	}
+	return res
+}
+
+// series adds a series with base labels, point attributes and name
+func (t *otlpTranslator) series(base map[string]string, attrs []*otlpKeyValue, name string,
+	extra ...string) *p2cTimeSeries {
+
+	labels := make(map[string]string, len(base)+len(attrs)+2)
+	for k, v := range base {
+		labels[k] = v
+	}
+	for k, v := range otlpLabels(attrs) {
+		labels[k] = v
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels[extra[i]] = extra[i+1]
+	}
+	labels[model.MetricNameLabel] = name
+
+	ts := &p2cTimeSeries{Labels: make([]*remote.LabelPair, 0, len(labels))}
+	for k, v := range labels {
+		if v == "" {
+			continue
+		}
+		ts.Labels = append(ts.Labels, &remote.LabelPair{Name: k, Value: v})
+	}
+	sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+	t.req.Timeseries = append(t.req.Timeseries, ts)
+	return ts
+}
+
+func (t *otlpTranslator) sample(ts *p2cTimeSeries, v float64, tms int64) {
+	ts.Samples = append(ts.Samples, &remote.Sample{Value: v, TimestampMs: tms})
+}
+
+// cumulative returns values as they are for cumulative points or the
+// running totals for delta ones
+func (t *otlpTranslator) cumulative(temporality int32, ts *p2cTimeSeries, values []float64) []float64 {
+	if temporality != otlpTemporalityDelta {
+		return values
+	}
+	return t.deltas.add(labelsKey(ts.Labels), values)
+}
+
+func (t *otlpTranslator) reject(n int, format string, args ...interface{}) {
+	t.rejected += int64(n)
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
+
+// translate converts req into t.req
+func (t *otlpTranslator) translate(req *otlpExportRequest) {
+	for _, rm := range req.ResourceMetrics {
+		ids, info := otlpResourceLabels(rm.Resource)
+		var latest int64
+
+		for _, sm := range rm.ScopeMetrics {
+			base := make(map[string]string, len(ids)+2)
+			for k, v := range ids {
+				base[k] = v
+			}
+			if sm.Scope != nil {
+				base["otel_scope_name"] = sm.Scope.Name
+				base["otel_scope_version"] = sm.Scope.Version
+			}
+			for _, m := range sm.Metrics {
+				if tms := t.metric(m, base); tms > latest {
+					latest = tms
+				}
+			}
+		}
+
+		// resource attributes are kept in a target_info series
+		if latest > 0 && len(info) > len(ids) {
+			ts := t.series(info, nil, "target_info")
+			t.sample(ts, 1, latest)
+		}
+	}
+}
+
+// metric translates the points of m, returning the latest timestamp
+func (t *otlpTranslator) metric(m *otlpMetric, base map[string]string) int64 {
+	name := otlpMetricName(m)
+	if name == "" {
+		t.reject(1, "metric with empty name")
+		return 0
+	}
+	meta := &metricMetadata{MetricFamilyName: name, Help: m.Description, Unit: m.Unit}
+	var latest int64
+	seen := func(tms int64) {
+		if tms > latest {
+			latest = tms
+		}
+	}
+
+	switch {
+	case m.Gauge != nil:
+		meta.Type = metricTypeGauge
+		for _, p := range m.Gauge.DataPoints {
+			ts := t.series(base, p.Attributes, name)
+			tms := otlpTimestamp(p.TimeUnixNano)
+			t.sample(ts, otlpValue(p.value(), p.Flags), tms)
+			ts.Exemplars = otlpExemplars(p.Exemplars)
+			seen(tms)
+		}
+
+	case m.Sum != nil:
+		meta.Type = metricTypeGauge
+		if m.Sum.IsMonotonic {
+			meta.Type = metricTypeCounter
+		}
+		for _, p := range m.Sum.DataPoints {
+			ts := t.series(base, p.Attributes, name)
+			tms := otlpTimestamp(p.TimeUnixNano)
+			v := p.value()
+			if p.Flags&otlpNoRecordedValue == 0 {
+				v = t.cumulative(m.Sum.AggregationTemporality, ts, []float64{v})[0]
+			}
+			t.sample(ts, otlpValue(v, p.Flags), tms)
+			ts.Exemplars = otlpExemplars(p.Exemplars)
+			seen(tms)
+		}
+
+	case m.Histogram != nil:
+		meta.Type = metricTypeHistogram
+		for _, p := range m.Histogram.DataPoints {
+			if len(p.BucketCounts) > 0 && len(p.BucketCounts) != len(p.ExplicitBounds)+1 {
+				t.reject(1, "%s: %d bucket counts for %d bounds", name, len(p.BucketCounts), len(p.ExplicitBounds))
+				continue
+			}
+			tms := otlpTimestamp(p.TimeUnixNano)
+			t.histogram(m.Histogram.AggregationTemporality, name, base, p, tms)
+			seen(tms)
+		}
+
+	case m.Summary != nil:
+		meta.Type = metricTypeSummary
+		for _, p := range m.Summary.DataPoints {
+			tms := otlpTimestamp(p.TimeUnixNano)
+			for _, q := range p.QuantileValues {
+				ts := t.series(base, p.Attributes, name, model.QuantileLabel, formatBound(q.Quantile))
+				t.sample(ts, otlpValue(q.Value, p.Flags), tms)
+			}
+			t.sample(t.series(base, p.Attributes, name+"_sum"), otlpValue(p.Sum, p.Flags), tms)
+			t.sample(t.series(base, p.Attributes, name+"_count"), otlpValue(float64(p.Count), p.Flags), tms)
+			seen(tms)
+		}
+
+	case m.ExponentialHistogram != nil:
+		meta.Type = metricTypeHistogram
+		if m.ExponentialHistogram.AggregationTemporality == otlpTemporalityDelta {
+			t.reject(len(m.ExponentialHistogram.DataPoints), "%s: delta exponential histograms are not supported", name)
+			return 0
+		}
+		for _, p := range m.ExponentialHistogram.DataPoints {
+			h, err := otlpNativeHistogram(p)
+			if err != nil {
+				t.reject(1, "%s: %s", name, err.Error())
+				continue
+			}
+			ts := t.series(base, p.Attributes, name)
+			ts.Histograms = append(ts.Histograms, h)
+			seen(h.TimestampMs)
+		}
+
+	default:
+		t.reject(1, "%s: no data", name)
+		return 0
+	}
+
+	t.req.Metadata = append(t.req.Metadata, meta)
+	return latest
+}
+
+// histogram translates an explicit bucket histogram point into _bucket,
+// _sum and _count series
+func (t *otlpTranslator) histogram(temporality int32, name string, base map[string]string,
+	p *otlpHistogramDataPoint, tms int64) {
+
+	// running totals of count, sum and each bucket
+	countTs := t.series(base, p.Attributes, name+"_count")
+	values := make([]float64, 0, len(p.BucketCounts)+2)
+	values = append(values, float64(p.Count), 0)
+	if p.Sum != nil {
+		values[1] = *p.Sum
+	}
+	for _, c := range p.BucketCounts {
+		values = append(values, float64(c))
+	}
+	if p.Flags&otlpNoRecordedValue == 0 {
+		values = t.cumulative(temporality, countTs, values)
+	}
+
+	t.sample(countTs, otlpValue(values[0], p.Flags), tms)
+	if p.Sum != nil {
+		t.sample(t.series(base, p.Attributes, name+"_sum"), otlpValue(values[1], p.Flags), tms)
+	}
+
+	exemplars := otlpExemplars(p.Exemplars)
+	var cum float64
+	for i, c := range values[2:] {
+		cum += c
+		le, bound := "+Inf", math.Inf(1)
+		if i < len(p.ExplicitBounds) {
+			bound = p.ExplicitBounds[i]
+			le = formatBound(bound)
+		}
+		v := cum
+		if i == len(p.ExplicitBounds) {
+			v = values[0]
+		}
+		ts := t.series(base, p.Attributes, name+"_bucket", model.BucketLabel, le)
+		t.sample(ts, otlpValue(v, p.Flags), tms)
+
+		// exemplars go with the bucket their value falls in
+		kept := exemplars[:0]
+		for _, e := range exemplars {
+			if e.Value <= bound {
+				ts.Exemplars = append(ts.Exemplars, e)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		exemplars = kept
+	}
+	if len(p.BucketCounts) == 0 {
+		ts := t.series(base, p.Attributes, name+"_bucket", model.BucketLabel, "+Inf")
+		t.sample(ts, otlpValue(values[0], p.Flags), tms)
+	}
+}
+
+// otlpNativeHistogram converts an exponential histogram point into a
+// native histogram. Scales beyond the largest native histogram schema
+// are reduced by merging buckets.
+func otlpNativeHistogram(p *otlpExpHistogramDataPoint) (*histogram, error) {
+	if p.Scale < -4 {
+		return nil, fmt.Errorf("exponential histogram scale %d below the minimum of -4", p.Scale)
+	}
+	scale := p.Scale
+	pos, neg := p.Positive, p.Negative
+	for scale > 8 {
+		pos, neg = downscaleBuckets(pos), downscaleBuckets(neg)
+		scale--
+	}
+
+	h := &histogram{
+		CountInt:      uint64(p.Count),
+		Schema:        scale,
+		ZeroThreshold: p.ZeroThreshold,
+		ZeroCountInt:  uint64(p.ZeroCount),
+		ResetHint:     0,
+		TimestampMs:   otlpTimestamp(p.TimeUnixNano),
+	}
+	if p.Sum != nil {
+		h.Sum = *p.Sum
+	}
+	if p.Flags&otlpNoRecordedValue != 0 {
+		h.Sum = math.Float64frombits(staleNaN)
+	}
+	h.PositiveSpans, h.PositiveDeltas = otlpSpans(pos)
+	h.NegativeSpans, h.NegativeDeltas = otlpSpans(neg)
+	return h, nil
+}
+
+// otlpSpans converts buckets to a span and delta encoded counts. OTLP
+// bucket i is (base^i, base^(i+1)], native histogram bucket i is
+// (base^(i-1), base^i].
+func otlpSpans(b *otlpBuckets) ([]*bucketSpan, []int64) {
+	if b == nil || len(b.BucketCounts) == 0 {
+		return nil, nil
+	}
+	deltas := make([]int64, 0, len(b.BucketCounts))
+	var prev int64
+	for _, c := range b.BucketCounts {
+		deltas = append(deltas, int64(c)-prev)
+		prev = int64(c)
+	}
+	return []*bucketSpan{{Offset: b.Offset + 1, Length: uint32(len(b.BucketCounts))}}, deltas
+}
+
+// downscaleBuckets merges pairs of buckets, halving the scale
+func downscaleBuckets(b *otlpBuckets) *otlpBuckets {
+	if b == nil || len(b.BucketCounts) == 0 {
+		return b
+	}
+	// floor division, offsets may be negative
+	idx := func(i int32) int32 { return i >> 1 }
+	res := &otlpBuckets{Offset: idx(b.Offset)}
+	for i, c := range b.BucketCounts {
+		j := int(idx(b.Offset+int32(i)) - res.Offset)
+		for len(res.BucketCounts) <= j {
+			res.BucketCounts = append(res.BucketCounts, 0)
+		}
+		res.BucketCounts[j] += c
+	}
+	return res
+}
+
+// otlpWrite serves /v1/metrics, accepting protobuf or json requests
+func (c *p2cServer) otlpWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (ct != "application/x-protobuf" && ct != "application/json") {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", r.Header.Get("Content-Type")),
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var req otlpExportRequest
+	if ct == "application/json" {
+		err = json.Unmarshal(buf, &req)
+	} else {
+		err = proto.Unmarshal(buf, &req)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := &otlpTranslator{deltas: c.otlpDeltas}
+	t.translate(&req)
+	c.process(&t.req)
+	c.otlpRejected.Add(float64(t.rejected))
+
+	var resp otlpExportResponse
+	if t.rejected > 0 {
+		resp.PartialSuccess = &otlpPartialSuccess{
+			RejectedDataPoints: t.rejected,
+			ErrorMessage:       strings.Join(t.errs, "; "),
+		}
+	}
+	var data []byte
+	if ct == "application/json" {
+		data, err = json.Marshal(&resp)
+	} else {
+		data, err = proto.Marshal(&resp)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Write(data)
+}
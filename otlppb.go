@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// otlp metrics messages, see:
+// 	https://github.com/open-telemetry/opentelemetry-proto/tree/main/opentelemetry/proto
+// declared here rather than vendoring the generated code. Field numbers
+// must match opentelemetry-proto and json names the lowerCamelCase of
+// OTLP/JSON, where 64 bit integers are strings and ids are hex.
+
+// metric data point aggregation temporalities
+const (
+	otlpTemporalityUnspecified = 0
+	otlpTemporalityDelta       = 1
+	otlpTemporalityCumulative  = 2
+)
+
+// otlpNoRecordedValue is the data point flag set for stale points
+const otlpNoRecordedValue = 1
+
+// otlpUint64 is a uint64 that may be a json string or number
+type otlpUint64 uint64
+
+func (v *otlpUint64) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseUint(unquoteJSONNumber(b), 10, 64)
+	*v = otlpUint64(n)
+	return err
+}
+
+// otlpInt64 is an int64 that may be a json string or number
+type otlpInt64 int64
+
+func (v *otlpInt64) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(unquoteJSONNumber(b), 10, 64)
+	*v = otlpInt64(n)
+	return err
+}
+
+// otlpID is a trace or span id, hex encoded in json
+type otlpID []byte
+
+func (v *otlpID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	id, err := hex.DecodeString(s)
+	*v = id
+	return err
+}
+
+func unquoteJSONNumber(b []byte) string {
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		return string(b[1 : len(b)-1])
+	}
+	return string(b)
+}
+
+type otlpExportRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics,json=resourceMetrics" json:"resourceMetrics,omitempty"`
+}
+
+func (m *otlpExportRequest) Reset()         { *m = otlpExportRequest{} }
+func (m *otlpExportRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportRequest) ProtoMessage()    {}
+
+type otlpExportResponse struct {
+	PartialSuccess *otlpPartialSuccess `protobuf:"bytes,1,opt,name=partial_success,json=partialSuccess" json:"partialSuccess,omitempty"`
+}
+
+func (m *otlpExportResponse) Reset()         { *m = otlpExportResponse{} }
+func (m *otlpExportResponse) String() string { return proto.CompactTextString(m) }
+func (*otlpExportResponse) ProtoMessage()    {}
+
+type otlpPartialSuccess struct {
+	RejectedDataPoints int64  `protobuf:"varint,1,opt,name=rejected_data_points,json=rejectedDataPoints,proto3" json:"rejectedDataPoints,string,omitempty"`
+	ErrorMessage       string `protobuf:"bytes,2,opt,name=error_message,json=errorMessage,proto3" json:"errorMessage,omitempty"`
+}
+
+func (m *otlpPartialSuccess) Reset()         { *m = otlpPartialSuccess{} }
+func (m *otlpPartialSuccess) String() string { return proto.CompactTextString(m) }
+func (*otlpPartialSuccess) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource" json:"resource,omitempty"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics,json=scopeMetrics" json:"scopeMetrics,omitempty"`
+}
+
+func (m *otlpResourceMetrics) Reset()         { *m = otlpResourceMetrics{} }
+func (m *otlpResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpResourceMetrics) ProtoMessage()    {}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes,omitempty"`
+}
+
+func (m *otlpResource) Reset()         { *m = otlpResource{} }
+func (m *otlpResource) String() string { return proto.CompactTextString(m) }
+func (*otlpResource) ProtoMessage()    {}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `protobuf:"bytes,1,opt,name=scope" json:"scope,omitempty"`
+	Metrics []*otlpMetric `protobuf:"bytes,2,rep,name=metrics" json:"metrics,omitempty"`
+}
+
+func (m *otlpScopeMetrics) Reset()         { *m = otlpScopeMetrics{} }
+func (m *otlpScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpScopeMetrics) ProtoMessage()    {}
+
+type otlpScope struct {
+	Name    string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+func (m *otlpScope) Reset()         { *m = otlpScope{} }
+func (m *otlpScope) String() string { return proto.CompactTextString(m) }
+func (*otlpScope) ProtoMessage()    {}
+
+// otlpMetric has one of its data fields set
+type otlpMetric struct {
+	Name                 string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Description          string            `protobuf:"bytes,2,opt,name=description,proto3" json:"description,omitempty"`
+	Unit                 string            `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
+	Gauge                *otlpGauge        `protobuf:"bytes,5,opt,name=gauge" json:"gauge,omitempty"`
+	Sum                  *otlpSum          `protobuf:"bytes,7,opt,name=sum" json:"sum,omitempty"`
+	Histogram            *otlpHistogram    `protobuf:"bytes,9,opt,name=histogram" json:"histogram,omitempty"`
+	ExponentialHistogram *otlpExpHistogram `protobuf:"bytes,10,opt,name=exponential_histogram,json=exponentialHistogram" json:"exponentialHistogram,omitempty"`
+	Summary              *otlpSummary      `protobuf:"bytes,11,opt,name=summary" json:"summary,omitempty"`
+}
+
+func (m *otlpMetric) Reset()         { *m = otlpMetric{} }
+func (m *otlpMetric) String() string { return proto.CompactTextString(m) }
+func (*otlpMetric) ProtoMessage()    {}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"dataPoints,omitempty"`
+}
+
+func (m *otlpGauge) Reset()         { *m = otlpGauge{} }
+func (m *otlpGauge) String() string { return proto.CompactTextString(m) }
+func (*otlpGauge) ProtoMessage()    {}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"dataPoints,omitempty"`
+	AggregationTemporality int32                  `protobuf:"varint,2,opt,name=aggregation_temporality,json=aggregationTemporality,proto3" json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,json=isMonotonic,proto3" json:"isMonotonic,omitempty"`
+}
+
+func (m *otlpSum) Reset()         { *m = otlpSum{} }
+func (m *otlpSum) String() string { return proto.CompactTextString(m) }
+func (*otlpSum) ProtoMessage()    {}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"dataPoints,omitempty"`
+	AggregationTemporality int32                     `protobuf:"varint,2,opt,name=aggregation_temporality,json=aggregationTemporality,proto3" json:"aggregationTemporality,omitempty"`
+}
+
+func (m *otlpHistogram) Reset()         { *m = otlpHistogram{} }
+func (m *otlpHistogram) String() string { return proto.CompactTextString(m) }
+func (*otlpHistogram) ProtoMessage()    {}
+
+type otlpExpHistogram struct {
+	DataPoints             []*otlpExpHistogramDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"dataPoints,omitempty"`
+	AggregationTemporality int32                        `protobuf:"varint,2,opt,name=aggregation_temporality,json=aggregationTemporality,proto3" json:"aggregationTemporality,omitempty"`
+}
+
+func (m *otlpExpHistogram) Reset()         { *m = otlpExpHistogram{} }
+func (m *otlpExpHistogram) String() string { return proto.CompactTextString(m) }
+func (*otlpExpHistogram) ProtoMessage()    {}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `protobuf:"bytes,1,rep,name=data_points,json=dataPoints" json:"dataPoints,omitempty"`
+}
+
+func (m *otlpSummary) Reset()         { *m = otlpSummary{} }
+func (m *otlpSummary) String() string { return proto.CompactTextString(m) }
+func (*otlpSummary) ProtoMessage()    {}
+
+// otlpNumberDataPoint has either AsDouble or AsInt set
+type otlpNumberDataPoint struct {
+	Attributes        []*otlpKeyValue `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64      `protobuf:"fixed64,2,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64      `protobuf:"fixed64,3,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"timeUnixNano,omitempty"`
+	AsDouble          *float64        `protobuf:"fixed64,4,opt,name=as_double,json=asDouble" json:"asDouble,omitempty"`
+	AsInt             *otlpInt64      `protobuf:"fixed64,6,opt,name=as_int,json=asInt" json:"asInt,omitempty"`
+	Exemplars         []*otlpExemplar `protobuf:"bytes,5,rep,name=exemplars" json:"exemplars,omitempty"`
+	Flags             uint32          `protobuf:"varint,8,opt,name=flags,proto3" json:"flags,omitempty"`
+}
+
+func (m *otlpNumberDataPoint) Reset()         { *m = otlpNumberDataPoint{} }
+func (m *otlpNumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpNumberDataPoint) ProtoMessage()    {}
+
+// value returns the points value
+func (m *otlpNumberDataPoint) value() float64 {
+	if m.AsInt != nil {
+		return float64(*m.AsInt)
+	}
+	if m.AsDouble != nil {
+		return *m.AsDouble
+	}
+	return 0
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []*otlpKeyValue `protobuf:"bytes,9,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64      `protobuf:"fixed64,2,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64      `protobuf:"fixed64,3,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"timeUnixNano,omitempty"`
+	Count             otlpUint64      `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,omitempty"`
+	Sum               *float64        `protobuf:"fixed64,5,opt,name=sum" json:"sum,omitempty"`
+	BucketCounts      []otlpUint64    `protobuf:"fixed64,6,rep,packed,name=bucket_counts,json=bucketCounts" json:"bucketCounts,omitempty"`
+	ExplicitBounds    []float64       `protobuf:"fixed64,7,rep,packed,name=explicit_bounds,json=explicitBounds" json:"explicitBounds,omitempty"`
+	Exemplars         []*otlpExemplar `protobuf:"bytes,8,rep,name=exemplars" json:"exemplars,omitempty"`
+	Flags             uint32          `protobuf:"varint,10,opt,name=flags,proto3" json:"flags,omitempty"`
+}
+
+func (m *otlpHistogramDataPoint) Reset()         { *m = otlpHistogramDataPoint{} }
+func (m *otlpHistogramDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpHistogramDataPoint) ProtoMessage()    {}
+
+type otlpExpHistogramDataPoint struct {
+	Attributes        []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64      `protobuf:"fixed64,2,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64      `protobuf:"fixed64,3,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"timeUnixNano,omitempty"`
+	Count             otlpUint64      `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,omitempty"`
+	Sum               *float64        `protobuf:"fixed64,5,opt,name=sum" json:"sum,omitempty"`
+	Scale             int32           `protobuf:"zigzag32,6,opt,name=scale,proto3" json:"scale,omitempty"`
+	ZeroCount         otlpUint64      `protobuf:"fixed64,7,opt,name=zero_count,json=zeroCount,proto3" json:"zeroCount,omitempty"`
+	Positive          *otlpBuckets    `protobuf:"bytes,8,opt,name=positive" json:"positive,omitempty"`
+	Negative          *otlpBuckets    `protobuf:"bytes,9,opt,name=negative" json:"negative,omitempty"`
+	Flags             uint32          `protobuf:"varint,10,opt,name=flags,proto3" json:"flags,omitempty"`
+	ZeroThreshold     float64         `protobuf:"fixed64,14,opt,name=zero_threshold,json=zeroThreshold,proto3" json:"zeroThreshold,omitempty"`
+}
+
+func (m *otlpExpHistogramDataPoint) Reset()         { *m = otlpExpHistogramDataPoint{} }
+func (m *otlpExpHistogramDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpExpHistogramDataPoint) ProtoMessage()    {}
+
+type otlpBuckets struct {
+	Offset       int32        `protobuf:"zigzag32,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	BucketCounts []otlpUint64 `protobuf:"varint,2,rep,packed,name=bucket_counts,json=bucketCounts" json:"bucketCounts,omitempty"`
+}
+
+func (m *otlpBuckets) Reset()         { *m = otlpBuckets{} }
+func (m *otlpBuckets) String() string { return proto.CompactTextString(m) }
+func (*otlpBuckets) ProtoMessage()    {}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []*otlpKeyValue        `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64             `protobuf:"fixed64,2,opt,name=start_time_unix_nano,json=startTimeUnixNano,proto3" json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64             `protobuf:"fixed64,3,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"timeUnixNano,omitempty"`
+	Count             otlpUint64             `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,omitempty"`
+	Sum               float64                `protobuf:"fixed64,5,opt,name=sum,proto3" json:"sum,omitempty"`
+	QuantileValues    []*otlpValueAtQuantile `protobuf:"bytes,6,rep,name=quantile_values,json=quantileValues" json:"quantileValues,omitempty"`
+	Flags             uint32                 `protobuf:"varint,8,opt,name=flags,proto3" json:"flags,omitempty"`
+}
+
+func (m *otlpSummaryDataPoint) Reset()         { *m = otlpSummaryDataPoint{} }
+func (m *otlpSummaryDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpSummaryDataPoint) ProtoMessage()    {}
+
+type otlpValueAtQuantile struct {
+	Quantile float64 `protobuf:"fixed64,1,opt,name=quantile,proto3" json:"quantile,omitempty"`
+	Value    float64 `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *otlpValueAtQuantile) Reset()         { *m = otlpValueAtQuantile{} }
+func (m *otlpValueAtQuantile) String() string { return proto.CompactTextString(m) }
+func (*otlpValueAtQuantile) ProtoMessage()    {}
+
+// otlpExemplar has either AsDouble or AsInt set
+type otlpExemplar struct {
+	FilteredAttributes []*otlpKeyValue `protobuf:"bytes,7,rep,name=filtered_attributes,json=filteredAttributes" json:"filteredAttributes,omitempty"`
+	TimeUnixNano       otlpUint64      `protobuf:"fixed64,2,opt,name=time_unix_nano,json=timeUnixNano,proto3" json:"timeUnixNano,omitempty"`
+	AsDouble           *float64        `protobuf:"fixed64,3,opt,name=as_double,json=asDouble" json:"asDouble,omitempty"`
+	AsInt              *otlpInt64      `protobuf:"fixed64,6,opt,name=as_int,json=asInt" json:"asInt,omitempty"`
+	SpanID             otlpID          `protobuf:"bytes,4,opt,name=span_id,json=spanId,proto3" json:"spanId,omitempty"`
+	TraceID            otlpID          `protobuf:"bytes,5,opt,name=trace_id,json=traceId,proto3" json:"traceId,omitempty"`
+}
+
+func (m *otlpExemplar) Reset()         { *m = otlpExemplar{} }
+func (m *otlpExemplar) String() string { return proto.CompactTextString(m) }
+func (*otlpExemplar) ProtoMessage()    {}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *otlpKeyValue) Reset()         { *m = otlpKeyValue{} }
+func (m *otlpKeyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpKeyValue) ProtoMessage()    {}
+
+// otlpAnyValue has one of its fields set
+type otlpAnyValue struct {
+	StringValue *string         `protobuf:"bytes,1,opt,name=string_value,json=stringValue" json:"stringValue,omitempty"`
+	BoolValue   *bool           `protobuf:"varint,2,opt,name=bool_value,json=boolValue" json:"boolValue,omitempty"`
+	IntValue    *otlpInt64      `protobuf:"varint,3,opt,name=int_value,json=intValue" json:"intValue,omitempty"`
+	DoubleValue *float64        `protobuf:"fixed64,4,opt,name=double_value,json=doubleValue" json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `protobuf:"bytes,5,opt,name=array_value,json=arrayValue" json:"arrayValue,omitempty"`
+	KvlistValue *otlpKvList     `protobuf:"bytes,6,opt,name=kvlist_value,json=kvlistValue" json:"kvlistValue,omitempty"`
+	BytesValue  []byte          `protobuf:"bytes,7,opt,name=bytes_value,json=bytesValue" json:"bytesValue,omitempty"`
+}
+
+func (m *otlpAnyValue) Reset()         { *m = otlpAnyValue{} }
+func (m *otlpAnyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpAnyValue) ProtoMessage()    {}
+
+type otlpArrayValue struct {
+	Values []*otlpAnyValue `protobuf:"bytes,1,rep,name=values" json:"values,omitempty"`
+}
+
+func (m *otlpArrayValue) Reset()         { *m = otlpArrayValue{} }
+func (m *otlpArrayValue) String() string { return proto.CompactTextString(m) }
+func (*otlpArrayValue) ProtoMessage()    {}
+
+type otlpKvList struct {
+	Values []*otlpKeyValue `protobuf:"bytes,1,rep,name=values" json:"values,omitempty"`
+}
+
+func (m *otlpKvList) Reset()         { *m = otlpKvList{} }
+func (m *otlpKvList) String() string { return proto.CompactTextString(m) }
+func (*otlpKvList) ProtoMessage()    {}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// a minimal python pickle decoder for the carbon pickle protocol, which
+// sends a list of (path, (timestamp, value)) tuples. Only the opcodes
+// needed for lists, tuples, strings and numbers are supported, see:
+// 	https://github.com/python/cpython/blob/main/Lib/pickletools.py
+
+// pickleMark is the marker pushed by the MARK opcode
+type pickleMark struct{}
+
+// unpickle decodes a pickled value into []interface{} for lists and
+// tuples, string, int64, *big.Int, float64, bool or nil
+func unpickle(data []byte) (interface{}, error) {
+	var (
+		stack []interface{}
+		memo  = make(map[int]interface{})
+		buf   = bytes.NewReader(data)
+	)
+
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("pickle: stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	// popMark pops everything down to the last mark
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(pickleMark); ok {
+				items := append([]interface{}(nil), stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, fmt.Errorf("pickle: mark not found")
+	}
+	read := func(n int) ([]byte, error) {
+		if n < 0 || n > buf.Len() {
+			return nil, fmt.Errorf("pickle: truncated")
+		}
+		b := make([]byte, n)
+		buf.Read(b)
+		return b, nil
+	}
+	readLine := func() (string, error) {
+		var b []byte
+		for {
+			c, err := buf.ReadByte()
+			if err != nil {
+				return "", fmt.Errorf("pickle: truncated")
+			}
+			if c == '\n' {
+				return string(b), nil
+			}
+			b = append(b, c)
+		}
+	}
+	readUint := func(n int) (uint64, error) {
+		b, err := read(n)
+		if err != nil {
+			return 0, err
+		}
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		return v, nil
+	}
+	appendTo := func(items ...interface{}) error {
+		l, err := pop()
+		if err != nil {
+			return err
+		}
+		list, ok := l.([]interface{})
+		if !ok {
+			return fmt.Errorf("pickle: append to %T", l)
+		}
+		stack = append(stack, append(list, items...))
+		return nil
+	}
+
+	for {
+		op, err := buf.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("pickle: missing STOP")
+		}
+		switch op {
+		case '.': // STOP
+			return pop()
+		case 0x80: // PROTO
+			if _, err = read(1); err != nil {
+				return nil, err
+			}
+		case 0x95: // FRAME
+			if _, err = read(8); err != nil {
+				return nil, err
+			}
+		case '(': // MARK
+			stack = append(stack, pickleMark{})
+		case ']', ')': // EMPTY_LIST, EMPTY_TUPLE
+			stack = append(stack, []interface{}{})
+		case 'l', 't': // LIST, TUPLE
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, items)
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op - 0x84)
+			if len(stack) < n {
+				return nil, fmt.Errorf("pickle: stack underflow")
+			}
+			items := append([]interface{}(nil), stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+		case 'a': // APPEND
+			v, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			if err = appendTo(v); err != nil {
+				return nil, err
+			}
+		case 'e': // APPENDS
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			if err = appendTo(items...); err != nil {
+				return nil, err
+			}
+		case 'N': // NONE
+			stack = append(stack, nil)
+		case 0x88, 0x89: // NEWTRUE, NEWFALSE
+			stack = append(stack, op == 0x88)
+		case 'I': // INT
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			switch line {
+			case "00":
+				stack = append(stack, false)
+			case "01":
+				stack = append(stack, true)
+			default:
+				v, err := strconv.ParseInt(line, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("pickle: invalid INT %q", line)
+				}
+				stack = append(stack, v)
+			}
+		case 'L': // LONG
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			v, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+			if !ok {
+				return nil, fmt.Errorf("pickle: invalid LONG %q", line)
+			}
+			stack = append(stack, v)
+		case 'J': // BININT
+			v, err := readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(int32(v)))
+		case 'K', 'M': // BININT1, BININT2
+			n := 1
+			if op == 'M' {
+				n = 2
+			}
+			v, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(v))
+		case 0x8a: // LONG1
+			n, err := readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, decodeLong(b))
+		case 'F': // FLOAT
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				return nil, fmt.Errorf("pickle: invalid FLOAT %q", line)
+			}
+			stack = append(stack, v)
+		case 'G': // BINFLOAT
+			b, err := read(8)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case 'S', 'V': // STRING, UNICODE
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			if op == 'S' {
+				if line, err = pyUnquote(line); err != nil {
+					return nil, err
+				}
+			}
+			stack = append(stack, line)
+		case 'U', 0x8c: // SHORT_BINSTRING, SHORT_BINUNICODE
+			n, err := readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case 'T', 'X': // BINSTRING, BINUNICODE
+			n, err := readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case 'p', 'g': // PUT, GET
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.Atoi(line)
+			if err != nil {
+				return nil, fmt.Errorf("pickle: invalid memo index %q", line)
+			}
+			if err = memoOp(op == 'p', idx, &stack, memo); err != nil {
+				return nil, err
+			}
+		case 'q', 'h', 'r', 'j': // BINPUT, BINGET, LONG_BINPUT, LONG_BINGET
+			n := 1
+			if op == 'r' || op == 'j' {
+				n = 4
+			}
+			idx, err := readUint(n)
+			if err != nil {
+				return nil, err
+			}
+			if err = memoOp(op == 'q' || op == 'r', int(idx), &stack, memo); err != nil {
+				return nil, err
+			}
+		case 0x94: // MEMOIZE
+			if err = memoOp(true, len(memo), &stack, memo); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("pickle: unsupported opcode 0x%02x", op)
+		}
+	}
+}
+
+// memoOp stores the top of the stack in the memo, or pushes a memo entry
+func memoOp(put bool, idx int, stack *[]interface{}, memo map[int]interface{}) error {
+	if put {
+		if len(*stack) == 0 {
+			return fmt.Errorf("pickle: stack underflow")
+		}
+		memo[idx] = (*stack)[len(*stack)-1]
+		return nil
+	}
+	v, ok := memo[idx]
+	if !ok {
+		return fmt.Errorf("pickle: memo index %d not found", idx)
+	}
+	*stack = append(*stack, v)
+	return nil
+}
+
+// decodeLong decodes a little endian twos complement integer
+func decodeLong(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return v
+}
+
+// pickleFloat converts an unpickled number to a float
+func pickleFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// pyUnquote decodes the python repr of a byte string, as the STRING
+// opcode holds it: quoted with ' or " and with python escapes, which
+// differ from go's in eg. \' being valid in either quotes and \ followed
+// by any other character being kept as is
+func pyUnquote(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", fmt.Errorf("pickle: invalid STRING %q", s)
+	}
+	in := s[1 : len(s)-1]
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		if i++; i == len(in) {
+			return "", fmt.Errorf("pickle: invalid STRING %q", s)
+		}
+		switch c = in[i]; c {
+		case '\\', '\'', '"':
+			out = append(out, c)
+		case 'a':
+			out = append(out, '\a')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case '\n':
+			// line continuation
+		case 'x':
+			if i+3 > len(in) {
+				return "", fmt.Errorf("pickle: invalid STRING %q", s)
+			}
+			b, err := strconv.ParseUint(in[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("pickle: invalid STRING %q", s)
+			}
+			out = append(out, byte(b))
+			i += 2
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// up to three octal digits
+			j := i + 1
+			for j < len(in) && j < i+3 && in[j] >= '0' && in[j] <= '7' {
+				j++
+			}
+			b, _ := strconv.ParseUint(in[i:j], 8, 16)
+			out = append(out, byte(b))
+			i = j - 1
+		default:
+			out = append(out, '\\', c)
+		}
+	}
+	return string(out), nil
+}
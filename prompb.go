@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// remote write/read messages with metadata, exemplars and native
+// histograms, see:
+// 	https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+// the vendored remote protos predate them so they are declared here, field
+// numbers must match prompb. Oneofs are declared as plain proto3 fields,
+// which is wire compatible as only one of them is ever set.
+
+// p2cWriteRequest is remote.WriteRequest with metadata
+type p2cWriteRequest struct {
+	Timeseries []*p2cTimeSeries  `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+	Metadata   []*metricMetadata `protobuf:"bytes,3,rep,name=metadata" json:"metadata,omitempty"`
+}
+
+func (m *p2cWriteRequest) Reset()         { *m = p2cWriteRequest{} }
+func (m *p2cWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*p2cWriteRequest) ProtoMessage()    {}
+
+// p2cTimeSeries is remote.TimeSeries with exemplars and native histograms
+type p2cTimeSeries struct {
+	Labels     []*remote.LabelPair `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples    []*remote.Sample    `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+	Exemplars  []*exemplar         `protobuf:"bytes,3,rep,name=exemplars" json:"exemplars,omitempty"`
+	Histograms []*histogram        `protobuf:"bytes,4,rep,name=histograms" json:"histograms,omitempty"`
+}
+
+func (m *p2cTimeSeries) Reset()         { *m = p2cTimeSeries{} }
+func (m *p2cTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*p2cTimeSeries) ProtoMessage()    {}
+
+// samples returns the series without its exemplars and histograms
+func (m *p2cTimeSeries) samples() *remote.TimeSeries {
+	return &remote.TimeSeries{Labels: m.Labels, Samples: m.Samples}
+}
+
+// histogram is a native histogram sample. Integer histograms set CountInt,
+// ZeroCountInt and the delta encoded bucket counts, float histograms set
+// CountFloat, ZeroCountFloat and absolute bucket counts. Custom bucket
+// histograms (schema -53) carry their bucket upper bounds in CustomValues.
+type histogram struct {
+	CountInt       uint64        `protobuf:"varint,1,opt,name=count_int,json=countInt,proto3" json:"count_int,omitempty"`
+	CountFloat     float64       `protobuf:"fixed64,2,opt,name=count_float,json=countFloat,proto3" json:"count_float,omitempty"`
+	Sum            float64       `protobuf:"fixed64,3,opt,name=sum,proto3" json:"sum,omitempty"`
+	Schema         int32         `protobuf:"zigzag32,4,opt,name=schema,proto3" json:"schema,omitempty"`
+	ZeroThreshold  float64       `protobuf:"fixed64,5,opt,name=zero_threshold,json=zeroThreshold,proto3" json:"zero_threshold,omitempty"`
+	ZeroCountInt   uint64        `protobuf:"varint,6,opt,name=zero_count_int,json=zeroCountInt,proto3" json:"zero_count_int,omitempty"`
+	ZeroCountFloat float64       `protobuf:"fixed64,7,opt,name=zero_count_float,json=zeroCountFloat,proto3" json:"zero_count_float,omitempty"`
+	NegativeSpans  []*bucketSpan `protobuf:"bytes,8,rep,name=negative_spans,json=negativeSpans" json:"negative_spans,omitempty"`
+	NegativeDeltas []int64       `protobuf:"zigzag64,9,rep,packed,name=negative_deltas,json=negativeDeltas" json:"negative_deltas,omitempty"`
+	NegativeCounts []float64     `protobuf:"fixed64,10,rep,packed,name=negative_counts,json=negativeCounts" json:"negative_counts,omitempty"`
+	PositiveSpans  []*bucketSpan `protobuf:"bytes,11,rep,name=positive_spans,json=positiveSpans" json:"positive_spans,omitempty"`
+	PositiveDeltas []int64       `protobuf:"zigzag64,12,rep,packed,name=positive_deltas,json=positiveDeltas" json:"positive_deltas,omitempty"`
+	PositiveCounts []float64     `protobuf:"fixed64,13,rep,packed,name=positive_counts,json=positiveCounts" json:"positive_counts,omitempty"`
+	ResetHint      int32         `protobuf:"varint,14,opt,name=reset_hint,json=resetHint,proto3" json:"reset_hint,omitempty"`
+	TimestampMs    int64         `protobuf:"varint,15,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	CustomValues   []float64     `protobuf:"fixed64,16,rep,packed,name=custom_values,json=customValues" json:"custom_values,omitempty"`
+}
+
+func (m *histogram) Reset()         { *m = histogram{} }
+func (m *histogram) String() string { return proto.CompactTextString(m) }
+func (*histogram) ProtoMessage()    {}
+
+// isFloat returns true for float histograms. Zero valued oneof fields are
+// indistinguishable from unset ones, a histogram without float fields set
+// is taken to be an integer one.
+func (m *histogram) isFloat() bool {
+	return len(m.PositiveCounts) > 0 || len(m.NegativeCounts) > 0 ||
+		m.CountFloat != 0 || m.ZeroCountFloat != 0
+}
+
+// bucketSpan is a run of consecutive buckets, Offset is the gap from the
+// end of the previous span (or bucket index 0 for the first span)
+type bucketSpan struct {
+	Offset int32  `protobuf:"zigzag32,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length uint32 `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+}
+
+func (m *bucketSpan) Reset()         { *m = bucketSpan{} }
+func (m *bucketSpan) String() string { return proto.CompactTextString(m) }
+func (*bucketSpan) ProtoMessage()    {}
+
+// p2cReadResponse is remote.ReadResponse with native histograms
+type p2cReadResponse struct {
+	Results []*p2cQueryResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *p2cReadResponse) Reset()         { *m = p2cReadResponse{} }
+func (m *p2cReadResponse) String() string { return proto.CompactTextString(m) }
+func (*p2cReadResponse) ProtoMessage()    {}
+
+type p2cQueryResult struct {
+	Timeseries []*p2cTimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *p2cQueryResult) Reset()         { *m = p2cQueryResult{} }
+func (m *p2cQueryResult) String() string { return proto.CompactTextString(m) }
+func (*p2cQueryResult) ProtoMessage()    {}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// kafka.mode splits prom2click in two so prometheus isn't held up by
+// clickhouse outages. A producer publishes the requests the write
+// endpoints queue for the writer to a kafka topic instead, in batches of
+// up to ch.batch. A consumer feeds what's published to its writer and
+// commits a message's offset only once its rows, and those of the
+// messages before it on its partition, were committed to clickhouse. When
+// a write fails the partition is read again from the last committed
+// offset, so rows may be written more than once but aren't lost.
+
+// kafka modes
+const (
+	queueModeProducer = "producer"
+	queueModeConsumer = "consumer"
+	queueModeBoth     = "both"
+)
+
+// queue retry backoff bounds, for publishing and consuming again after a
+// failed write
+const (
+	queueMinBackoff = 100 * time.Millisecond
+	queueMaxBackoff = 30 * time.Second
+)
+
+// queueMessage is a message read from a partition of the topic
+type queueMessage struct {
+	partition int32
+	offset    int64
+	value     []byte
+}
+
+// queueBroker publishes to and consumes from the topic, on kafka or the
+// in-process memoryBroker
+type queueBroker interface {
+	// publish appends a message to the topic
+	publish(value []byte) error
+	// consume calls fn concurrently for each partition assigned to the
+	// consumer group with its messages from the committed offset, until
+	// ctx is done or any fn returns. It's called again to resume.
+	consume(ctx context.Context, fn func(ctx context.Context, claim queueClaim) error) error
+	close() error
+}
+
+// queueClaim is a partition assigned to the consumer
+type queueClaim interface {
+	messages() <-chan *queueMessage
+	// commit marks msg and the messages before it consumed
+	commit(msg *queueMessage)
+}
+
+// queueAck tracks the rows of a consumed message still to be written
+type queueAck struct {
+	// pending first for the 64 bit alignment atomic operations need on
+	// 32 bit platforms
+	pending int64
+	failed  int32
+	msg     *queueMessage
+	done    chan struct{}
+}
+
+func newQueueAck(msg *queueMessage, rows int) *queueAck {
+	a := &queueAck{pending: int64(rows), msg: msg, done: make(chan struct{})}
+	if rows == 0 {
+		close(a.done)
+	}
+	return a
+}
+
+// written records the outcome of writing one of the rows
+func (a *queueAck) written(ok bool) {
+	if !ok {
+		atomic.StoreInt32(&a.failed, 1)
+	}
+	if atomic.AddInt64(&a.pending, -1) == 0 {
+		close(a.done)
+	}
+}
+
+type p2cQueue struct {
+	// rewound is set when a partition is read again, to back off
+	rewound int32
+
+	conf   *config
+	broker queueBroker
+	// requests to publish, nil unless producing
+	requests chan *p2cRequest
+	// requests consumed for the writer, nil unless consuming
+	consumed   chan *p2cRequest
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mtx        sync.Mutex
+	stopping   chan struct{}
+	publisher  sync.WaitGroup
+	reading    sync.WaitGroup
+	committing sync.WaitGroup
+	stopped    chan struct{}
+	published  prometheus.Counter
+	errors     prometheus.Counter
+	dropped    prometheus.Counter
+	received   prometheus.Counter
+	invalid    prometheus.Counter
+	rewinds    prometheus.Counter
+}
+
+// NewP2CQueue returns the queue of kafka.mode. A producer publishes what's
+// queued on requests, a consumer queues what it consumes on requests too,
+// both consumes to a channel of its own. Its metrics are registered with reg.
+func NewP2CQueue(conf *config, requests chan *p2cRequest, reg prometheus.Registerer) (*p2cQueue, error) {
+	var err error
+	q := new(p2cQueue)
+	q.conf = conf
+	q.stopping = make(chan struct{})
+	q.stopped = make(chan struct{})
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	switch conf.KafkaMode {
+	case queueModeProducer:
+		q.requests = requests
+	case queueModeConsumer:
+		q.consumed = requests
+	case queueModeBoth:
+		q.requests = requests
+		q.consumed = make(chan *p2cRequest, conf.ChanSize)
+	default:
+		err = fmt.Errorf("unknown kafka.mode %q, expected producer, consumer or both", conf.KafkaMode)
+	}
+	if err == nil && q.requests != nil && conf.KafkaLinger <= 0 {
+		err = fmt.Errorf("kafka.linger must be positive")
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return q, err
+	}
+
+	if conf.KafkaBrokers == "memory" {
+		if conf.KafkaMode != queueModeBoth {
+			err = fmt.Errorf("the memory broker only works with kafka.mode both")
+			fmt.Printf("Error: %s\n", err.Error())
+			return q, err
+		}
+		q.broker = newMemoryBroker(memoryPartitions)
+	} else {
+		q.broker, err = newKafkaBroker(conf, q.requests != nil, q.consumed != nil)
+		if err != nil {
+			fmt.Printf("Error connecting to kafka: %s\n", err.Error())
+			return q, err
+		}
+	}
+
+	q.published = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_published_messages_total",
+			Help: "Total number of batches of samples published to kafka.",
+		},
+	)
+	q.errors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_publish_errors_total",
+			Help: "Total number of failed attempts to publish a batch of samples to kafka.",
+		},
+	)
+	q.dropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_dropped_samples_total",
+			Help: "Total number of samples that could not be published to kafka before shutdown.",
+		},
+	)
+	q.received = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_consumed_messages_total",
+			Help: "Total number of batches of samples consumed from kafka.",
+		},
+	)
+	q.invalid = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_invalid_messages_total",
+			Help: "Total number of messages consumed from kafka that could not be decoded.",
+		},
+	)
+	q.rewinds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kafka_rewinds_total",
+			Help: "Total number of times a partition was read again from its last committed offset as writing to clickhouse failed.",
+		},
+	)
+	reg.MustRegister(q.published)
+	reg.MustRegister(q.errors)
+	reg.MustRegister(q.dropped)
+	reg.MustRegister(q.received)
+	reg.MustRegister(q.invalid)
+	reg.MustRegister(q.rewinds)
+
+	return q, nil
+}
+
+func (q *p2cQueue) Start() {
+	fmt.Printf("Kafka %s starting on topic %s..\n", q.conf.KafkaMode, q.conf.KafkaTopic)
+	if q.requests != nil {
+		q.publisher.Add(1)
+		go q.publish()
+	}
+	if q.consumed != nil {
+		go q.consume()
+	}
+}
+
+// publish publishes requests in batches of up to ch.batch, waiting at most
+// kafka.linger for a batch to fill
+func (q *p2cQueue) publish() {
+	defer q.publisher.Done()
+	tick := time.NewTicker(q.conf.KafkaLinger)
+	defer tick.Stop()
+
+	// requests with an ack are acknowledged once their batch is published
+	var (
+		batch = new(queueBatch)
+		acks  []writeAck
+	)
+	flush := func() {
+		if len(batch.Requests) > 0 {
+			ok := q.send(batch)
+			for _, ack := range acks {
+				ack.written(ok)
+			}
+			batch, acks = new(queueBatch), nil
+		}
+	}
+	for {
+		select {
+		case req, ok := <-q.requests:
+			if !ok {
+				flush()
+				return
+			}
+			batch.Requests = append(batch.Requests, newQueueRequest(req))
+			if req.ack != nil {
+				acks = append(acks, req.ack)
+			}
+			if len(batch.Requests) >= q.conf.ChBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// send publishes a batch, retrying with backoff until it's published or
+// the queue is stopping. Meanwhile the write endpoints block once the
+// request channel fills. It returns false if the batch was dropped.
+func (q *p2cQueue) send(batch *queueBatch) bool {
+	nmetrics := float64(len(batch.Requests))
+	data, err := proto.Marshal(batch)
+	if err != nil {
+		fmt.Printf("Error: kafka: marshal: %s\n", err.Error())
+		q.dropped.Add(nmetrics)
+		return false
+	}
+
+	backoff := queueMinBackoff
+	for {
+		if err = q.broker.publish(data); err == nil {
+			q.published.Inc()
+			return true
+		}
+		fmt.Printf("Error: kafka: publish: %s\n", err.Error())
+		q.errors.Inc()
+		select {
+		case <-q.stopping:
+			q.dropped.Add(nmetrics)
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > queueMaxBackoff {
+			backoff = queueMaxBackoff
+		}
+	}
+}
+
+// consume consumes the topic until the queue is closed, backing off after
+// a partition is rewound so a clickhouse outage isn't retried in a loop
+func (q *p2cQueue) consume() {
+	defer close(q.stopped)
+	backoff := queueMinBackoff
+	for q.ctx.Err() == nil {
+		err := q.broker.consume(q.ctx, q.consumeClaim)
+		if err != nil {
+			fmt.Printf("Error: kafka: consume: %s\n", err.Error())
+		} else if atomic.SwapInt32(&q.rewound, 0) == 0 {
+			backoff = queueMinBackoff
+			continue
+		}
+		select {
+		case <-q.ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > queueMaxBackoff {
+			backoff = queueMaxBackoff
+		}
+	}
+}
+
+// consumeClaim feeds the writer the requests of a partition, committing
+// each message once its rows are written. Once the queue is stopping it
+// returns only when the session ends, so everything read can be committed
+// first.
+func (q *p2cQueue) consumeClaim(ctx context.Context, claim queueClaim) error {
+	q.mtx.Lock()
+	select {
+	case <-q.stopping:
+		q.mtx.Unlock()
+		<-ctx.Done()
+		return nil
+	default:
+	}
+	q.reading.Add(1)
+	q.committing.Add(1)
+	q.mtx.Unlock()
+
+	acks := make(chan *queueAck, q.conf.ChanSize)
+	failed := make(chan struct{})
+	committed := make(chan struct{})
+	go q.commit(claim, acks, failed, committed)
+
+	stopping, err := q.read(ctx, claim, acks, failed)
+	close(acks)
+	q.reading.Done()
+	if stopping {
+		<-committed
+		<-ctx.Done()
+	}
+	return err
+}
+
+// read reads messages until the queue is stopping, the session ends or a
+// write fails, returning whether the queue is stopping
+func (q *p2cQueue) read(ctx context.Context, claim queueClaim, acks chan<- *queueAck,
+	failed <-chan struct{}) (bool, error) {
+
+	for {
+		select {
+		case <-q.stopping:
+			return true, nil
+		default:
+		}
+
+		var msg *queueMessage
+		select {
+		case <-q.stopping:
+			return true, nil
+		case <-ctx.Done():
+			return false, nil
+		case <-failed:
+			return false, fmt.Errorf("writing to clickhouse failed, reading the partition again " +
+				"from its last committed offset")
+		case m, ok := <-claim.messages():
+			if !ok {
+				return false, nil
+			}
+			msg = m
+		}
+		q.received.Inc()
+
+		var batch queueBatch
+		if err := proto.Unmarshal(msg.value, &batch); err != nil {
+			// it never will decode, so it's committed as is
+			fmt.Printf("Error: kafka: partition %d offset %d: %s\n", msg.partition, msg.offset, err.Error())
+			q.invalid.Inc()
+			batch.Requests = nil
+		}
+
+		ack := newQueueAck(msg, len(batch.Requests))
+		select {
+		case acks <- ack:
+		case <-q.stopping:
+			return true, nil
+		case <-ctx.Done():
+			return false, nil
+		}
+		for _, m := range batch.Requests {
+			req := m.p2c()
+			req.ack = ack
+			q.consumed <- req
+		}
+	}
+}
+
+// commit commits the messages of a partition in order as their rows are
+// written. After a failed write nothing more is committed and failed is
+// closed, so the partition is read again from the failed message.
+func (q *p2cQueue) commit(claim queueClaim, acks <-chan *queueAck, failed chan<- struct{},
+	committed chan<- struct{}) {
+
+	defer q.committing.Done()
+	defer close(committed)
+	ok := true
+	for ack := range acks {
+		if !ok {
+			continue
+		}
+		<-ack.done
+		if atomic.LoadInt32(&ack.failed) != 0 {
+			ok = false
+			q.rewinds.Inc()
+			atomic.StoreInt32(&q.rewound, 1)
+			close(failed)
+			continue
+		}
+		claim.commit(ack.msg)
+	}
+}
+
+// Stop stops publishing retries and reading from the topic, before the
+// request channel is closed
+func (q *p2cQueue) Stop() {
+	q.mtx.Lock()
+	close(q.stopping)
+	q.mtx.Unlock()
+	q.reading.Wait()
+	if q.conf.KafkaMode == queueModeBoth {
+		close(q.consumed)
+	}
+}
+
+// Wait waits for everything queued to be published, once the request
+// channel is closed
+func (q *p2cQueue) Wait() {
+	q.publisher.Wait()
+}
+
+// Close commits what was written, once the writer has stopped, and
+// disconnects from the brokers
+func (q *p2cQueue) Close() {
+	done := make(chan struct{})
+	go func() {
+		q.committing.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(q.conf.HTTPTimeout):
+		fmt.Println("Kafka commit timed out, uncommitted messages will be consumed again..")
+	}
+
+	q.cancel()
+	if q.consumed != nil {
+		<-q.stopped
+	}
+	if err := q.broker.close(); err != nil {
+		fmt.Printf("Error: kafka: close: %s\n", err.Error())
+	}
+}
+
+// memoryPartitions is the number of partitions of the memory broker
+const memoryPartitions = 4
+
+// memoryBroker is an in-process stand-in for kafka, a topic consumed by a
+// single consumer group. Nothing survives a restart, it's for trying
+// kafka.mode out and testing it without a cluster.
+type memoryBroker struct {
+	mtx        sync.Mutex
+	partitions []*memoryPartition
+	next       int
+	// closed and replaced when a message is published
+	published chan struct{}
+	closed    bool
+}
+
+// memoryPartition holds the messages from the committed offset on
+type memoryPartition struct {
+	committed int64
+	messages  []*queueMessage
+}
+
+func newMemoryBroker(partitions int) *memoryBroker {
+	b := &memoryBroker{published: make(chan struct{})}
+	for i := 0; i < partitions; i++ {
+		b.partitions = append(b.partitions, new(memoryPartition))
+	}
+	return b
+}
+
+// publish appends to the partitions in turn
+func (b *memoryBroker) publish(value []byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.closed {
+		return fmt.Errorf("memory broker closed")
+	}
+	p := b.partitions[b.next]
+	p.messages = append(p.messages, &queueMessage{
+		partition: int32(b.next),
+		offset:    p.committed + int64(len(p.messages)),
+		value:     value,
+	})
+	b.next = (b.next + 1) % len(b.partitions)
+	close(b.published)
+	b.published = make(chan struct{})
+	return nil
+}
+
+// consume assigns every partition to fn, as kafka does the only member of
+// a consumer group
+func (b *memoryBroker) consume(ctx context.Context, fn func(ctx context.Context, claim queueClaim) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(b.partitions))
+	for i := range b.partitions {
+		c := &memoryClaim{broker: b, partition: i, ctx: ctx, msgs: make(chan *queueMessage)}
+		go c.feed()
+		go func() {
+			err := fn(ctx, c)
+			// a session ends when any partition's consumer returns
+			cancel()
+			errs <- err
+		}()
+	}
+
+	var err error
+	for range b.partitions {
+		if cerr := <-errs; cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (b *memoryBroker) close() error {
+	b.mtx.Lock()
+	b.closed = true
+	b.mtx.Unlock()
+	return nil
+}
+
+// memoryClaim is a partition of the memory broker
+type memoryClaim struct {
+	broker    *memoryBroker
+	partition int
+	// the session
+	ctx  context.Context
+	msgs chan *queueMessage
+}
+
+// feed sends the messages of the partition from its committed offset
+// until the session ends
+func (c *memoryClaim) feed() {
+	defer close(c.msgs)
+	ctx := c.ctx
+	b := c.broker
+	b.mtx.Lock()
+	offset := b.partitions[c.partition].committed
+	b.mtx.Unlock()
+	for {
+		var msg *queueMessage
+		b.mtx.Lock()
+		p := b.partitions[c.partition]
+		if i := offset - p.committed; i >= 0 && i < int64(len(p.messages)) {
+			msg = p.messages[i]
+		}
+		published := b.published
+		b.mtx.Unlock()
+
+		if msg == nil {
+			select {
+			case <-published:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case c.msgs <- msg:
+			offset++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *memoryClaim) messages() <-chan *queueMessage {
+	return c.msgs
+}
+
+// commit drops the messages up to msg. As with kafka commits after the
+// session ended are ignored.
+func (c *memoryClaim) commit(msg *queueMessage) {
+	b := c.broker
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if c.ctx.Err() != nil {
+		return
+	}
+	p := b.partitions[c.partition]
+	if n := msg.offset + 1 - p.committed; n > 0 {
+		p.messages = p.messages[n:]
+		p.committed = msg.offset + 1
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testDB is a clickhouse stand-in recording the values of committed rows
+type testDB struct {
+	mtx sync.Mutex
+	// commits fail while fail > 0
+	fail int
+	// row inserts fail while failExec > 0
+	failExec int
+	// commits wait for hold to be closed, if set
+	hold      chan struct{}
+	committed map[float64]int
+	// commits that have started
+	commits int
+}
+
+var (
+	testDBsMtx sync.Mutex
+	testDBs    = make(map[string]*testDB)
+)
+
+func init() {
+	sql.Register("queuetest", testDriver{})
+}
+
+// newTestDB returns a database and the connection pool to it
+func newTestDB(t *testing.T) (*testDB, *sql.DB) {
+	db := &testDB{committed: make(map[float64]int)}
+	testDBsMtx.Lock()
+	testDBs[t.Name()] = db
+	testDBsMtx.Unlock()
+	pool, err := sql.Open("queuetest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, pool
+}
+
+// rows returns the number of distinct values committed
+func (db *testDB) rows() int {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return len(db.committed)
+}
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testDBsMtx.Lock()
+	defer testDBsMtx.Unlock()
+	return &testConn{db: testDBs[name]}, nil
+}
+
+type testConn struct {
+	db *testDB
+	tx *testTx
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{conn: c}, nil }
+func (c *testConn) Close() error                              { return nil }
+
+func (c *testConn) Begin() (driver.Tx, error) {
+	c.tx = &testTx{conn: c}
+	return c.tx, nil
+}
+
+type testTx struct {
+	conn *testConn
+	vals []float64
+}
+
+func (tx *testTx) Commit() error {
+	db := tx.conn.db
+	db.mtx.Lock()
+	db.commits++
+	hold := db.hold
+	db.mtx.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.fail > 0 {
+		db.fail--
+		return errors.New("commit failed")
+	}
+	for _, v := range tx.vals {
+		db.committed[v]++
+	}
+	return nil
+}
+
+func (tx *testTx) Rollback() error { return nil }
+
+type testStmt struct {
+	conn *testConn
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+
+// CheckNamedValue accepts the clickhouse array arguments as they are
+func (s *testStmt) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+// Exec records the val of an insertSQL row
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.failExec > 0 {
+		db.failExec--
+		return nil, errors.New("exec failed")
+	}
+	s.conn.tx.vals = append(s.conn.tx.vals, args[3].(float64))
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+// testQueue is a queue in both mode on the memory broker feeding a writer
+// on db
+type testQueue struct {
+	requests chan *p2cRequest
+	queue    *p2cQueue
+	broker   *memoryBroker
+	writer   *p2cWriter
+}
+
+func newTestQueue(t *testing.T, pool *sql.DB) *testQueue {
+	conf := &config{
+		ChDB:          "metrics",
+		ChTable:       "samples",
+		ChBatch:       10,
+		ChBatchLinger: 10 * time.Millisecond,
+		ChanSize:      100,
+		KafkaMode:     queueModeBoth,
+		KafkaBrokers:  "memory",
+		KafkaTopic:    "prom2click",
+		KafkaLinger:   10 * time.Millisecond,
+		HTTPTimeout:   5 * time.Second,
+	}
+	tq := &testQueue{requests: make(chan *p2cRequest, conf.ChanSize)}
+
+	var err error
+	reg := prometheus.NewRegistry()
+	if tq.queue, err = NewP2CQueue(conf, tq.requests, reg); err != nil {
+		t.Fatal(err)
+	}
+	tq.broker = tq.queue.broker.(*memoryBroker)
+	if tq.writer, err = NewP2CWriter(conf, tq.queue.consumed, reg); err != nil {
+		t.Fatal(err)
+	}
+	tq.writer.shards[0].db.Close()
+	tq.writer.shards[0].db = pool
+
+	tq.writer.Start()
+	tq.queue.Start()
+	return tq
+}
+
+// send queues requests with the values from to to-1
+func (tq *testQueue) send(from, to int) {
+	for i := from; i < to; i++ {
+		tq.requests <- &p2cRequest{
+			name: "test",
+			tags: []string{"__name__=test", fmt.Sprintf("i=%d", i)},
+			val:  float64(i),
+			ts:   time.Unix(int64(i), 0),
+		}
+	}
+}
+
+// shutdown stops the queue and writer as the server does
+func (tq *testQueue) shutdown() {
+	tq.queue.Stop()
+	close(tq.requests)
+	tq.queue.Wait()
+	tq.writer.Wait()
+	tq.queue.Close()
+}
+
+// uncommitted returns the values of the messages not committed yet
+func (tq *testQueue) uncommitted(t *testing.T) []float64 {
+	tq.broker.mtx.Lock()
+	defer tq.broker.mtx.Unlock()
+	var vals []float64
+	for _, p := range tq.broker.partitions {
+		for _, msg := range p.messages {
+			var batch queueBatch
+			if err := proto.Unmarshal(msg.value, &batch); err != nil {
+				t.Fatal(err)
+			}
+			for _, req := range batch.Requests {
+				vals = append(vals, req.Value)
+			}
+		}
+	}
+	return vals
+}
+
+// committedOffsets returns the sum of the committed offsets
+func (tq *testQueue) committedOffsets() int64 {
+	tq.broker.mtx.Lock()
+	defer tq.broker.mtx.Unlock()
+	var n int64
+	for _, p := range tq.broker.partitions {
+		n += p.committed
+	}
+	return n
+}
+
+// waitFor polls cond until it's true or a few seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueCommitsAfterWrite(t *testing.T) {
+	db, pool := newTestDB(t)
+	hold := make(chan struct{})
+	db.hold = hold
+	var release sync.Once
+	tq := newTestQueue(t, pool)
+	defer tq.shutdown()
+	defer release.Do(func() { close(hold) })
+
+	tq.send(0, 50)
+	waitFor(t, "a write", func() bool {
+		db.mtx.Lock()
+		defer db.mtx.Unlock()
+		return db.commits > 0
+	})
+	// give a premature commit a chance to happen
+	time.Sleep(50 * time.Millisecond)
+	if n := tq.committedOffsets(); n != 0 {
+		t.Fatalf("%d messages committed before they were written", n)
+	}
+
+	release.Do(func() { close(hold) })
+	waitFor(t, "every message to be committed", func() bool {
+		return len(tq.uncommitted(t)) == 0 && db.rows() == 50
+	})
+}
+
+func TestQueueRewindsAfterFailedWrite(t *testing.T) {
+	db, pool := newTestDB(t)
+	db.fail = 1
+	tq := newTestQueue(t, pool)
+	defer tq.shutdown()
+
+	tq.send(0, 50)
+	waitFor(t, "every message to be committed", func() bool {
+		return len(tq.uncommitted(t)) == 0 && db.rows() == 50
+	})
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.fail != 0 {
+		t.Fatal("no write failed")
+	}
+	// the failed batch was read and written again
+	for i := 0; i < 50; i++ {
+		if db.committed[float64(i)] == 0 {
+			t.Fatalf("value %d never written", i)
+		}
+	}
+}
+
+func TestQueueRewindsAfterFailedRow(t *testing.T) {
+	db, pool := newTestDB(t)
+	db.failExec = 1
+	tq := newTestQueue(t, pool)
+	defer tq.shutdown()
+
+	tq.send(0, 50)
+	waitFor(t, "every message to be committed", func() bool {
+		return len(tq.uncommitted(t)) == 0 && db.rows() == 50
+	})
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if db.failExec != 0 {
+		t.Fatal("no row failed")
+	}
+}
+
+func TestQueueShutdownCommitsWritten(t *testing.T) {
+	db, pool := newTestDB(t)
+	hold := make(chan struct{})
+	db.hold = hold
+	tq := newTestQueue(t, pool)
+
+	// shut down while a write is in flight
+	tq.send(0, 50)
+	waitFor(t, "a write", func() bool {
+		db.mtx.Lock()
+		defer db.mtx.Unlock()
+		return db.commits > 0
+	})
+	stopped := make(chan struct{})
+	go func() {
+		tq.shutdown()
+		close(stopped)
+	}()
+	waitFor(t, "the queue to stop reading", func() bool {
+		select {
+		case <-tq.queue.stopping:
+			return true
+		default:
+			return false
+		}
+	})
+	close(hold)
+	<-stopped
+
+	// everything is either committed to kafka, and so written, or will be
+	// read again, but nothing written is left uncommitted
+	uncommitted := tq.uncommitted(t)
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	for _, v := range uncommitted {
+		if db.committed[v] > 0 {
+			t.Fatalf("value %v was written but not committed", v)
+		}
+	}
+	if len(db.committed) == 0 {
+		t.Fatal("nothing was written")
+	}
+	if len(db.committed)+len(uncommitted) != 50 {
+		t.Fatalf("%d values written and %d uncommitted, expected 50 in all",
+			len(db.committed), len(uncommitted))
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// messages published to kafka, a batch of the requests queued for the
+// writer. Only prom2click reads them but field numbers must still never
+// change, producers and consumers may run different versions.
+
+// queueBatch is a kafka message
+type queueBatch struct {
+	Requests []*queueRequest `protobuf:"bytes,1,rep,name=requests" json:"requests,omitempty"`
+}
+
+func (m *queueBatch) Reset()         { *m = queueBatch{} }
+func (m *queueBatch) String() string { return proto.CompactTextString(m) }
+func (*queueBatch) ProtoMessage()    {}
+
+// queueRequest is a p2cRequest, at most one of the histogram, native
+// histogram, exemplar and metadata is set
+type queueRequest struct {
+	Name        string                `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Tags        []string              `protobuf:"bytes,2,rep,name=tags" json:"tags,omitempty"`
+	Value       float64               `protobuf:"fixed64,3,opt,name=value,proto3" json:"value,omitempty"`
+	TimestampNs int64                 `protobuf:"varint,4,opt,name=timestamp_ns,json=timestampNs,proto3" json:"timestamp_ns,omitempty"`
+	Histogram   *queueHistogram       `protobuf:"bytes,5,opt,name=histogram" json:"histogram,omitempty"`
+	Native      *queueNativeHistogram `protobuf:"bytes,6,opt,name=native" json:"native,omitempty"`
+	Exemplar    *queueExemplar        `protobuf:"bytes,7,opt,name=exemplar" json:"exemplar,omitempty"`
+	Metadata    *queueMetadata        `protobuf:"bytes,8,opt,name=metadata" json:"metadata,omitempty"`
+}
+
+func (m *queueRequest) Reset()         { *m = queueRequest{} }
+func (m *queueRequest) String() string { return proto.CompactTextString(m) }
+func (*queueRequest) ProtoMessage()    {}
+
+// queueHistogram is a p2cHistogram
+type queueHistogram struct {
+	Kind   string    `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Bounds []float64 `protobuf:"fixed64,2,rep,packed,name=bounds" json:"bounds,omitempty"`
+	Counts []float64 `protobuf:"fixed64,3,rep,packed,name=counts" json:"counts,omitempty"`
+	Sum    float64   `protobuf:"fixed64,4,opt,name=sum,proto3" json:"sum,omitempty"`
+	Count  float64   `protobuf:"fixed64,5,opt,name=count,proto3" json:"count,omitempty"`
+	Labels []string  `protobuf:"bytes,6,rep,name=labels" json:"labels,omitempty"`
+}
+
+func (m *queueHistogram) Reset()         { *m = queueHistogram{} }
+func (m *queueHistogram) String() string { return proto.CompactTextString(m) }
+func (*queueHistogram) ProtoMessage()    {}
+
+// queueNativeHistogram is a p2cNativeHistogram
+type queueNativeHistogram struct {
+	Schema        int32     `protobuf:"zigzag32,1,opt,name=schema,proto3" json:"schema,omitempty"`
+	ZeroThreshold float64   `protobuf:"fixed64,2,opt,name=zero_threshold,json=zeroThreshold,proto3" json:"zero_threshold,omitempty"`
+	ZeroCount     float64   `protobuf:"fixed64,3,opt,name=zero_count,json=zeroCount,proto3" json:"zero_count,omitempty"`
+	Count         float64   `protobuf:"fixed64,4,opt,name=count,proto3" json:"count,omitempty"`
+	Sum           float64   `protobuf:"fixed64,5,opt,name=sum,proto3" json:"sum,omitempty"`
+	PosOffsets    []int32   `protobuf:"zigzag32,6,rep,packed,name=pos_offsets,json=posOffsets" json:"pos_offsets,omitempty"`
+	PosLengths    []uint32  `protobuf:"varint,7,rep,packed,name=pos_lengths,json=posLengths" json:"pos_lengths,omitempty"`
+	PosBuckets    []float64 `protobuf:"fixed64,8,rep,packed,name=pos_buckets,json=posBuckets" json:"pos_buckets,omitempty"`
+	NegOffsets    []int32   `protobuf:"zigzag32,9,rep,packed,name=neg_offsets,json=negOffsets" json:"neg_offsets,omitempty"`
+	NegLengths    []uint32  `protobuf:"varint,10,rep,packed,name=neg_lengths,json=negLengths" json:"neg_lengths,omitempty"`
+	NegBuckets    []float64 `protobuf:"fixed64,11,rep,packed,name=neg_buckets,json=negBuckets" json:"neg_buckets,omitempty"`
+	ResetHint     uint32    `protobuf:"varint,12,opt,name=reset_hint,json=resetHint,proto3" json:"reset_hint,omitempty"`
+	Float         uint32    `protobuf:"varint,13,opt,name=float,proto3" json:"float,omitempty"`
+	CustomValues  []float64 `protobuf:"fixed64,14,rep,packed,name=custom_values,json=customValues" json:"custom_values,omitempty"`
+}
+
+func (m *queueNativeHistogram) Reset()         { *m = queueNativeHistogram{} }
+func (m *queueNativeHistogram) String() string { return proto.CompactTextString(m) }
+func (*queueNativeHistogram) ProtoMessage()    {}
+
+// queueExemplar is a p2cExemplar
+type queueExemplar struct {
+	Labels      []string `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Value       float64  `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	TimestampMs int64    `protobuf:"varint,3,opt,name=timestamp_ms,json=timestampMs,proto3" json:"timestamp_ms,omitempty"`
+}
+
+func (m *queueExemplar) Reset()         { *m = queueExemplar{} }
+func (m *queueExemplar) String() string { return proto.CompactTextString(m) }
+func (*queueExemplar) ProtoMessage()    {}
+
+// queueMetadata is a p2cMetadata
+type queueMetadata struct {
+	Type string `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Help string `protobuf:"bytes,2,opt,name=help,proto3" json:"help,omitempty"`
+	Unit string `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
+}
+
+func (m *queueMetadata) Reset()         { *m = queueMetadata{} }
+func (m *queueMetadata) String() string { return proto.CompactTextString(m) }
+func (*queueMetadata) ProtoMessage()    {}
+
+// newQueueRequest returns the message of a request
+func newQueueRequest(req *p2cRequest) *queueRequest {
+	m := &queueRequest{
+		Name:        req.name,
+		Tags:        req.tags,
+		Value:       req.val,
+		TimestampNs: req.ts.UnixNano(),
+	}
+	if h := req.hist; h != nil {
+		m.Histogram = &queueHistogram{
+			Kind:   h.kind,
+			Bounds: h.bounds,
+			Counts: h.counts,
+			Sum:    h.sum,
+			Count:  h.count,
+			Labels: h.labels,
+		}
+	}
+	if h := req.native; h != nil {
+		m.Native = &queueNativeHistogram{
+			Schema:        h.schema,
+			ZeroThreshold: h.zeroThreshold,
+			ZeroCount:     h.zeroCount,
+			Count:         h.count,
+			Sum:           h.sum,
+			PosOffsets:    h.posOffsets,
+			PosLengths:    h.posLengths,
+			PosBuckets:    h.posBuckets,
+			NegOffsets:    h.negOffsets,
+			NegLengths:    h.negLengths,
+			NegBuckets:    h.negBuckets,
+			ResetHint:     uint32(h.resetHint),
+			Float:         uint32(h.float),
+			CustomValues:  h.customValues,
+		}
+	}
+	if e := req.exemplar; e != nil {
+		m.Exemplar = &queueExemplar{Labels: e.labels, Value: e.val, TimestampMs: e.tsMs}
+	}
+	if md := req.meta; md != nil {
+		m.Metadata = &queueMetadata{Type: md.Type, Help: md.Help, Unit: md.Unit}
+	}
+	return m
+}
+
+// p2c returns the request of a message
+func (m *queueRequest) p2c() *p2cRequest {
+	req := &p2cRequest{
+		name: m.Name,
+		tags: m.Tags,
+		val:  m.Value,
+		ts:   time.Unix(0, m.TimestampNs),
+	}
+	if h := m.Histogram; h != nil {
+		req.hist = &p2cHistogram{
+			kind:   h.Kind,
+			bounds: h.Bounds,
+			counts: h.Counts,
+			sum:    h.Sum,
+			count:  h.Count,
+			labels: h.Labels,
+		}
+	}
+	if h := m.Native; h != nil {
+		req.native = &p2cNativeHistogram{
+			schema:        h.Schema,
+			zeroThreshold: h.ZeroThreshold,
+			zeroCount:     h.ZeroCount,
+			count:         h.Count,
+			sum:           h.Sum,
+			posOffsets:    h.PosOffsets,
+			posLengths:    h.PosLengths,
+			posBuckets:    h.PosBuckets,
+			negOffsets:    h.NegOffsets,
+			negLengths:    h.NegLengths,
+			negBuckets:    h.NegBuckets,
+			resetHint:     uint8(h.ResetHint),
+			float:         uint8(h.Float),
+			customValues:  h.CustomValues,
+		}
+	}
+	if e := m.Exemplar; e != nil {
+		req.exemplar = &p2cExemplar{labels: e.Labels, val: e.Value, tsMs: e.TimestampMs}
+	}
+	if md := m.Metadata; md != nil {
+		req.meta = &p2cMetadata{Type: md.Type, Help: md.Help, Unit: md.Unit}
+	}
+	return req
+}
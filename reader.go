@@ -2,25 +2,171 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/kshvakov/clickhouse"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/remote"
 )
 
+// clickhouse exception codes for query limits
+const (
+	chTooManyRows        = 158
+	chTimeoutExceeded    = 159
+	chTooManyRowsOrBytes = 396
+)
+
 type p2cReader struct {
-	conf *config
-	db   *sql.DB
+	conf       *config
+	db         *sql.DB
+	cache      *p2cCache
+	rollup     rollupSchedule
+	downsample []downsampleTable
+	limits     *prometheus.CounterVec
+	native     *nativeProbes
+	// queries and errors are logged to log
+	log io.Writer
+}
+
+// readLimits tracks the number of series and samples accumulated for a
+// single read request against the configured maximums (0 is unlimited)
+type readLimits struct {
+	mtx        sync.Mutex
+	maxSeries  int
+	maxSamples int
+	series     int
+	samples    int
+	// keys of the series seen, a series found in several sub-ranges of a
+	// split query is only counted once
+	seen map[string]struct{}
+}
+
+func (r *p2cReader) newReadLimits() *readLimits {
+	return &readLimits{
+		maxSeries:  r.conf.ReadMaxSeries,
+		maxSamples: r.conf.ReadMaxSamples,
+	}
+}
+
+// addSeries records a new series, returning an error if that exceeds the limit
+func (r *p2cReader) addSeries(l *readLimits) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.series++
+	if l.maxSeries > 0 && l.series > l.maxSeries {
+		r.limits.WithLabelValues("series").Inc()
+		return &p2cReadError{http.StatusUnprocessableEntity,
+			fmt.Sprintf("read request exceeded the limit of %d series, narrow the "+
+				"selector or time range", l.maxSeries)}
+	}
+	return nil
+}
+
+// addSeriesKey records the series with labelsKey key unless it was seen
+// already, returning an error if that exceeds the limit
+func (r *p2cReader) addSeriesKey(l *readLimits, key string) error {
+	if l.maxSeries <= 0 {
+		return nil
+	}
+	l.mtx.Lock()
+	if l.seen == nil {
+		l.seen = make(map[string]struct{})
+	}
+	_, ok := l.seen[key]
+	l.seen[key] = struct{}{}
+	l.mtx.Unlock()
+	if ok {
+		return nil
+	}
+	return r.addSeries(l)
+}
+
+// addSamples records n new samples, returning an error if that exceeds the limit
+func (r *p2cReader) addSamples(l *readLimits, n int) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.samples += n
+	if l.maxSamples > 0 && l.samples > l.maxSamples {
+		r.limits.WithLabelValues("samples").Inc()
+		return &p2cReadError{http.StatusUnprocessableEntity,
+			fmt.Sprintf("read request exceeded the limit of %d samples, narrow the "+
+				"selector or time range", l.maxSamples)}
+	}
+	return nil
+}
+
+// p2cReadError is a read failure with the http status that should be
+// returned to the client
+type p2cReadError struct {
+	status int
+	msg    string
+}
+
+func (e *p2cReadError) Error() string {
+	return e.msg
+}
+
+// queryError maps query failures caused by cancellation or by the
+// configured read limits to a p2cReadError, other errors pass through
+func (r *p2cReader) queryError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return &p2cReadError{http.StatusGatewayTimeout,
+			fmt.Sprintf("query exceeded the maximum duration of %s", r.conf.CHMaxQueryTime)}
+	case context.Canceled:
+		return &p2cReadError{http.StatusServiceUnavailable, "query cancelled by client"}
+	}
+
+	if ex, ok := err.(*clickhouse.Exception); ok {
+		switch ex.Code {
+		case chTimeoutExceeded:
+			return &p2cReadError{http.StatusGatewayTimeout,
+				fmt.Sprintf("query exceeded the maximum duration of %s", r.conf.CHMaxQueryTime)}
+		case chTooManyRows, chTooManyRowsOrBytes:
+			return &p2cReadError{http.StatusUnprocessableEntity,
+				fmt.Sprintf("query would read more than %d rows, narrow the selector "+
+					"or time range", r.conf.CHMaxRowsToRead)}
+		}
+	}
+	return err
+}
+
+// getSettings returns the clickhouse SETTINGS clause enforcing the read
+// limits, or an empty string if none are configured
+func (r *p2cReader) getSettings() string {
+	var settings []string
+	if secs := int64(r.conf.CHMaxQueryTime.Seconds()); secs > 0 {
+		settings = append(settings, fmt.Sprintf("max_execution_time=%d", secs))
+	}
+	if r.conf.CHMaxRowsToRead > 0 {
+		settings = append(settings, fmt.Sprintf("max_rows_to_read=%d", r.conf.CHMaxRowsToRead))
+	}
+	if len(settings) < 1 {
+		return ""
+	}
+	return " SETTINGS " + strings.Join(settings, ", ")
 }
 
-// getTimePeriod return select and where SQL chunks relating to the time period -or- error
-func (r *p2cReader) getTimePeriod(query *remote.Query) (string, string, error) {
+// timeRange is a query time range in seconds with the aggregation step,
+// start and end are aligned to the step so repeated queries hit the same
+// buckets (and cache keys)
+type timeRange struct {
+	start int64
+	end   int64
+	step  int64
+}
 
-	var tselSQL = "SELECT COUNT() AS CNT, (intDiv(toUInt32(ts), %d) * %d) * 1000 as t"
-	var twhereSQL = "WHERE date >= toDate(%d) AND ts >= toDateTime(%d) AND ts <= toDateTime(%d)"
+// getTimeRange returns the aligned time range and aggregation step for query -or- error
+func (r *p2cReader) getTimeRange(query *remote.Query) (timeRange, error) {
 	var err error
 	tstart := query.StartTimestampMs / 1000
 	tend := query.EndTimestampMs / 1000
@@ -28,7 +174,7 @@ func (r *p2cReader) getTimePeriod(query *remote.Query) (string, string, error) {
 	// valid time period
 	if tend < tstart {
 		err = errors.New("Start time is after end time")
-		return "", "", err
+		return timeRange{}, err
 	}
 
 	// need time period in seconds
@@ -37,31 +183,51 @@ func (r *p2cReader) getTimePeriod(query *remote.Query) (string, string, error) {
 	// need to split time period into <nsamples> - also, don't divide by zero
 	if r.conf.CHMaxSamples < 1 {
 		err = fmt.Errorf(fmt.Sprintf("Invalid CHMaxSamples: %d", r.conf.CHMaxSamples))
-		return "", "", err
+		return timeRange{}, err
 	}
 	taggr := tperiod / int64(r.conf.CHMaxSamples)
 	if taggr < int64(r.conf.CHMinPeriod) {
 		taggr = int64(r.conf.CHMinPeriod)
 	}
+	if taggr < 1 {
+		taggr = 1
+	}
 
-	selectSQL := fmt.Sprintf(tselSQL, taggr, taggr)
-	whereSQL := fmt.Sprintf(twhereSQL, tstart, tstart, tend)
+	return timeRange{
+		start: tstart - tstart%taggr,
+		end:   tend - tend%taggr + taggr - 1,
+		step:  taggr,
+	}, nil
+}
+
+// getTimePeriod return select and where SQL chunks relating to the time period
+func (r *p2cReader) getTimePeriod(tr timeRange, src readSource) (string, string) {
+	var tselSQL = "SELECT %s AS CNT, (intDiv(toUInt32(%s), %d) * %d) * 1000 as t"
+	var twhereSQL = "WHERE date >= toDate(%d) AND %s >= toDateTime(%d) AND %s <= toDateTime(%d)"
 
-	return selectSQL, whereSQL, nil
+	selectSQL := fmt.Sprintf(tselSQL, src.cnt, src.tcol, tr.step, tr.step)
+	whereSQL := fmt.Sprintf(twhereSQL, tr.start, src.tcol, tr.start, src.tcol, tr.end)
+
+	return selectSQL, whereSQL
 }
 
-func (r *p2cReader) getSQL(query *remote.Query) (string, error) {
-	// time related select sql, where sql chunks
-	tselectSQL, twhereSQL, err := r.getTimePeriod(query)
-	if err != nil {
-		return "", err
-	}
+// sqlEscaper escapes a string for a clickhouse string literal, where
+// backslashes are escapes too
+var sqlEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
 
-	// match sql chunk
+// tagRegex returns the regex matching the name=value tags of a label regex
+// matcher, anchored as prometheus anchors regexes. A leading ^ is dropped
+// as the value doesn't start the tag.
+func tagRegex(m *remote.LabelMatcher) string {
+	return "^" + m.Name + "=(?:" + strings.TrimPrefix(m.Value, "^") + ")$"
+}
+
+// getMatchersSQL returns an sql where chunk for each label matcher
+func getMatchersSQL(matchers []*remote.LabelMatcher) []string {
 	var mwhereSQL []string
 	// build an sql statement chunk for each matcher in the query
 	// yeah, this is a bit ugly..
-	for _, m := range query.Matchers {
+	for _, m := range matchers {
 		// __name__ is handled specially - match it directly
 		// as it is stored in the name column (it's also in tags as __name__)
 		// note to self: add name to index.. otherwise this will be slow..
@@ -69,13 +235,14 @@ func (r *p2cReader) getSQL(query *remote.Query) (string, error) {
 			var whereAdd string
 			switch m.Type {
 			case remote.MatchType_EQUAL:
-				whereAdd = fmt.Sprintf(` name='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
+				whereAdd = fmt.Sprintf(` name='%s' `, sqlEscaper.Replace(m.Value))
 			case remote.MatchType_NOT_EQUAL:
-				whereAdd = fmt.Sprintf(` name!='%s' `, strings.Replace(m.Value, `'`, `\'`, -1))
+				whereAdd = fmt.Sprintf(` name!='%s' `, sqlEscaper.Replace(m.Value))
+			// prometheus regexes are fully anchored
 			case remote.MatchType_REGEX_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 1 `, strings.Replace(m.Value, `/`, `\/`, -1))
+				whereAdd = fmt.Sprintf(` match(name, '^(?:%s)$') = 1 `, sqlEscaper.Replace(m.Value))
 			case remote.MatchType_REGEX_NO_MATCH:
-				whereAdd = fmt.Sprintf(` match(name, %s) = 0 `, strings.Replace(m.Value, `/`, `\/`, -1))
+				whereAdd = fmt.Sprintf(` match(name, '^(?:%s)$') = 0 `, sqlEscaper.Replace(m.Value))
 			}
 			mwhereSQL = append(mwhereSQL, whereAdd)
 			continue
@@ -91,10 +258,10 @@ func (r *p2cReader) getSQL(query *remote.Query) (string, error) {
 					continue
 				}
 				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
+					istr := fmt.Sprintf(`'%s=%s' `, m.Name, sqlEscaper.Replace(val))
 					insql.WriteString(istr)
 				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
+					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, sqlEscaper.Replace(val))
 					insql.WriteString(istr)
 				}
 			}
@@ -110,10 +277,10 @@ func (r *p2cReader) getSQL(query *remote.Query) (string, error) {
 					continue
 				}
 				if i == 0 {
-					istr := fmt.Sprintf(`'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
+					istr := fmt.Sprintf(`'%s=%s' `, m.Name, sqlEscaper.Replace(val))
 					insql.WriteString(istr)
 				} else {
-					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, strings.Replace(val, `'`, `\'`, -1))
+					istr := fmt.Sprintf(`,'%s=%s' `, m.Name, sqlEscaper.Replace(val))
 					insql.WriteString(istr)
 				}
 			}
@@ -121,121 +288,286 @@ func (r *p2cReader) getSQL(query *remote.Query) (string, error) {
 			mwhereSQL = append(mwhereSQL, wstr)
 
 		case remote.MatchType_REGEX_MATCH:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 1`
-			// we can't have ^ in the regexp since keys are stored in arrays of key=value
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			}
+			asql := `arrayExists(x -> 1 == match(x, '%s'),tags) = 1`
+			mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, sqlEscaper.Replace(tagRegex(m))))
 
 		case remote.MatchType_REGEX_NO_MATCH:
-			asql := `arrayExists(x -> 1 == match(x, '^%s=%s'),tags) = 0`
-			if strings.HasPrefix(m.Value, "^") {
-				val := strings.Replace(m.Value, "^", "", 1)
-				val = strings.Replace(val, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			} else {
-				val := strings.Replace(m.Value, `/`, `\/`, -1)
-				mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, m.Name, val))
-			}
+			asql := `arrayExists(x -> 1 == match(x, '%s'),tags) = 0`
+			mwhereSQL = append(mwhereSQL, fmt.Sprintf(asql, sqlEscaper.Replace(tagRegex(m))))
 		}
 	}
+	return mwhereSQL
+}
 
-	// put select and where together with group by etc
-	tempSQL := "%s, name, tags, quantile(%f)(val) as value FROM %s.%s %s AND %s GROUP BY t, name, tags ORDER BY t"
-	sql := fmt.Sprintf(tempSQL, tselectSQL, r.conf.CHQuantile, r.conf.ChDB, r.conf.ChTable, twhereSQL,
-		strings.Join(mwhereSQL, " AND "))
-	return sql, nil
+// getSQL returns the select statement for query over tr with rows sorted by order
+func (r *p2cReader) getSQL(query *remote.Query, tr timeRange, order string) string {
+	// time related select sql, where sql chunks
+	src := r.source(tr)
+	tselectSQL, twhereSQL := r.getTimePeriod(tr, src)
+
+	// match sql chunk
+	mwhereSQL := getMatchersSQL(query.Matchers)
+
+	// raw samples, exactly as they were written
+	if src.raw {
+		tempSQL := "SELECT 1 AS CNT, toUInt32(ts) * 1000 AS t, name, tags, val as value FROM %s.%s %s AND %s ORDER BY %s"
+		sql := fmt.Sprintf(tempSQL, r.conf.ChDB, src.table, twhereSQL,
+			strings.Join(mwhereSQL, " AND "), order)
+		return sql + r.getSettings()
+	}
+
+	// put select and where together with group by etc, buckets with no
+	// finite values (eg. only staleness markers) are dropped
+	tempSQL := "%s, name, tags, %s as value FROM %s.%s %s AND %s GROUP BY t, name, tags HAVING CNT > 0 ORDER BY %s"
+	sql := fmt.Sprintf(tempSQL, tselectSQL, src.value, r.conf.ChDB, src.table, twhereSQL,
+		strings.Join(mwhereSQL, " AND "), order)
+	return sql + r.getSettings()
 }
 
-func NewP2CReader(conf *config) (*p2cReader, error) {
+// NewP2CReader connects a reader to clickhouse, logging to log
+func NewP2CReader(conf *config, log io.Writer) (*p2cReader, error) {
 	var err error
 	r := new(p2cReader)
 	r.conf = conf
+	r.log = log
+	r.native = newNativeProbes()
 	r.db, err = sql.Open("clickhouse", r.conf.ChDSN)
 	if err != nil {
-		fmt.Printf("Error connecting to clickhouse: %s\n", err.Error())
+		fmt.Fprintf(r.log, "Error connecting to clickhouse: %s\n", err.Error())
 		return r, err
 	}
 
+	// rollup schedule from the clickhouse config or ch.rollup
+	if r.conf.CHRollupConfig != "" {
+		r.rollup, err = loadRollupConfig(r.conf.CHRollupConfig)
+	} else if r.conf.CHRollup != "" {
+		r.rollup, err = parseRollup(r.conf.CHRollup)
+	}
+	if err != nil {
+		fmt.Fprintf(r.log, "Error loading rollup schedule: %s\n", err.Error())
+		return r, err
+	}
+
+	// downsampled tables to read coarse steps from
+	if r.conf.CHDownsample != "" {
+		// views on ch.table only see inserts on this server, sharded writes
+		// go to ch.shardtable on each shard
+		if r.conf.ChShards != "" {
+			err = errors.New("ch.downsample can't be used with ch.shards")
+			fmt.Fprintf(r.log, "Error: %s\n", err.Error())
+			return r, err
+		}
+		r.downsample, err = parseDownsample(r.conf.CHDownsample, r.conf.ChTable)
+		if err != nil {
+			fmt.Fprintf(r.log, "Error parsing downsampled tables: %s\n", err.Error())
+			return r, err
+		}
+		if r.conf.CHDownsampleCreate {
+			if err = r.createDownsampleTables(); err != nil {
+				fmt.Fprintf(r.log, "Error creating downsampled tables: %s\n", err.Error())
+				return r, err
+			}
+		}
+		if err = r.loadDownsampleViews(); err != nil {
+			fmt.Fprintf(r.log, "Error loading downsampled tables: %s\n", err.Error())
+			return r, err
+		}
+	}
+
+	r.limits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "read_limit_exceeded_total",
+			Help: "Total number of remote read requests aborted for exceeding a series or samples limit.",
+		},
+		[]string{"limit"},
+	)
+	prometheus.MustRegister(r.limits)
+
+	if r.conf.ReadCacheSize > 0 {
+		r.cache = NewP2CCache(r.conf.ReadCacheSize, r.conf.ReadCacheTTL)
+	}
+
 	return r, nil
 }
 
-func (r *p2cReader) Read(req *remote.ReadRequest) (*remote.ReadResponse, error) {
-	var err error
-	var sqlStr string
-	var rows *sql.Rows
+// scan runs sqlStr and calls fn for each row of the result, returning the
+// number of rows read
+func (r *p2cReader) scan(ctx context.Context, sqlStr string,
+	fn func(t int64, tags []string, value float64) error) (int, error) {
 
-	resp := remote.ReadResponse{
-		Results: []*remote.QueryResult{
-			{Timeseries: make([]*remote.TimeSeries, 0, 0)},
-		},
+	// todo: metrics on number of errors, rows, selects, timings, etc
+	rows, err := r.db.QueryContext(ctx, sqlStr)
+	if err != nil {
+		fmt.Fprintf(r.log, "Error: query failed: %s", sqlStr)
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return 0, r.queryError(ctx, err)
+	}
+	defer rows.Close()
+
+	rcount := 0
+	for rows.Next() {
+		rcount++
+		var (
+			cnt   int
+			t     int64
+			name  string
+			tags  []string
+			value float64
+		)
+		if err = rows.Scan(&cnt, &t, &name, &tags, &value); err != nil {
+			fmt.Fprintf(r.log, "Error: scan: %s\n", err.Error())
+		}
+		// remove this..
+		//fmt.Fprintf(r.log, fmt.Sprintf("%d,%d,%s,%s,%f\n", cnt, t, name, strings.Join(tags, ":"), value))
+
+		if err = fn(t, tags, value); err != nil {
+			return rcount, err
+		}
 	}
-	// need to map tags to timeseries to record samples
+	if err = rows.Err(); err != nil {
+		fmt.Fprintf(r.log, "Error: query error: %s\n", err)
+		return rcount, r.queryError(ctx, err)
+	}
+	return rcount, nil
+}
+
+// query returns the series matching q over tr, from the cache if possible
+func (r *p2cReader) query(ctx context.Context, q *remote.Query, tr timeRange,
+	limits *readLimits) ([]*remote.TimeSeries, int, error) {
+
+	var key string
+	cacheable := r.cacheable(tr)
+	if cacheable {
+		key = r.cacheKey(q, tr)
+		if series, ok := r.cache.get(key); ok {
+			for _, ts := range series {
+				if err := r.addSeriesKey(limits, labelsKey(ts.Labels)); err != nil {
+					return nil, 0, err
+				}
+				if err := r.addSamples(limits, len(ts.Samples)); err != nil {
+					return nil, 0, err
+				}
+			}
+			return series, 0, nil
+		}
+	}
+
+	// get the select sql
+	sqlStr := r.getSQL(q, tr, "t")
+	fmt.Fprintf(r.log, "query: running sql: %s\n\n", sqlStr)
+
+	// build map of timeseries from sql result
 	var tsres = make(map[string]*remote.TimeSeries)
+	add := func(t int64, tags []string, value float64) error {
+		// borrowed from influx remote storage adapter - array sep
+		key := strings.Join(tags, "\xff")
+		ts, ok := tsres[key]
+		if !ok {
+			ts = &remote.TimeSeries{
+				Labels: r.makeLabels(tags),
+			}
+			if err := r.addSeriesKey(limits, labelsKey(ts.Labels)); err != nil {
+				return err
+			}
+			tsres[key] = ts
+		}
+		if err := r.addSamples(limits, 1); err != nil {
+			return err
+		}
+		ts.Samples = append(ts.Samples, &remote.Sample{
+			Value:       float64(value),
+			TimestampMs: t,
+		})
+		return nil
+	}
+
+	n, err := r.scan(ctx, sqlStr, add)
+	if err != nil {
+		return nil, n, err
+	}
+
+	// the parts of a histogram may be in either table
+	if r.conf.ChHistograms {
+		hn, err := r.scanHistograms(ctx, q, tr, r.conf.ReadRaw, add)
+		n += hn
+		if err != nil {
+			return nil, n, err
+		}
+	}
+
+	series := make([]*remote.TimeSeries, 0, len(tsres))
+	for _, ts := range tsres {
+		if r.conf.ChHistograms {
+			sort.SliceStable(ts.Samples, func(i, j int) bool {
+				return ts.Samples[i].TimestampMs < ts.Samples[j].TimestampMs
+			})
+		}
+		series = append(series, ts)
+	}
+	if cacheable {
+		r.cache.set(key, series)
+	}
+	return series, n, nil
+}
+
+// Read runs the queries in req against clickhouse, ctx bounds how long
+// they may run for
+func (r *p2cReader) Read(ctx context.Context, req *remote.ReadRequest) (*p2cReadResponse, error) {
+	resp := p2cReadResponse{
+		Results: []*p2cQueryResult{
+			{Timeseries: make([]*p2cTimeSeries, 0, 0)},
+		},
+	}
+	// need to map labels to timeseries to merge results
+	var tsres = make(map[string]*p2cTimeSeries)
+	limits := r.newReadLimits()
 
 	// for debugging/figuring out query format/etc
 	rcount := 0
 	for _, q := range req.Queries {
 		// remove me..
-		fmt.Printf("\nquery: start: %d, end: %d\n\n", q.StartTimestampMs, q.EndTimestampMs)
+		fmt.Fprintf(r.log, "\nquery: start: %d, end: %d\n\n", q.StartTimestampMs, q.EndTimestampMs)
 
-		// get the select sql
-		sqlStr, err = r.getSQL(q)
-		fmt.Printf("query: running sql: %s\n\n", sqlStr)
+		tr, err := r.getTimeRange(q)
 		if err != nil {
-			fmt.Printf("Error: reader: getSQL: %s\n", err.Error())
+			fmt.Fprintf(r.log, "Error: reader: getTimeRange: %s\n", err.Error())
 			return &resp, err
 		}
 
-		// get the select sql
+		series, n, err := r.queryRange(ctx, q, tr, limits)
+		rcount += n
 		if err != nil {
-			fmt.Printf("Error: reader: getSQL: %s\n", err.Error())
 			return &resp, err
 		}
 
-		// todo: metrics on number of errors, rows, selects, timings, etc
-		rows, err = r.db.Query(sqlStr)
+		for _, ts := range series {
+			key := labelsKey(ts.Labels)
+			if mts, ok := tsres[key]; ok {
+				mts.Samples = append(mts.Samples, ts.Samples...)
+				continue
+			}
+			// results may be cached, copy so appends don't modify them
+			tsres[key] = &p2cTimeSeries{
+				Labels:  ts.Labels,
+				Samples: ts.Samples[:len(ts.Samples):len(ts.Samples)],
+			}
+		}
+
+		if !r.conf.ChNativeHistograms {
+			continue
+		}
+		natives, n, err := r.queryNative(ctx, q, tr, limits)
+		rcount += n
 		if err != nil {
-			fmt.Printf("Error: query failed: %s", sqlStr)
-			fmt.Printf("Error: query error: %s\n", err)
 			return &resp, err
 		}
-
-		// build map of timeseries from sql result
-
-		for rows.Next() {
-			rcount++
-			var (
-				cnt   int
-				t     int64
-				name  string
-				tags  []string
-				value float64
-			)
-			if err = rows.Scan(&cnt, &t, &name, &tags, &value); err != nil {
-				fmt.Printf("Error: scan: %s\n", err.Error())
-			}
-			// remove this..
-			//fmt.Printf(fmt.Sprintf("%d,%d,%s,%s,%f\n", cnt, t, name, strings.Join(tags, ":"), value))
-
-			// borrowed from influx remote storage adapter - array sep
-			key := strings.Join(tags, "\xff")
-			ts, ok := tsres[key]
-			if !ok {
-				ts = &remote.TimeSeries{
-					Labels: makeLabels(tags),
-				}
-				tsres[key] = ts
+		for _, ts := range natives {
+			key := labelsKey(ts.Labels)
+			if mts, ok := tsres[key]; ok {
+				mts.Histograms = append(mts.Histograms, ts.Histograms...)
+				continue
 			}
-			ts.Samples = append(ts.Samples, &remote.Sample{
-				Value:       float64(value),
-				TimestampMs: t,
-			})
+			tsres[key] = ts
 		}
 	}
 
@@ -244,20 +576,34 @@ func (r *p2cReader) Read(req *remote.ReadRequest) (*remote.ReadResponse, error)
 		resp.Results[0].Timeseries = append(resp.Results[0].Timeseries, ts)
 	}
 
-	fmt.Printf("query: returning %d rows for %d queries\n", rcount, len(req.Queries))
+	fmt.Fprintf(r.log, "query: returning %d rows for %d queries\n", rcount, len(req.Queries))
 
 	return &resp, nil
 
 }
 
-func makeLabels(tags []string) []*remote.LabelPair {
+// labelsKey returns a unique key for a set of sorted labels
+func labelsKey(labels []*remote.LabelPair) string {
+	var b bytes.Buffer
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(l.Value)
+		b.WriteByte('\xff')
+	}
+	return b.String()
+}
+
+// makeLabels returns the label pairs of tags sorted by name, logging
+// malformed tags to r.log
+func (r *p2cReader) makeLabels(tags []string) []*remote.LabelPair {
 	lpairs := make([]*remote.LabelPair, 0, len(tags))
 	// (currently) writer includes __name__ in tags so no need to add it here
 	// may change this to save space later..
 	for _, tag := range tags {
 		vals := strings.SplitN(tag, "=", 2)
 		if len(vals) != 2 {
-			fmt.Printf("Error unpacking tag key/val: %s\n", tag)
+			fmt.Fprintf(r.log, "Error unpacking tag key/val: %s\n", tag)
 			continue
 		}
 		if vals[1] == "" {
@@ -268,5 +614,10 @@ func makeLabels(tags []string) []*remote.LabelPair {
 			Value: vals[1],
 		})
 	}
+	// prometheus expects labels sorted by name, which tag order (key=value)
+	// doesn't quite guarantee
+	sort.Slice(lpairs, func(i, j int) bool {
+		return lpairs[i].Name < lpairs[j].Name
+	})
 	return lpairs
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// retentionRule keeps series matching a selector for a given duration.
+// Rules are applied in order, a series is governed by the first rule it
+// matches.
+type retentionRule struct {
+	selector  string
+	matchers  []*remote.LabelMatcher
+	retention time.Duration
+}
+
+// retentionTarget is a table rows are deleted from
+type retentionTarget struct {
+	db    *sql.DB
+	table string
+	desc  string
+	// the local table deletes run against on each server of cluster when
+	// table is Distributed, mutations aren't supported there
+	local   string
+	cluster string
+	// time column rows expire by
+	tcol string
+	// whether the table has tags, rules matching other labels than the
+	// name don't apply to those without
+	tags bool
+}
+
+type p2cRetention struct {
+	conf    *config
+	rules   []retentionRule
+	targets []retentionTarget
+	expired *prometheus.CounterVec
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// parseRetentionRules reads rules from a file with one rule per line:
+//
+//	<selector> <retention>
+//
+// eg.
+//
+//	{__name__=~"node_.*"} 90d
+//	{env="dev"} 7d
+//	{} 365d
+//
+// where {} matches every series. Blank lines and # comments are ignored.
+func parseRetentionRules(path string) ([]retentionRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []retentionRule
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected <selector> <retention>", path, lineno)
+		}
+		sel := strings.TrimSpace(line[:i])
+		d, err := model.ParseDuration(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid retention: %s", path, lineno, err.Error())
+		}
+
+		rule := retentionRule{selector: sel, retention: time.Duration(d)}
+		if sel != "{}" {
+			rule.matchers, err = parseSelector(sel)
+			if err == nil {
+				err = checkRetentionMatchers(rule.matchers)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, lineno, err.Error())
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) < 1 {
+		return nil, fmt.Errorf("%s: no retention rules found", path)
+	}
+	return rules, nil
+}
+
+// checkRetentionMatchers returns an error for matchers getMatchersSQL
+// can't render exactly, as a rule deleting series it doesn't select loses
+// data. Equality values are split on | and empty ones dropped, a ^ inside
+// a label regex can't match as the tag starts with the name, and a series
+// without a label only matches the regexes matching "" in prometheus.
+func checkRetentionMatchers(matchers []*remote.LabelMatcher) error {
+	for _, m := range matchers {
+		switch m.Type {
+		case remote.MatchType_EQUAL, remote.MatchType_NOT_EQUAL:
+			if m.Name != model.MetricNameLabel && (m.Value == "" || strings.Contains(m.Value, "|")) {
+				return fmt.Errorf("%s: empty values and values containing | aren't supported", m.Name)
+			}
+		case remote.MatchType_REGEX_MATCH, remote.MatchType_REGEX_NO_MATCH:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return fmt.Errorf("%s: %s", m.Name, err.Error())
+			}
+			if m.Name == model.MetricNameLabel {
+				continue
+			}
+			if strings.Contains(strings.TrimPrefix(m.Value, "^"), "^") {
+				return fmt.Errorf("%s: ^ is only supported at the start of a regex", m.Name)
+			}
+			if re.MatchString("") {
+				return fmt.Errorf("%s: regexes matching the empty string aren't supported", m.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func NewP2CRetention(conf *config) (*p2cRetention, error) {
+	var err error
+	r := new(p2cRetention)
+	r.conf = conf
+	r.quit = make(chan struct{})
+
+	r.rules, err = parseRetentionRules(conf.RetentionRules)
+	if err != nil {
+		fmt.Printf("Error loading retention rules: %s\n", err.Error())
+		return r, err
+	}
+
+	// mutations aren't supported on distributed tables so with client side
+	// sharding delete from each shards local table
+	if conf.ChShards != "" {
+		shards, err := parseShards(conf.ChShards, conf.ChShardWeights)
+		if err != nil {
+			return r, err
+		}
+		for _, s := range shards {
+			db, err := sql.Open("clickhouse", s.dsn)
+			if err != nil {
+				fmt.Printf("Error connecting to clickhouse shard %d: %s\n", s.id, err.Error())
+				return r, err
+			}
+			r.targets = append(r.targets, retentionTarget{db: db, table: conf.ChShardTable,
+				desc: fmt.Sprintf("shard %d", s.id), tcol: "ts", tags: true})
+		}
+	}
+	db, err := sql.Open("clickhouse", conf.ChDSN)
+	if err != nil {
+		fmt.Printf("Error connecting to clickhouse: %s\n", err.Error())
+		return r, err
+	}
+	if conf.ChShards == "" {
+		// otherwise delete from ch.shardtable on every server of the
+		// cluster behind a Distributed ch.table
+		t := retentionTarget{db: db, table: conf.ChTable, desc: conf.ChTable, tcol: "ts", tags: true}
+		if conf.RetentionCluster != "" {
+			t.local, t.cluster = conf.ChShardTable, conf.RetentionCluster
+		} else if err = r.checkLocal(db, conf.ChTable); err != nil {
+			fmt.Printf("Error: retention: %s\n", err.Error())
+			return r, err
+		}
+		r.targets = append(r.targets, t)
+	}
+
+	// the downsampled, histogram, exemplar and metadata tables are written
+	// through ch.dsn. Metadata is rewritten while a metric is active, so
+	// it expires once it wasn't for the retention.
+	if conf.CHDownsample != "" {
+		dts, err := parseDownsample(conf.CHDownsample, conf.ChTable)
+		if err != nil {
+			return r, err
+		}
+		for _, dt := range dts {
+			r.targets = append(r.targets, retentionTarget{db: db, table: dt.table, desc: dt.table,
+				tcol: "bucket", tags: true})
+		}
+	}
+	for _, t := range []struct {
+		enabled bool
+		table   string
+	}{
+		{conf.ChHistograms, conf.ChHistTable},
+		{conf.ChNativeHistograms, conf.ChNativeTable},
+		{conf.ChExemplars, conf.ChExemplarTable},
+	} {
+		if t.enabled {
+			r.targets = append(r.targets, retentionTarget{db: db, table: t.table, desc: t.table,
+				tcol: "ts", tags: true})
+		}
+	}
+	if conf.ChMetadata {
+		r.targets = append(r.targets, retentionTarget{db: db, table: conf.ChMetaTable, desc: conf.ChMetaTable,
+			tcol: "updated"})
+	}
+
+	r.expired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retention_expired_rows_total",
+			Help: "Total number of rows deleted (or that would be in dry run mode) by each retention rule.",
+		},
+		[]string{"rule"},
+	)
+	prometheus.MustRegister(r.expired)
+
+	return r, nil
+}
+
+// checkLocal returns an error if table is Distributed, deleting from it
+// needs retention.cluster. If clickhouse can't be reached yet the deletes
+// report it.
+func (r *p2cRetention) checkLocal(db *sql.DB, table string) error {
+	var engine string
+	err := db.QueryRow(fmt.Sprintf("SELECT engine FROM system.tables WHERE database = '%s' AND name = '%s'",
+		sqlEscaper.Replace(r.conf.ChDB), sqlEscaper.Replace(table))).Scan(&engine)
+	if err != nil {
+		fmt.Printf("Warning: retention: checking the engine of %s: %s\n", table, err.Error())
+		return nil
+	}
+	if engine == "Distributed" {
+		return fmt.Errorf("%s.%s is Distributed, set retention.cluster to delete from ch.shardtable on each server",
+			r.conf.ChDB, table)
+	}
+	return nil
+}
+
+// ruleSQL returns the where clause selecting the rows of t expired under
+// rule i: older than its retention, matching it and not matching an
+// earlier rule. It returns false if the rule, or an earlier one, doesn't
+// apply to t.
+func (r *p2cRetention) ruleSQL(i int, t retentionTarget, now time.Time) (string, bool) {
+	matchSQL := func(rule retentionRule) (string, bool) {
+		if len(rule.matchers) == 0 {
+			return "1", true
+		}
+		if !t.tags {
+			for _, m := range rule.matchers {
+				if m.Name != model.MetricNameLabel {
+					return "", false
+				}
+			}
+		}
+		return "(" + strings.Join(getMatchersSQL(rule.matchers), " AND ") + ")", true
+	}
+
+	rule := r.rules[i]
+	match, ok := matchSQL(rule)
+	if !ok {
+		return "", false
+	}
+	where := []string{
+		fmt.Sprintf("%s < toDateTime(%d)", t.tcol, now.Add(-rule.retention).Unix()),
+		match,
+	}
+	for _, prev := range r.rules[:i] {
+		match, ok := matchSQL(prev)
+		if !ok {
+			// rows the earlier rule governs can't be told apart in t, so
+			// leave them all to it rather than expire them early
+			return "", false
+		}
+		where = append(where, "NOT "+match)
+	}
+	return strings.Join(where, " AND "), true
+}
+
+// apply runs each rule against each target, counting the expired rows and
+// deleting them unless in dry run mode
+func (r *p2cRetention) apply() {
+	now := time.Now()
+	for i, rule := range r.rules {
+		for _, t := range r.targets {
+			where, ok := r.ruleSQL(i, t, now)
+			if !ok {
+				continue
+			}
+			table := fmt.Sprintf("%s.%s", r.conf.ChDB, t.table)
+
+			var n uint64
+			err := t.db.QueryRow(fmt.Sprintf("SELECT count() FROM %s WHERE %s", table, where)).Scan(&n)
+			if err != nil {
+				fmt.Printf("Error: retention: rule %d: %s: %s\n", i, t.desc, err.Error())
+				continue
+			}
+			r.expired.WithLabelValues(strconv.Itoa(i)).Add(float64(n))
+
+			if r.conf.RetentionDryRun {
+				fmt.Printf("Retention (dry run): rule %d (%s %s): %s: %d rows would be deleted\n",
+					i, rule.selector, model.Duration(rule.retention), t.desc, n)
+				r.report(t, table, where)
+				continue
+			}
+			if n == 0 {
+				continue
+			}
+
+			// deletes are asynchronous mutations in clickhouse
+			alter := table
+			if t.cluster != "" {
+				alter = fmt.Sprintf("%s.%s ON CLUSTER %s", r.conf.ChDB, t.local, t.cluster)
+			}
+			_, err = t.db.Exec(fmt.Sprintf("ALTER TABLE %s DELETE WHERE %s", alter, where))
+			if err != nil {
+				fmt.Printf("Error: retention: rule %d: %s: delete: %s\n", i, t.desc, err.Error())
+				continue
+			}
+			fmt.Printf("Retention: rule %d (%s %s): %s: deleting %d rows\n",
+				i, rule.selector, model.Duration(rule.retention), t.desc, n)
+		}
+	}
+}
+
+// report prints the metrics with the most rows that would be deleted
+func (r *p2cRetention) report(t retentionTarget, table, where string) {
+	rows, err := t.db.Query(fmt.Sprintf("SELECT name, count() AS c FROM %s WHERE %s "+
+		"GROUP BY name ORDER BY c DESC LIMIT 10", table, where))
+	if err != nil {
+		fmt.Printf("Error: retention: report: %s\n", err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			n    uint64
+		)
+		if err = rows.Scan(&name, &n); err != nil {
+			fmt.Printf("Error: retention: report: %s\n", err.Error())
+			return
+		}
+		fmt.Printf("\t%s: %d rows\n", name, n)
+	}
+}
+
+// Start applies the rules now and then every retention.interval
+func (r *p2cRetention) Start() {
+	fmt.Println("Retention starting..")
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.conf.RetentionInterval)
+		defer ticker.Stop()
+		for {
+			r.apply()
+			select {
+			case <-ticker.C:
+			case <-r.quit:
+				fmt.Println("Retention stopped..")
+				return
+			}
+		}
+	}()
+}
+
+func (r *p2cRetention) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
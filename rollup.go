@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rollupTier is a graphite_rollup retention: data older than age seconds
+// is stored with precision seconds resolution
+type rollupTier struct {
+	age       int64
+	precision int64
+}
+
+// rollupSchedule is a set of retentions sorted by age
+type rollupSchedule []rollupTier
+
+// parseRollup parses a comma separated list of age:precision pairs in
+// seconds, eg. 0:10,86400:30,172800:300
+func parseRollup(s string) (rollupSchedule, error) {
+	var rs rollupSchedule
+	for _, tier := range strings.Split(s, ",") {
+		tier = strings.TrimSpace(tier)
+		if tier == "" {
+			continue
+		}
+		vals := strings.SplitN(tier, ":", 2)
+		if len(vals) != 2 {
+			return nil, fmt.Errorf("invalid rollup retention %q, expected age:precision", tier)
+		}
+		age, err := strconv.ParseInt(vals[0], 10, 64)
+		if err != nil || age < 0 {
+			return nil, fmt.Errorf("invalid rollup age %q", vals[0])
+		}
+		precision, err := strconv.ParseInt(vals[1], 10, 64)
+		if err != nil || precision < 1 {
+			return nil, fmt.Errorf("invalid rollup precision %q", vals[1])
+		}
+		rs = append(rs, rollupTier{age: age, precision: precision})
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].age < rs[j].age })
+	return rs, nil
+}
+
+// loadRollupConfig reads the default graphite_rollup retentions from a
+// clickhouse server config file, see config.xml
+func loadRollupConfig(path string) (rollupSchedule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chconf struct {
+		Retentions []struct {
+			Age       int64 `xml:"age"`
+			Precision int64 `xml:"precision"`
+		} `xml:"graphite_rollup>default>retention"`
+	}
+	if err = xml.Unmarshal(data, &chconf); err != nil {
+		return nil, err
+	}
+
+	var rs rollupSchedule
+	for _, ret := range chconf.Retentions {
+		if ret.Precision < 1 {
+			return nil, fmt.Errorf("invalid rollup precision %d in %s", ret.Precision, path)
+		}
+		rs = append(rs, rollupTier{age: ret.Age, precision: ret.Precision})
+	}
+	if len(rs) < 1 {
+		return nil, fmt.Errorf("no graphite_rollup default retentions found in %s", path)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].age < rs[j].age })
+	return rs, nil
+}
+
+// tier returns the index of the tier data age seconds old is stored in,
+// or -1 if it's younger than every tier
+func (rs rollupSchedule) tier(age int64) int {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].age > age })
+	return i - 1
+}
+
+// rollupStep returns a step no finer than precision: precision itself or
+// step rounded up to a multiple of it
+func rollupStep(step, precision int64) int64 {
+	if step <= precision {
+		return precision
+	}
+	if rem := step % precision; rem != 0 {
+		step += precision - rem
+	}
+	return step
+}
+
+// planRollup splits tr at the rollup tier boundaries (relative to now) and
+// coarsens the step of each part to at least the resolution its data is
+// stored at, so old ranges don't produce gaps or quantiles of one point.
+func (r *p2cReader) planRollup(tr timeRange) []timeRange {
+	if len(r.rollup) < 1 {
+		return []timeRange{tr}
+	}
+	now := time.Now().Unix()
+
+	var trs []timeRange
+	for start := tr.start; start <= tr.end; {
+		part := timeRange{start: start, end: tr.end, step: tr.step}
+
+		i := r.rollup.tier(now - start)
+		if i >= 0 {
+			part.step = rollupStep(tr.step, r.rollup[i].precision)
+			if len(trs) == 0 {
+				part.start -= part.start % part.step
+			}
+			// the part ends where data gets young enough to leave this
+			// tier, extended to the end of the bucket that falls in
+			boundary := now - r.rollup[i].age
+			end := boundary - boundary%part.step + part.step - 1
+			if end < part.end {
+				part.end = end
+			}
+		} else if len(trs) == 0 {
+			// younger than every tier, nothing to do
+			return []timeRange{tr}
+		}
+
+		trs = append(trs, part)
+		start = part.end + 1
+	}
+	return trs
+}
+
+// coarsenRollup returns tr with a single step that satisfies the oldest
+// data in the range
+func (r *p2cReader) coarsenRollup(tr timeRange) timeRange {
+	if len(r.rollup) < 1 {
+		return tr
+	}
+	i := r.rollup.tier(time.Now().Unix() - tr.start)
+	if i < 0 {
+		return tr
+	}
+	tr.step = rollupStep(tr.step, r.rollup[i].precision)
+	tr.start -= tr.start % tr.step
+	tr.end = tr.end - tr.end%tr.step + tr.step - 1
+	return tr
+}
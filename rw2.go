@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// remote write 2.0, see:
+// 	https://prometheus.io/docs/specs/remote_write_spec_2_0/
+// 	https://github.com/prometheus/prometheus/blob/main/prompb/io/prometheus/write/v2/types.proto
+// labels, help and unit strings are references into the requests symbol
+// table. v2 requests are decoded into a p2cWriteRequest so they take the
+// same path as v1 ones.
+
+const (
+	writeProtoV1 = "prometheus.WriteRequest"
+	writeProtoV2 = "io.prometheus.write.v2.Request"
+)
+
+// response headers reporting what a v2 request wrote
+const (
+	writtenSamplesHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	writtenHistogramsHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	writtenExemplarsHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// metric types of v2 metadata
+const (
+	metricTypeUnknown = iota
+	metricTypeCounter
+	metricTypeGauge
+	metricTypeHistogram
+	metricTypeGaugeHistogram
+	metricTypeSummary
+	metricTypeInfo
+	metricTypeStateset
+)
+
+type writeRequestV2 struct {
+	Symbols    []string        `protobuf:"bytes,4,rep,name=symbols" json:"symbols,omitempty"`
+	Timeseries []*timeSeriesV2 `protobuf:"bytes,5,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *writeRequestV2) Reset()         { *m = writeRequestV2{} }
+func (m *writeRequestV2) String() string { return proto.CompactTextString(m) }
+func (*writeRequestV2) ProtoMessage()    {}
+
+type timeSeriesV2 struct {
+	LabelsRefs       []uint32         `protobuf:"varint,1,rep,packed,name=labels_refs,json=labelsRefs" json:"labels_refs,omitempty"`
+	Samples          []*remote.Sample `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+	Histograms       []*histogram     `protobuf:"bytes,3,rep,name=histograms" json:"histograms,omitempty"`
+	Exemplars        []*exemplarV2    `protobuf:"bytes,4,rep,name=exemplars" json:"exemplars,omitempty"`
+	Metadata         *metadataV2      `protobuf:"bytes,5,opt,name=metadata" json:"metadata,omitempty"`
+	CreatedTimestamp int64            `protobuf:"varint,6,opt,name=created_timestamp,json=createdTimestamp,proto3" json:"created_timestamp,omitempty"`
+}
+
+func (m *timeSeriesV2) Reset()         { *m = timeSeriesV2{} }
+func (m *timeSeriesV2) String() string { return proto.CompactTextString(m) }
+func (*timeSeriesV2) ProtoMessage()    {}
+
+type exemplarV2 struct {
+	LabelsRefs  []uint32 `protobuf:"varint,1,rep,packed,name=labels_refs,json=labelsRefs" json:"labels_refs,omitempty"`
+	Value       float64  `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	TimestampMs int64    `protobuf:"varint,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *exemplarV2) Reset()         { *m = exemplarV2{} }
+func (m *exemplarV2) String() string { return proto.CompactTextString(m) }
+func (*exemplarV2) ProtoMessage()    {}
+
+type metadataV2 struct {
+	Type    int32  `protobuf:"varint,1,opt,name=type,proto3" json:"type,omitempty"`
+	HelpRef uint32 `protobuf:"varint,3,opt,name=help_ref,json=helpRef,proto3" json:"help_ref,omitempty"`
+	UnitRef uint32 `protobuf:"varint,4,opt,name=unit_ref,json=unitRef,proto3" json:"unit_ref,omitempty"`
+}
+
+func (m *metadataV2) Reset()         { *m = metadataV2{} }
+func (m *metadataV2) String() string { return proto.CompactTextString(m) }
+func (*metadataV2) ProtoMessage()    {}
+
+// writeStats counts what a write request queued for writing
+type writeStats struct {
+	samples    int
+	histograms int
+	exemplars  int
+}
+
+// setHeaders sets the v2 written response headers
+func (s writeStats) setHeaders(w http.ResponseWriter) {
+	w.Header().Set(writtenSamplesHeader, strconv.Itoa(s.samples))
+	w.Header().Set(writtenHistogramsHeader, strconv.Itoa(s.histograms))
+	w.Header().Set(writtenExemplarsHeader, strconv.Itoa(s.exemplars))
+}
+
+// writeProto returns the remote write protobuf message a request carries
+// from its Content-Type, v1 if unset. The error is reported with 415.
+func writeProto(r *http.Request) (string, error) {
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "snappy" {
+		return "", fmt.Errorf("unsupported content encoding %q", enc)
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return writeProtoV1, nil
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type %q: %s", ct, err.Error())
+	}
+	if mt != "application/x-protobuf" {
+		return "", fmt.Errorf("unsupported content type %q", ct)
+	}
+	switch params["proto"] {
+	case "", writeProtoV1:
+		return writeProtoV1, nil
+	case writeProtoV2:
+		return writeProtoV2, nil
+	}
+	return "", fmt.Errorf("unsupported remote write protobuf message %q", params["proto"])
+}
+
+// symbol returns the symbol table entry ref
+func (m *writeRequestV2) symbol(ref uint32) (string, error) {
+	if int(ref) >= len(m.Symbols) {
+		return "", fmt.Errorf("symbol reference %d out of range, %d symbols", ref, len(m.Symbols))
+	}
+	return m.Symbols[ref], nil
+}
+
+// labels resolves name/value symbol reference pairs
+func (m *writeRequestV2) labels(refs []uint32) ([]*remote.LabelPair, error) {
+	if len(refs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of label references %d", len(refs))
+	}
+	labels := make([]*remote.LabelPair, 0, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		name, err := m.symbol(refs[i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := m.symbol(refs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, &remote.LabelPair{Name: name, Value: value})
+	}
+	return labels, nil
+}
+
+// v1 converts the request into a v1 write request. With createdZero a
+// zero sample is added at the created timestamp of cumulative series if
+// it's before their first sample, as Prometheus does with
+// created-timestamp-zero-ingestion.
+func (m *writeRequestV2) v1(createdZero bool) (*p2cWriteRequest, error) {
+	req := &p2cWriteRequest{Timeseries: make([]*p2cTimeSeries, 0, len(m.Timeseries))}
+	for i, ts := range m.Timeseries {
+		labels, err := m.labels(ts.LabelsRefs)
+		if err != nil {
+			return nil, fmt.Errorf("timeseries %d: %s", i, err.Error())
+		}
+		if ts.Metadata != nil {
+			help, err := m.symbol(ts.Metadata.HelpRef)
+			if err != nil {
+				return nil, fmt.Errorf("timeseries %d: metadata help: %s", i, err.Error())
+			}
+			unit, err := m.symbol(ts.Metadata.UnitRef)
+			if err != nil {
+				return nil, fmt.Errorf("timeseries %d: metadata unit: %s", i, err.Error())
+			}
+			name := seriesName(&remote.TimeSeries{Labels: labels})
+			if name != "" && (ts.Metadata.Type != metricTypeUnknown || help != "" || unit != "") {
+				req.Metadata = append(req.Metadata, &metricMetadata{
+					Type:             ts.Metadata.Type,
+					MetricFamilyName: name,
+					Help:             help,
+					Unit:             unit,
+				})
+			}
+		}
+
+		series := &p2cTimeSeries{
+			Labels:     labels,
+			Samples:    ts.Samples,
+			Histograms: ts.Histograms,
+		}
+		for j, e := range ts.Exemplars {
+			elabels, err := m.labels(e.LabelsRefs)
+			if err != nil {
+				return nil, fmt.Errorf("timeseries %d: exemplar %d: %s", i, j, err.Error())
+			}
+			series.Exemplars = append(series.Exemplars, &exemplar{
+				Labels:      elabels,
+				Value:       e.Value,
+				TimestampMs: e.TimestampMs,
+			})
+		}
+		if createdZero && ts.CreatedTimestamp != 0 && ts.cumulative() {
+			series.Samples, series.Histograms = ts.createdZero()
+		}
+		req.Timeseries = append(req.Timeseries, series)
+	}
+	return req, nil
+}
+
+// cumulative returns true if the series is a counter, histogram or summary
+func (m *timeSeriesV2) cumulative() bool {
+	if m.Metadata == nil {
+		return false
+	}
+	switch m.Metadata.Type {
+	case metricTypeCounter, metricTypeHistogram, metricTypeSummary:
+		return true
+	}
+	return false
+}
+
+// createdZero returns the series samples and histograms with a zero value
+// at the created timestamp prepended, if it's in an earlier second than
+// the first one (timestamps are stored with second precision)
+func (m *timeSeriesV2) createdZero() ([]*remote.Sample, []*histogram) {
+	ct := m.CreatedTimestamp
+	before := func(t int64) bool { return ct/1000 < t/1000 }
+
+	samples, hists := m.Samples, m.Histograms
+	if len(samples) > 0 && before(samples[0].TimestampMs) {
+		samples = append([]*remote.Sample{{Value: 0, TimestampMs: ct}}, samples...)
+	}
+	if len(hists) > 0 && before(hists[0].TimestampMs) {
+		zero := &histogram{
+			Schema:        hists[0].Schema,
+			ZeroThreshold: hists[0].ZeroThreshold,
+			TimestampMs:   ct,
+		}
+		hists = append([]*histogram{zero}, hists...)
+	}
+	return samples, hists
+}
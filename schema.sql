@@ -24,3 +24,109 @@ CREATE TABLE IF NOT EXISTS metrics.dist
  	ts DateTime,
 	updated DateTime DEFAULT now()
  ) ENGINE = Distributed(metrics, metrics, samples, sipHash64(name));
+
+# optional downsampled table, prom2click -ch.downsample=5m -ch.downsamplecreate
+# creates these (per bucket size) if they don't exist
+CREATE TABLE IF NOT EXISTS metrics.samples_5m
+ (
+ 	date Date,
+ 	name String,
+ 	tags Array(String),
+ 	bucket DateTime,
+ 	min_val AggregateFunction(min, Float64),
+ 	max_val AggregateFunction(max, Float64),
+ 	sum_val AggregateFunction(sum, Float64),
+ 	cnt AggregateFunction(count, Float64),
+ 	last_val AggregateFunction(argMax, Float64, DateTime)
+) ENGINE = AggregatingMergeTree(date, (name, tags, bucket), 8192);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS metrics.samples_5m_mv
+ TO metrics.samples_5m
+ AS SELECT
+ 	toDate(ts) AS date,
+ 	name,
+ 	tags,
+ 	toDateTime(intDiv(toUInt32(ts), 300) * 300) AS bucket,
+ 	minState(val) AS min_val,
+ 	maxState(val) AS max_val,
+ 	sumState(val) AS sum_val,
+ 	countState(val) AS cnt,
+ 	argMaxState(val, ts) AS last_val
+ FROM metrics.samples
+ WHERE isFinite(val)
+ GROUP BY date, name, tags, bucket;
+
+# optional structured histogram table, prom2click -ch.histograms writes the
+# buckets/quantiles, sum and count of each histogram/summary here. Tables
+# created before bound_labels need:
+#   ALTER TABLE metrics.histograms ADD COLUMN bound_labels Array(String) AFTER bounds;
+CREATE TABLE IF NOT EXISTS metrics.histograms
+ (
+ 	date Date DEFAULT toDate(0),
+ 	name String,
+ 	tags Array(String),
+ 	kind String,
+ 	bounds Array(Float64),
+ 	bound_labels Array(String),
+ 	counts Array(Float64),
+ 	sum Float64,
+ 	count Float64,
+ 	ts DateTime,
+ 	updated DateTime DEFAULT now()
+) ENGINE = MergeTree(date, (name, tags, ts), 8192);
+
+# optional native histogram table, prom2click -ch.nativehistograms writes
+# native histogram samples here. Bucket counts are absolute, spans are
+# split into parallel offset/length arrays. Tables created before
+# custom_values need:
+#   ALTER TABLE metrics.native_histograms ADD COLUMN custom_values Array(Float64) AFTER negative_buckets;
+CREATE TABLE IF NOT EXISTS metrics.native_histograms
+ (
+ 	date Date DEFAULT toDate(0),
+ 	name String,
+ 	tags Array(String),
+ 	schema Int32,
+ 	zero_threshold Float64,
+ 	zero_count Float64,
+ 	count Float64,
+ 	sum Float64,
+ 	positive_offsets Array(Int32),
+ 	positive_lengths Array(UInt32),
+ 	positive_buckets Array(Float64),
+ 	negative_offsets Array(Int32),
+ 	negative_lengths Array(UInt32),
+ 	negative_buckets Array(Float64),
+ 	custom_values Array(Float64),
+ 	reset_hint UInt8,
+ 	float UInt8,
+ 	ts DateTime,
+ 	updated DateTime DEFAULT now()
+) ENGINE = MergeTree(date, (name, tags, ts), 8192);
+
+
+# optional exemplar table, prom2click -ch.exemplars writes exemplars here
+# with the name and tags of their series. ts_ms keeps the exemplars
+# millisecond timestamp.
+CREATE TABLE IF NOT EXISTS metrics.exemplars
+ (
+ 	date Date DEFAULT toDate(0),
+ 	name String,
+ 	tags Array(String),
+ 	labels Array(String),
+ 	val Float64,
+ 	ts DateTime,
+ 	ts_ms Int64,
+ 	updated DateTime DEFAULT now()
+) ENGINE = MergeTree(date, (name, tags, ts), 8192);
+
+# optional metadata table, prom2click -ch.metadata writes the HELP, TYPE and
+# UNIT of each metric here when they change
+CREATE TABLE IF NOT EXISTS metrics.metadata
+ (
+ 	date Date DEFAULT toDate(0),
+ 	name String,
+ 	type String,
+ 	help String,
+ 	unit String,
+ 	updated DateTime DEFAULT now()
+) ENGINE = ReplacingMergeTree(date, (name), 8192, updated);
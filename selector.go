@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// parseSelector parses a prometheus series selector, eg.
+//
+//	http_requests_total{job="api", code=~"5.."}
+//
+// into label matchers. Only plain selectors are supported, no ranges,
+// offsets or functions.
+func parseSelector(s string) ([]*remote.LabelMatcher, error) {
+	var matchers []*remote.LabelMatcher
+	p := strings.TrimSpace(s)
+
+	// optional metric name
+	i := 0
+	for i < len(p) && isNameChar(p[i], i == 0, true) {
+		i++
+	}
+	if i > 0 {
+		matchers = append(matchers, &remote.LabelMatcher{
+			Type:  remote.MatchType_EQUAL,
+			Name:  model.MetricNameLabel,
+			Value: p[:i],
+		})
+	}
+	p = strings.TrimSpace(p[i:])
+
+	if p == "" {
+		if len(matchers) == 0 {
+			return nil, fmt.Errorf("invalid selector %q: empty", s)
+		}
+		return matchers, nil
+	}
+	if p[0] != '{' || p[len(p)-1] != '}' {
+		return nil, fmt.Errorf("invalid selector %q: expected {...}", s)
+	}
+	p = p[1 : len(p)-1]
+
+	for {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			break
+		}
+
+		// label name
+		i = 0
+		for i < len(p) && isNameChar(p[i], i == 0, false) {
+			i++
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("invalid selector %q: expected label name at %q", s, p)
+		}
+		m := &remote.LabelMatcher{Name: p[:i]}
+		p = strings.TrimSpace(p[i:])
+
+		// match operator
+		switch {
+		case strings.HasPrefix(p, "=~"):
+			m.Type = remote.MatchType_REGEX_MATCH
+			p = p[2:]
+		case strings.HasPrefix(p, "!~"):
+			m.Type = remote.MatchType_REGEX_NO_MATCH
+			p = p[2:]
+		case strings.HasPrefix(p, "!="):
+			m.Type = remote.MatchType_NOT_EQUAL
+			p = p[2:]
+		case strings.HasPrefix(p, "="):
+			m.Type = remote.MatchType_EQUAL
+			p = p[1:]
+		default:
+			return nil, fmt.Errorf("invalid selector %q: expected match operator at %q", s, p)
+		}
+		p = strings.TrimSpace(p)
+
+		// quoted value
+		val, rest, err := unquotePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", s, err.Error())
+		}
+		m.Value = val
+		matchers = append(matchers, m)
+
+		p = strings.TrimSpace(rest)
+		if p == "" {
+			break
+		}
+		if p[0] != ',' {
+			return nil, fmt.Errorf("invalid selector %q: expected , at %q", s, p)
+		}
+		p = p[1:]
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("invalid selector %q: no matchers", s)
+	}
+	return matchers, nil
+}
+
+// unquotePrefix unquotes the single, double or back quoted string at the
+// start of s and returns it with the remainder of s
+func unquotePrefix(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'' && s[0] != '`') {
+		return "", "", fmt.Errorf("expected quoted string at %q", s)
+	}
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if q != '`' {
+				i++
+			}
+		case q:
+			lit := s[:i+1]
+			if q == '\'' {
+				// strconv only unquotes single characters in single quotes
+				inner := strings.Replace(lit[1:i], `\'`, `'`, -1)
+				lit = `"` + strings.Replace(inner, `"`, `\"`, -1) + `"`
+			}
+			val, err := strconv.Unquote(lit)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+			}
+			return val, s[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %s", s)
+}
+
+// isNameChar returns true if c is valid in a label or (if metric is set)
+// metric name at the given position
+func isNameChar(c byte, first, metric bool) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+		(metric && c == ':') || (!first && c >= '0' && c <= '9')
+}
+
+// labelMatcher is a label matcher with its regexp compiled
+type labelMatcher struct {
+	*remote.LabelMatcher
+	re *regexp.Regexp
+}
+
+// newLabelMatchers compiles matchers for evaluation against label sets
+func newLabelMatchers(matchers []*remote.LabelMatcher) ([]labelMatcher, error) {
+	lms := make([]labelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		lm := labelMatcher{LabelMatcher: m}
+		if m.Type == remote.MatchType_REGEX_MATCH || m.Type == remote.MatchType_REGEX_NO_MATCH {
+			// prometheus regexes are fully anchored
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			lm.re = re
+		}
+		lms = append(lms, lm)
+	}
+	return lms, nil
+}
+
+// matchLabels returns true if labels satisfy every matcher, a missing
+// label has the empty value
+func matchLabels(lms []labelMatcher, labels map[string]string) bool {
+	for _, m := range lms {
+		v := labels[m.Name]
+		switch m.Type {
+		case remote.MatchType_EQUAL:
+			if v != m.Value {
+				return false
+			}
+		case remote.MatchType_NOT_EQUAL:
+			if v == m.Value {
+				return false
+			}
+		case remote.MatchType_REGEX_MATCH:
+			if !m.re.MatchString(v) {
+				return false
+			}
+		case remote.MatchType_REGEX_NO_MATCH:
+			if m.re.MatchString(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// selectorsSQL returns an sql expression true for the series matching any
+// of selectors, none matches nothing
+func selectorsSQL(selectors [][]*remote.LabelMatcher) string {
+	if len(selectors) == 0 {
+		return "0"
+	}
+	var match []string
+	for _, matchers := range selectors {
+		where := getMatchersSQL(matchers)
+		if len(where) == 0 {
+			return "1"
+		}
+		match = append(match, "("+strings.Join(where, " AND ")+")")
+	}
+	return "(" + strings.Join(match, " OR ") + ")"
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// p2cShard is a single clickhouse write target. When client side sharding
+// is disabled there is exactly one shard which points at ch.dsn/ch.table.
+type p2cShard struct {
+	id       int
+	dsn      string
+	weight   int
+	db       *sql.DB
+	requests chan *p2cRequest
+	// 1 if the last write to the shard succeeded, 0 otherwise
+	healthy int32
+	// consecutive failed batches, only touched by the shards writer goroutine
+	failures int
+}
+
+// back-off between writes to an unhealthy shard, doubling per failed batch
+const (
+	shardMinBackoff = 100 * time.Millisecond
+	shardMaxBackoff = 10 * time.Second
+)
+
+func (s *p2cShard) isHealthy() bool {
+	return atomic.LoadInt32(&s.healthy) == 1
+}
+
+// setHealthy records the result of the last write and returns true if
+// the health state changed
+func (s *p2cShard) setHealthy(ok bool) bool {
+	var v int32
+	if ok {
+		v = 1
+		s.failures = 0
+	} else {
+		s.failures++
+	}
+	return atomic.SwapInt32(&s.healthy, v) != v
+}
+
+// backoff returns how long to wait before writing to the shard again
+// after failures consecutive failed batches
+func (s *p2cShard) backoff() time.Duration {
+	d := shardMinBackoff
+	for i := 1; i < s.failures && d < shardMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > shardMaxBackoff {
+		d = shardMaxBackoff
+	}
+	return d
+}
+
+// parseShards builds the shard list from the semicolon separated ch.shards
+// DSNs and optional comma separated ch.shardweights.
+func parseShards(dsns, weights string) ([]*p2cShard, error) {
+	var shards []*p2cShard
+	for _, dsn := range strings.Split(dsns, ";") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn == "" {
+			continue
+		}
+		shards = append(shards, &p2cShard{
+			id:      len(shards),
+			dsn:     dsn,
+			weight:  1,
+			healthy: 1,
+		})
+	}
+	if len(shards) < 1 {
+		return nil, errors.New("no shard DSNs found in ch.shards")
+	}
+
+	if weights == "" {
+		return shards, nil
+	}
+	ws := strings.Split(weights, ",")
+	if len(ws) != len(shards) {
+		return nil, fmt.Errorf("ch.shardweights has %d weights for %d shards",
+			len(ws), len(shards))
+	}
+	for i, w := range ws {
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid shard weight: %s", w)
+		}
+		shards[i].weight = n
+	}
+	return shards, nil
+}
+
+// shardSlots maps each slot in [0, sum(weights)) to a shard index the same
+// way a clickhouse Distributed table does: shard i owns a contiguous range
+// of slots sized by its weight, in the order the shards are defined.
+func shardSlots(shards []*p2cShard) []int {
+	var slots []int
+	for i, s := range shards {
+		for j := 0; j < s.weight; j++ {
+			slots = append(slots, i)
+		}
+	}
+	return slots
+}
+
+// shardFor returns the index of the shard that owns name, matching the
+// sipHash64(name) sharding key used by the Distributed table in schema.sql
+func shardFor(slots []int, name string) int {
+	if len(slots) == 1 {
+		return slots[0]
+	}
+	return slots[sipHash64([]byte(name))%uint64(len(slots))]
+}
+
+// sipHash64 is SipHash-2-4 with a zero key, which is what clickhouse's
+// sipHash64() function computes for a String argument.
+func sipHash64(p []byte) uint64 {
+	v0 := uint64(0x736f6d6570736575)
+	v1 := uint64(0x646f72616e646f6d)
+	v2 := uint64(0x6c7967656e657261)
+	v3 := uint64(0x7465646279746573)
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(p)
+	for len(p) >= 8 {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		p = p[8:]
+	}
+
+	// last block: remaining bytes plus the length in the top byte
+	b := uint64(n) << 56
+	for i, c := range p {
+		b |= uint64(c) << (8 * uint(i))
+	}
+	v3 ^= b
+	round()
+	round()
+	v0 ^= b
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// splitRange splits tr into sub-ranges aligned to multiples of interval
+// seconds (eg. days) so each covers at most one interval. The interval is
+// rounded up to a multiple of the step so no aggregation bucket straddles
+// two sub-ranges. Aligning to the interval rather than the query start
+// keeps sub-range cache keys stable as a dashboard's window moves.
+func splitRange(tr timeRange, interval int64) []timeRange {
+	if interval < 1 || tr.end-tr.start < interval {
+		return []timeRange{tr}
+	}
+	if rem := interval % tr.step; rem != 0 {
+		interval += tr.step - rem
+	}
+
+	var trs []timeRange
+	for start := tr.start; start <= tr.end; {
+		end := start - start%interval + interval - 1
+		if end > tr.end {
+			end = tr.end
+		}
+		trs = append(trs, timeRange{start: start, end: end, step: tr.step})
+		start = end + 1
+	}
+	return trs
+}
+
+// queryRange returns the series matching q over tr. The range is split at
+// rollup tier boundaries and long ranges into sub-ranges, which are queried
+// concurrently by up to read.splitworkers goroutines, the results are
+// merged in time order.
+func (r *p2cReader) queryRange(ctx context.Context, q *remote.Query, tr timeRange,
+	limits *readLimits) ([]*remote.TimeSeries, int, error) {
+
+	// each rollup tier may need a different step, then split those parts
+	var trs []timeRange
+	for _, part := range r.planRollup(tr) {
+		trs = append(trs, splitRange(part, int64(r.conf.ReadSplitInterval.Seconds()))...)
+	}
+	if len(trs) == 1 {
+		return r.query(ctx, q, trs[0], limits)
+	}
+	fmt.Fprintf(r.log, "query: split into %d sub-ranges\n", len(trs))
+
+	// first error cancels the remaining sub-queries
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := r.conf.ReadSplitWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		qerr    error
+		rcount  int
+		sem     = make(chan struct{}, workers)
+		results = make([][]*remote.TimeSeries, len(trs))
+	)
+
+	for i := range trs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+
+			series, n, err := r.query(ctx, q, trs[i], limits)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			rcount += n
+			if err != nil {
+				if qerr == nil {
+					qerr = err
+					cancel()
+				}
+				return
+			}
+			results[i] = series
+		}(i)
+	}
+	wg.Wait()
+
+	if qerr != nil {
+		return nil, rcount, qerr
+	}
+	// the parent context may have ended while waiting for a worker
+	if err := ctx.Err(); err != nil {
+		return nil, rcount, r.queryError(ctx, err)
+	}
+
+	// sub-ranges are in time order as are the samples within each so
+	// appending them per series keeps the merged samples in order
+	var (
+		order  []string
+		merged = make(map[string]*remote.TimeSeries)
+	)
+	for _, series := range results {
+		for _, ts := range series {
+			key := labelsKey(ts.Labels)
+			mts, ok := merged[key]
+			if !ok {
+				// results may be cached, copy so appends don't modify them
+				mts = &remote.TimeSeries{
+					Labels:  ts.Labels,
+					Samples: ts.Samples[:len(ts.Samples):len(ts.Samples)],
+				}
+				merged[key] = mts
+				order = append(order, key)
+				continue
+			}
+			mts.Samples = append(mts.Samples, ts.Samples...)
+		}
+	}
+
+	series := make([]*remote.TimeSeries, 0, len(order))
+	for _, key := range order {
+		series = append(series, merged[key])
+	}
+	return series, rcount, nil
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"os"
 	"time"
 
 	"fmt"
@@ -20,36 +23,104 @@ type p2cRequest struct {
 	tags []string
 	val  float64
 	ts   time.Time
+	// set for a histogram or summary row
+	hist *p2cHistogram
+	// set for a native histogram sample
+	native *p2cNativeHistogram
+	// set for an exemplar
+	exemplar *p2cExemplar
+	// set for metric metadata
+	meta *p2cMetadata
+	// set for requests consumed from kafka or imported
+	ack writeAck
 }
 
 type p2cServer struct {
-	requests chan *p2cRequest
-	mux      *http.ServeMux
-	conf     *config
-	writer   *p2cWriter
-	reader   *p2cReader
-	rx       prometheus.Counter
+	requests      chan *p2cRequest
+	mux           *http.ServeMux
+	conf          *config
+	writer        *p2cWriter
+	reader        *p2cReader
+	retainer      *p2cRetention
+	graphite      *p2cGraphite
+	forwarder     *p2cForwarder
+	queue         *p2cQueue
+	rx            prometheus.Counter
+	special       *prometheus.CounterVec
+	nativeDropped prometheus.Counter
+	metaCache     *metadataCache
+	influxInvalid prometheus.Counter
+	otlpDeltas    *otlpDeltas
+	otlpRejected  prometheus.Counter
+	tsdbInvalid   prometheus.Counter
 }
 
+// staleNaN is the bit pattern prometheus uses for staleness markers
+const staleNaN uint64 = 0x7ff0000000000002
+
 func NewP2CServer(conf *config) (*p2cServer, error) {
 	var err error
 	c := new(p2cServer)
 	c.requests = make(chan *p2cRequest, conf.ChanSize)
 	c.mux = http.NewServeMux()
 	c.conf = conf
+	c.metaCache = newMetadataCache()
 
-	c.writer, err = NewP2CWriter(conf, c.requests)
-	if err != nil {
-		fmt.Printf("Error creating clickhouse writer: %s\n", err.Error())
-		return c, err
+	// the writer writes what the endpoints queue, unless a kafka producer
+	// publishes it instead
+	writes := c.requests
+	if conf.KafkaMode != "" {
+		c.queue, err = NewP2CQueue(conf, c.requests, prometheus.DefaultRegisterer)
+		if err != nil {
+			fmt.Printf("Error creating kafka queue: %s\n", err.Error())
+			return c, err
+		}
+		writes = c.queue.consumed
+	}
+
+	if writes != nil {
+		c.writer, err = NewP2CWriter(conf, writes, prometheus.DefaultRegisterer)
+		if err != nil {
+			fmt.Printf("Error creating clickhouse writer: %s\n", err.Error())
+			return c, err
+		}
+		// a dropped message would only be read again, wait for the shard
+		// instead
+		if writes != c.requests {
+			c.writer.block = true
+		}
 	}
 
-	c.reader, err = NewP2CReader(conf)
+	c.reader, err = NewP2CReader(conf, os.Stdout)
 	if err != nil {
 		fmt.Printf("Error creating clickhouse reader: %s\n", err.Error())
 		return c, err
 	}
 
+	if conf.RetentionRules != "" {
+		c.retainer, err = NewP2CRetention(conf)
+		if err != nil {
+			fmt.Printf("Error creating retention manager: %s\n", err.Error())
+			return c, err
+		}
+	}
+
+	if conf.GraphiteAddress != "" || conf.GraphitePickleAddress != "" {
+		c.graphite, err = NewP2CGraphite(conf, c.process)
+		if err != nil {
+			fmt.Printf("Error creating graphite listener: %s\n", err.Error())
+			return c, err
+		}
+	}
+
+	if conf.ForwardConfig != "" {
+		c.forwarder, err = NewP2CForwarder(conf)
+		if err != nil {
+			fmt.Printf("Error creating forwarder: %s\n", err.Error())
+			return c, err
+		}
+	}
+
 	c.rx = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "received_samples_total",
@@ -58,7 +129,55 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 	)
 	prometheus.MustRegister(c.rx)
 
+	c.special = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "received_special_samples_total",
+			Help: "Total number of received samples with staleness marker, NaN or +/-Inf values.",
+		},
+		[]string{"kind"},
+	)
+	prometheus.MustRegister(c.special)
+
+	c.nativeDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dropped_native_histograms_total",
+			Help: "Total number of received native histogram samples dropped as ch.nativehistograms is disabled.",
+		},
+	)
+	prometheus.MustRegister(c.nativeDropped)
+
+	c.influxInvalid = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influx_invalid_lines_total",
+			Help: "Total number of influx line protocol lines rejected as invalid.",
+		},
+	)
+	prometheus.MustRegister(c.influxInvalid)
+
+	c.otlpDeltas = newOTLPDeltas()
+	c.otlpRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "otlp_rejected_points_total",
+			Help: "Total number of OTLP data points rejected as unsupported or invalid.",
+		},
+	)
+	prometheus.MustRegister(c.otlpRejected)
+
+	c.tsdbInvalid = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "opentsdb_invalid_points_total",
+			Help: "Total number of opentsdb data points rejected as invalid.",
+		},
+	)
+	prometheus.MustRegister(c.tsdbInvalid)
+
 	c.mux.HandleFunc(c.conf.HTTPWritePath, func(w http.ResponseWriter, r *http.Request) {
+		msg, err := writeProto(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -71,13 +190,27 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 			return
 		}
 
-		var req remote.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if msg == writeProtoV1 {
+			var req p2cWriteRequest
+			if err := proto.Unmarshal(reqBuf, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.process(&req)
 			return
 		}
 
-		c.process(req)
+		var req2 writeRequestV2
+		if err := proto.Unmarshal(reqBuf, &req2); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := req2.v1(c.conf.WriteCreatedZero)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.process(req).setHeaders(w)
 	})
 
 	c.mux.HandleFunc("/read", func(w http.ResponseWriter, r *http.Request) {
@@ -93,16 +226,41 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 			return
 		}
 
-		var req remote.ReadRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
+		var rreq p2cReadRequest
+		if err := proto.Unmarshal(reqBuf, &rreq); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		req := remote.ReadRequest{Queries: rreq.Queries}
+
+		// stop the query when the client goes away or it takes too long
+		ctx := r.Context()
+		if c.conf.CHMaxQueryTime > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.conf.CHMaxQueryTime)
+			defer cancel()
+		}
+
+		// stream chunks if the client supports it and all the series can be
+		if rreq.streamed() && c.reader.streamable(ctx, &req) {
+			cw := newChunkedWriter(w)
+			if err = c.reader.ReadStream(ctx, &req, cw); err != nil {
+				// too late to send an error once frames are on the wire,
+				// the client will see a truncated response
+				if cw.frames > 0 {
+					fmt.Printf("Error: streamed read failed after %d frames: %s\n",
+						cw.frames, err.Error())
+					return
+				}
+				readError(w, err)
+			}
+			return
+		}
 
-		var resp *remote.ReadResponse
-		resp, err = c.reader.Read(&req)
+		var resp *p2cReadResponse
+		resp, err = c.reader.Read(ctx, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			readError(w, err)
 			return
 		}
 
@@ -122,6 +280,16 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 		}
 	})
 
+	c.mux.HandleFunc("/api/v1/query_exemplars", c.queryExemplars)
+	c.mux.HandleFunc("/api/v1/metadata", c.queryMetadata)
+	c.mux.HandleFunc("/api/v1/export", c.exportSeries)
+	c.mux.HandleFunc("/federate", c.federate)
+	c.mux.HandleFunc("/influx/write", c.influxWrite)
+	c.mux.HandleFunc("/api/v2/write", c.influxWrite)
+	c.mux.HandleFunc("/v1/metrics", c.otlpWrite)
+	c.mux.HandleFunc("/api/put", c.tsdbPut)
+	c.mux.HandleFunc("/import/openmetrics", c.importExposition)
+
 	c.mux.Handle(c.conf.HTTPMetricsPath, prometheus.InstrumentHandler(
 		c.conf.HTTPMetricsPath, prometheus.UninstrumentedHandler(),
 	))
@@ -129,59 +297,177 @@ func NewP2CServer(conf *config) (*p2cServer, error) {
 	return c, nil
 }
 
-func (c *p2cServer) process(req remote.WriteRequest) {
-	for _, series := range req.Timeseries {
-		c.rx.Add(float64(len(series.Samples)))
-		var (
-			name string
-			tags []string
-		)
-
-		for _, label := range series.Labels {
-			if model.LabelName(label.Name) == model.MetricNameLabel {
-				name = label.Value
+// readError writes err to w with the status it carries, if any
+func readError(w http.ResponseWriter, err error) {
+	if rerr, ok := err.(*p2cReadError); ok {
+		http.Error(w, rerr.Error(), rerr.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// process queues the requests samples for the writer
+func (c *p2cServer) process(req *p2cWriteRequest) writeStats {
+	var (
+		stats writeStats
+		hists *histBuilder
+	)
+	if c.conf.ChHistograms {
+		hists = newHistBuilder()
+	}
+	if c.forwarder != nil {
+		c.forwarder.forward(req)
+	}
+
+	for _, s := range req.Timeseries {
+		c.rx.Add(float64(len(s.Samples) + len(s.Histograms)))
+		for _, sample := range s.Samples {
+			if kind := specialValue(sample.Value); kind != "" {
+				c.special.WithLabelValues(kind).Inc()
 			}
-			// store tags in <key>=<value> format
-			// allows for has(tags, "key=val") searches
-			// probably impossible/difficult to do regex searches on tags
-			t := fmt.Sprintf("%s=%s", label.Name, label.Value)
-			tags = append(tags, t)
-		}
-
-		for _, sample := range series.Samples {
-			p2c := new(p2cRequest)
-			p2c.name = name
-			p2c.ts = time.Unix(sample.TimestampMs/1000, 0)
-			p2c.val = sample.Value
-			p2c.tags = tags
+		}
+
+		stats.samples += len(s.Samples)
+		if len(s.Histograms) > 0 {
+			if c.conf.ChNativeHistograms {
+				c.enqueueNative(s)
+				stats.histograms += len(s.Histograms)
+			} else {
+				c.nativeDropped.Add(float64(len(s.Histograms)))
+			}
+		}
+		if len(s.Exemplars) > 0 && c.conf.ChExemplars {
+			c.enqueueExemplars(s)
+			stats.exemplars += len(s.Exemplars)
+		}
+		if len(s.Samples) == 0 {
+			continue
+		}
+
+		series := s.samples()
+		if hists != nil && hists.add(seriesName(series), series) {
+			continue
+		}
+		c.enqueue(series)
+	}
+
+	if len(req.Metadata) > 0 && c.conf.ChMetadata {
+		c.enqueueMetadata(req.Metadata)
+	}
+
+	if hists != nil {
+		for _, p2c := range hists.finish(c.enqueue) {
 			c.requests <- p2c
 		}
+	}
+	return stats
+}
+
+// enqueue queues a request per sample of series for the writer
+func (c *p2cServer) enqueue(series *remote.TimeSeries) {
+	name, tags := seriesTags(series.Labels)
+	for _, sample := range series.Samples {
+		// value bits are kept as is so staleness markers survive
+		p2c := new(p2cRequest)
+		p2c.name = name
+		p2c.ts = time.Unix(sample.TimestampMs/1000, 0)
+		p2c.val = sample.Value
+		p2c.tags = tags
+		c.requests <- p2c
+	}
+}
+
+// seriesTags returns the metric name and tags of a series
+func seriesTags(labels []*remote.LabelPair) (string, []string) {
+	var (
+		name string
+		tags []string
+	)
+
+	for _, label := range labels {
+		if model.LabelName(label.Name) == model.MetricNameLabel {
+			name = label.Value
+		}
+		// store tags in <key>=<value> format
+		// allows for has(tags, "key=val") searches
+		// probably impossible/difficult to do regex searches on tags
+		t := fmt.Sprintf("%s=%s", label.Name, label.Value)
+		tags = append(tags, t)
+	}
+	return name, tags
+}
 
+// specialValue returns the kind of non-finite value v is, or "" for finite values
+func specialValue(v float64) string {
+	switch {
+	case math.Float64bits(v) == staleNaN:
+		return "stale"
+	case math.IsNaN(v):
+		return "nan"
+	case math.IsInf(v, 0):
+		return "inf"
 	}
+	return ""
 }
 
 func (c *p2cServer) Start() error {
 	fmt.Println("HTTP server starting...")
-	c.writer.Start()
+	if c.writer != nil {
+		c.writer.Start()
+	}
+	if c.queue != nil {
+		c.queue.Start()
+	}
+	if c.retainer != nil {
+		c.retainer.Start()
+	}
+	if c.forwarder != nil {
+		c.forwarder.Start()
+	}
+	if c.graphite != nil {
+		c.graphite.Start()
+	}
 	return graceful.RunWithErr(c.conf.HTTPAddr, c.conf.HTTPTimeout, c.mux)
 }
 
 func (c *p2cServer) Shutdown() {
+	if c.retainer != nil {
+		c.retainer.Stop()
+	}
+	if c.graphite != nil {
+		c.graphite.Stop()
+	}
+	if c.forwarder != nil {
+		c.forwarder.Stop()
+	}
+	if c.queue != nil {
+		c.queue.Stop()
+	}
 	close(c.requests)
-	c.writer.Wait()
+	if c.queue != nil {
+		c.queue.Wait()
+	}
 
-	wchan := make(chan struct{})
-	go func() {
+	if c.writer != nil {
 		c.writer.Wait()
-		close(wchan)
-	}()
 
-	select {
-	case <-wchan:
-		fmt.Println("Writer shutdown cleanly..")
-	// All done!
-	case <-time.After(10 * time.Second):
-		fmt.Println("Writer shutdown timed out, samples will be lost..")
+		wchan := make(chan struct{})
+		go func() {
+			c.writer.Wait()
+			close(wchan)
+		}()
+
+		select {
+		case <-wchan:
+			fmt.Println("Writer shutdown cleanly..")
+		// All done!
+		case <-time.After(10 * time.Second):
+			fmt.Println("Writer shutdown timed out, samples will be lost..")
+		}
 	}
 
+	// offsets are committed once what was consumed is written
+	if c.queue != nil {
+		c.queue.Close()
+	}
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// streamed remote read, see:
+// 	https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+// the vendored remote protos predate it so the messages we need are
+// declared here, field numbers must match prompb.
+
+// response types a client may accept for a remote read request
+const (
+	readResponseSamples           = 0
+	readResponseStreamedXORChunks = 1
+)
+
+const streamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// p2cReadRequest is remote.ReadRequest plus the accepted response types
+type p2cReadRequest struct {
+	Queries               []*remote.Query `protobuf:"bytes,1,rep,name=queries" json:"queries,omitempty"`
+	AcceptedResponseTypes []int32         `protobuf:"varint,2,rep,packed,name=accepted_response_types,json=acceptedResponseTypes" json:"accepted_response_types,omitempty"`
+}
+
+func (m *p2cReadRequest) Reset()         { *m = p2cReadRequest{} }
+func (m *p2cReadRequest) String() string { return proto.CompactTextString(m) }
+func (*p2cReadRequest) ProtoMessage()    {}
+
+// streamed returns true if the client accepts streamed XOR chunks
+func (m *p2cReadRequest) streamed() bool {
+	for _, t := range m.AcceptedResponseTypes {
+		if t == readResponseStreamedXORChunks {
+			return true
+		}
+	}
+	return false
+}
+
+type chunkedReadResponse struct {
+	ChunkedSeries []*chunkedSeries `protobuf:"bytes,1,rep,name=chunked_series,json=chunkedSeries" json:"chunked_series,omitempty"`
+	QueryIndex    int64            `protobuf:"varint,2,opt,name=query_index,json=queryIndex,proto3" json:"query_index,omitempty"`
+}
+
+func (m *chunkedReadResponse) Reset()         { *m = chunkedReadResponse{} }
+func (m *chunkedReadResponse) String() string { return proto.CompactTextString(m) }
+func (*chunkedReadResponse) ProtoMessage()    {}
+
+type chunkedSeries struct {
+	Labels []*remote.LabelPair `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Chunks []*chunk            `protobuf:"bytes,2,rep,name=chunks" json:"chunks,omitempty"`
+}
+
+func (m *chunkedSeries) Reset()         { *m = chunkedSeries{} }
+func (m *chunkedSeries) String() string { return proto.CompactTextString(m) }
+func (*chunkedSeries) ProtoMessage()    {}
+
+type chunk struct {
+	MinTimeMs int64  `protobuf:"varint,1,opt,name=min_time_ms,json=minTimeMs,proto3" json:"min_time_ms,omitempty"`
+	MaxTimeMs int64  `protobuf:"varint,2,opt,name=max_time_ms,json=maxTimeMs,proto3" json:"max_time_ms,omitempty"`
+	Type      int32  `protobuf:"varint,3,opt,name=type,proto3" json:"type,omitempty"`
+	Data      []byte `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *chunk) Reset()         { *m = chunk{} }
+func (m *chunk) String() string { return proto.CompactTextString(m) }
+func (*chunk) ProtoMessage()    {}
+
+// chunkedWriter writes length delimited, crc32 checked ChunkedReadResponse
+// frames and flushes each one to the client
+type chunkedWriter struct {
+	w      http.ResponseWriter
+	frames int
+}
+
+// newChunkedWriter sets the streamed content type up front so a response
+// without any series still has it
+func newChunkedWriter(w http.ResponseWriter) *chunkedWriter {
+	w.Header().Set("Content-Type", streamedContentType)
+	return &chunkedWriter{w: w}
+}
+
+func (cw *chunkedWriter) write(msg *chunkedReadResponse) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// frame: uvarint size, big endian crc32 (castagnoli), message
+	var hdr [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(b)))
+	binary.BigEndian.PutUint32(hdr[n:], crc32.Checksum(b, castagnoliTable))
+	if _, err = cw.w.Write(hdr[:n+4]); err != nil {
+		return err
+	}
+	if _, err = cw.w.Write(b); err != nil {
+		return err
+	}
+	cw.frames++
+
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// streamable returns true if every series matching req can be streamed,
+// series stored in ch.histtable are only expanded by Read and native
+// histograms can't be XOR chunks
+func (r *p2cReader) streamable(ctx context.Context, req *remote.ReadRequest) bool {
+	if r.conf.ChHistograms {
+		return false
+	}
+	if !r.conf.ChNativeHistograms {
+		return true
+	}
+	for _, q := range req.Queries {
+		if r.hasNative(ctx, q) {
+			return false
+		}
+	}
+	return true
+}
+
+// nativeProbeTTL is how long the result of a native histogram probe is
+// reused, series that gain native histograms are streamed as samples
+// only until it expires
+const nativeProbeTTL = time.Minute
+
+// nativeProbes remembers which matchers select native histograms so
+// streamed reads don't each query ch.nativetable first
+type nativeProbes struct {
+	mtx   sync.Mutex
+	found map[string]nativeProbe
+}
+
+type nativeProbe struct {
+	native bool
+	at     time.Time
+}
+
+func newNativeProbes() *nativeProbes {
+	return &nativeProbes{found: make(map[string]nativeProbe)}
+}
+
+// get returns the cached probe result for key, if it's recent
+func (np *nativeProbes) get(key string, now time.Time) (bool, bool) {
+	np.mtx.Lock()
+	defer np.mtx.Unlock()
+	p, ok := np.found[key]
+	if !ok || now.Sub(p.at) > nativeProbeTTL {
+		return false, false
+	}
+	return p.native, true
+}
+
+// set records a probe result, dropping expired ones
+func (np *nativeProbes) set(key string, native bool, now time.Time) {
+	np.mtx.Lock()
+	defer np.mtx.Unlock()
+	for k, p := range np.found {
+		if now.Sub(p.at) > nativeProbeTTL {
+			delete(np.found, k)
+		}
+	}
+	np.found[key] = nativeProbe{native: native, at: now}
+}
+
+// hasNative returns true if q may match native histograms, or if it can't
+// tell. Any time range is considered so a cached result holds for every
+// query with the same matchers.
+func (r *p2cReader) hasNative(ctx context.Context, q *remote.Query) bool {
+	where := getMatchersSQL(q.Matchers)
+	key := strings.Join(where, " AND ")
+	now := time.Now()
+	if native, ok := r.native.get(key, now); ok {
+		return native
+	}
+
+	whereSQL := ""
+	if len(where) > 0 {
+		whereSQL = "WHERE " + key
+	}
+	var n uint8
+	err := r.db.QueryRowContext(ctx, fmt.Sprintf("SELECT 1 FROM %s.%s %s LIMIT 1",
+		r.conf.ChDB, r.conf.ChNativeTable, whereSQL)).Scan(&n)
+	switch {
+	case err == sql.ErrNoRows:
+		r.native.set(key, false, now)
+		return false
+	case err != nil:
+		fmt.Fprintf(r.log, "Error: checking for native histograms: %s\n", err.Error())
+		return true
+	}
+	r.native.set(key, true, now)
+	return true
+}
+
+// ReadStream runs the queries in req and streams each series to cw as soon
+// as all of its rows have been scanned, rather than building the whole
+// response in memory. Rows are ordered by series so each one is complete
+// before the next begins. Only samples in ch.table are read, see streamable.
+func (r *p2cReader) ReadStream(ctx context.Context, req *remote.ReadRequest, cw *chunkedWriter) error {
+	limits := r.newReadLimits()
+
+	rcount := 0
+	for i, q := range req.Queries {
+		fmt.Fprintf(r.log, "\nquery: streamed: start: %d, end: %d\n\n", q.StartTimestampMs, q.EndTimestampMs)
+
+		tr, err := r.getTimeRange(q)
+		if err != nil {
+			fmt.Fprintf(r.log, "Error: reader: getTimeRange: %s\n", err.Error())
+			return err
+		}
+
+		// series are streamed in one pass so use one step for the whole
+		// range, coarse enough for the oldest rollup tier in it
+		tr = r.coarsenRollup(tr)
+
+		sqlStr := r.getSQL(q, tr, "tags, t")
+		fmt.Fprintf(r.log, "query: running sql: %s\n\n", sqlStr)
+
+		var (
+			key    string
+			series *chunkedSeries
+			chk    *xorChunk
+		)
+
+		cut := func() {
+			if chk == nil {
+				return
+			}
+			series.Chunks = append(series.Chunks, &chunk{
+				MinTimeMs: chk.mint,
+				MaxTimeMs: chk.t,
+				Type:      chunkEncodingXOR,
+				Data:      chk.Bytes(),
+			})
+			chk = nil
+		}
+
+		flush := func() error {
+			if series == nil {
+				return nil
+			}
+			cut()
+			return cw.write(&chunkedReadResponse{
+				ChunkedSeries: []*chunkedSeries{series},
+				QueryIndex:    int64(i),
+			})
+		}
+
+		add := func(t int64, tags []string, value float64) error {
+			k := strings.Join(tags, "\xff")
+			if series == nil || k != key {
+				if err := flush(); err != nil {
+					return err
+				}
+				if err := r.addSeries(limits); err != nil {
+					return err
+				}
+				key = k
+				series = &chunkedSeries{Labels: r.makeLabels(tags)}
+			}
+			if err := r.addSamples(limits, 1); err != nil {
+				return err
+			}
+			if chk != nil && chk.NumSamples() >= maxChunkSamples {
+				cut()
+			}
+			if chk == nil {
+				chk = newXORChunk()
+			}
+			chk.Append(t, value)
+			return nil
+		}
+
+		n, err := r.scan(ctx, sqlStr, add)
+		rcount += n
+		if err != nil {
+			return err
+		}
+		if err = flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(r.log, "query: streamed %d rows in %d frames for %d queries\n",
+		rcount, cw.frames, len(req.Queries))
+
+	return nil
+}
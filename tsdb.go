@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// an offline reader of prometheus tsdb blocks (index format 1 and 2), see:
+// 	https://github.com/prometheus/prometheus/blob/main/tsdb/docs/format/README.md
+// only what's needed to iterate every series and its XOR chunks is read,
+// the label indices and postings other than the all postings list aren't.
+
+const (
+	tsdbIndexMagic      = 0xBAAAD700
+	tsdbChunksMagic     = 0x85BD40DD
+	tsdbTombstonesMagic = 0x0130BA30
+
+	// index toc, 6 section offsets and a crc32
+	tsdbTOCLen = 6*8 + 4
+	// chunk segment header, magic, version and padding
+	tsdbChunksHeaderLen = 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// tsdbMeta is a blocks meta.json
+type tsdbMeta struct {
+	ULID    string `json:"ulid"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"`
+	Stats   struct {
+		NumSamples uint64 `json:"numSamples"`
+		NumSeries  uint64 `json:"numSeries"`
+	} `json:"stats"`
+	Version int `json:"version"`
+}
+
+// tsdbChunkMeta references a chunk of a series
+type tsdbChunkMeta struct {
+	ref        uint64
+	mint, maxt int64
+}
+
+// tsdbInterval is a deleted time range from the tombstones
+type tsdbInterval struct {
+	mint, maxt int64
+}
+
+// tsdbBlock is an open block
+type tsdbBlock struct {
+	dir        string
+	meta       tsdbMeta
+	index      []byte
+	version    byte
+	symbols    []string
+	symbolsAt  map[uint32]string
+	postings   []uint32
+	segments   []*os.File
+	tombstones map[uint64][]tsdbInterval
+}
+
+// tsdbDecbuf decodes the sections of an index
+type tsdbDecbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *tsdbDecbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid uvarint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *tsdbDecbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *tsdbDecbuf) be32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 4 {
+		d.err = fmt.Errorf("unexpected end of data")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *tsdbDecbuf) str() string {
+	n := int(d.uvarint())
+	if d.err != nil {
+		return ""
+	}
+	if n > len(d.b) {
+		d.err = fmt.Errorf("unexpected end of data")
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// listTSDBBlocks returns the block directories in dir ordered by ulid,
+// which orders them by time
+func listTSDBBlocks(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), "meta.json")); err == nil {
+			blocks = append(blocks, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(blocks)
+	return blocks, nil
+}
+
+// readTSDBMeta reads the meta.json of a block
+func readTSDBMeta(dir string) (tsdbMeta, error) {
+	var meta tsdbMeta
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return meta, err
+	}
+	if err = json.Unmarshal(b, &meta); err != nil {
+		return meta, fmt.Errorf("%s: %s", filepath.Join(dir, "meta.json"), err.Error())
+	}
+	return meta, nil
+}
+
+// openTSDBBlock reads the index and tombstones of a block and opens its
+// chunk segments
+func openTSDBBlock(dir string) (*tsdbBlock, error) {
+	meta, err := readTSDBMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	b := &tsdbBlock{dir: dir, meta: meta}
+
+	if err = b.readIndex(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Join(dir, "index"), err.Error())
+	}
+	if err = b.readTombstones(); err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Join(dir, "tombstones"), err.Error())
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "chunks", "[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	for _, path := range segments {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.segments = append(b.segments, f)
+
+		hdr := make([]byte, tsdbChunksHeaderLen)
+		if _, err = f.ReadAt(hdr, 0); err != nil || binary.BigEndian.Uint32(hdr) != tsdbChunksMagic {
+			b.Close()
+			return nil, fmt.Errorf("%s: not a chunk segment", path)
+		}
+	}
+	return b, nil
+}
+
+// Close closes the chunk segments
+func (b *tsdbBlock) Close() {
+	for _, f := range b.segments {
+		f.Close()
+	}
+}
+
+func (b *tsdbBlock) readIndex() error {
+	var err error
+	if b.index, err = ioutil.ReadFile(filepath.Join(b.dir, "index")); err != nil {
+		return err
+	}
+	if len(b.index) < 5+tsdbTOCLen || binary.BigEndian.Uint32(b.index) != tsdbIndexMagic {
+		return fmt.Errorf("not a tsdb index")
+	}
+	b.version = b.index[4]
+	if b.version != 1 && b.version != 2 {
+		return fmt.Errorf("unsupported index version %d", b.version)
+	}
+
+	toc := b.index[len(b.index)-tsdbTOCLen:]
+	if crc32.Checksum(toc[:48], castagnoli) != binary.BigEndian.Uint32(toc[48:]) {
+		return fmt.Errorf("toc checksum mismatch")
+	}
+	symbolsOff := binary.BigEndian.Uint64(toc[0:])
+	postingsTableOff := binary.BigEndian.Uint64(toc[40:])
+
+	if err = b.readSymbols(symbolsOff); err != nil {
+		return fmt.Errorf("symbols: %s", err.Error())
+	}
+	if err = b.readAllPostings(postingsTableOff); err != nil {
+		return fmt.Errorf("postings: %s", err.Error())
+	}
+	return nil
+}
+
+// section returns the contents of the length prefixed section at off,
+// checking its crc32
+func (b *tsdbBlock) section(off uint64) ([]byte, error) {
+	if off+4 > uint64(len(b.index)) {
+		return nil, fmt.Errorf("offset %d out of range", off)
+	}
+	n := uint64(binary.BigEndian.Uint32(b.index[off:]))
+	if off+4+n+4 > uint64(len(b.index)) {
+		return nil, fmt.Errorf("section at %d out of range", off)
+	}
+	data := b.index[off+4 : off+4+n]
+	if crc32.Checksum(data, castagnoli) != binary.BigEndian.Uint32(b.index[off+4+n:]) {
+		return nil, fmt.Errorf("checksum mismatch at %d", off)
+	}
+	return data, nil
+}
+
+// readSymbols reads the symbol table, version 2 refers to symbols by
+// their position and version 1 by their offset in the file
+func (b *tsdbBlock) readSymbols(off uint64) error {
+	data, err := b.section(off)
+	if err != nil {
+		return err
+	}
+	d := &tsdbDecbuf{b: data}
+	n := int(d.be32())
+	if b.version == 1 {
+		b.symbolsAt = make(map[uint32]string, n)
+	} else {
+		b.symbols = make([]string, 0, n)
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		at := uint32(off + 4 + uint64(len(data)-len(d.b)))
+		s := d.str()
+		if b.version == 1 {
+			b.symbolsAt[at] = s
+		} else {
+			b.symbols = append(b.symbols, s)
+		}
+	}
+	return d.err
+}
+
+func (b *tsdbBlock) symbol(ref uint64) (string, error) {
+	if b.version == 1 {
+		if s, ok := b.symbolsAt[uint32(ref)]; ok {
+			return s, nil
+		}
+	} else if ref < uint64(len(b.symbols)) {
+		return b.symbols[ref], nil
+	}
+	return "", fmt.Errorf("unknown symbol %d", ref)
+}
+
+// readAllPostings finds the postings list of every series, keyed by an
+// empty label name and value, in the postings offset table
+func (b *tsdbBlock) readAllPostings(tableOff uint64) error {
+	data, err := b.section(tableOff)
+	if err != nil {
+		return err
+	}
+	d := &tsdbDecbuf{b: data}
+	n := int(d.be32())
+	for i := 0; i < n && d.err == nil; i++ {
+		d.uvarint() // number of strings, always 2
+		name, value := d.str(), d.str()
+		off := d.uvarint()
+		if d.err != nil || name != "" || value != "" {
+			continue
+		}
+
+		list, err := b.section(off)
+		if err != nil {
+			return err
+		}
+		ld := &tsdbDecbuf{b: list}
+		refs := int(ld.be32())
+		b.postings = make([]uint32, 0, refs)
+		for j := 0; j < refs && ld.err == nil; j++ {
+			b.postings = append(b.postings, ld.be32())
+		}
+		return ld.err
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return fmt.Errorf("no all postings list")
+}
+
+// Series returns the refs of every series in the block
+func (b *tsdbBlock) Series() []uint32 {
+	return b.postings
+}
+
+// SeriesAt decodes the labels and chunk metas of a series
+func (b *tsdbBlock) SeriesAt(ref uint32) ([]*remote.LabelPair, []tsdbChunkMeta, error) {
+	// version 2 series are 16 byte aligned and referenced by offset / 16
+	off := uint64(ref)
+	if b.version == 2 {
+		off *= 16
+	}
+	if off >= uint64(len(b.index)) {
+		return nil, nil, fmt.Errorf("series %d out of range", ref)
+	}
+	n, l := binary.Uvarint(b.index[off:])
+	if l <= 0 || off+uint64(l)+n+4 > uint64(len(b.index)) {
+		return nil, nil, fmt.Errorf("series %d out of range", ref)
+	}
+	data := b.index[off+uint64(l) : off+uint64(l)+n]
+	if crc32.Checksum(data, castagnoli) != binary.BigEndian.Uint32(b.index[off+uint64(l)+n:]) {
+		return nil, nil, fmt.Errorf("series %d checksum mismatch", ref)
+	}
+
+	d := &tsdbDecbuf{b: data}
+	nlabels := int(d.uvarint())
+	labels := make([]*remote.LabelPair, 0, nlabels)
+	for i := 0; i < nlabels && d.err == nil; i++ {
+		name, err := b.symbol(d.uvarint())
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := b.symbol(d.uvarint())
+		if err != nil {
+			return nil, nil, err
+		}
+		labels = append(labels, &remote.LabelPair{Name: name, Value: value})
+	}
+
+	// the first chunk is absolute, the rest are deltas to the previous one
+	nchunks := int(d.uvarint())
+	chunks := make([]tsdbChunkMeta, 0, nchunks)
+	var prev tsdbChunkMeta
+	for i := 0; i < nchunks && d.err == nil; i++ {
+		var c tsdbChunkMeta
+		if i == 0 {
+			c.mint = d.varint()
+			c.maxt = c.mint + int64(d.uvarint())
+			c.ref = d.uvarint()
+		} else {
+			c.mint = prev.maxt + int64(d.uvarint())
+			c.maxt = c.mint + int64(d.uvarint())
+			c.ref = uint64(int64(prev.ref) + d.varint())
+		}
+		chunks = append(chunks, c)
+		prev = c
+	}
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("series %d: %s", ref, d.err.Error())
+	}
+	return labels, chunks, nil
+}
+
+// Chunk reads a chunk, returning its encoding and data. The upper 32 bits
+// of a ref are the segment and the lower the offset in it.
+func (b *tsdbBlock) Chunk(ref uint64) (byte, []byte, error) {
+	seg, off := int(ref>>32), int64(uint32(ref))
+	if seg >= len(b.segments) {
+		return 0, nil, fmt.Errorf("chunk %d: segment %d not found", ref, seg)
+	}
+	f := b.segments[seg]
+
+	// length, encoding, data and crc32 of encoding and data
+	hdr := make([]byte, binary.MaxVarintLen32+1)
+	n, err := f.ReadAt(hdr, off)
+	if n == 0 {
+		return 0, nil, fmt.Errorf("chunk %d: %s", ref, err.Error())
+	}
+	size, l := binary.Uvarint(hdr[:n])
+	if l <= 0 {
+		return 0, nil, fmt.Errorf("chunk %d: invalid length", ref)
+	}
+	buf := make([]byte, 1+size+4)
+	if _, err = f.ReadAt(buf, off+int64(l)); err != nil {
+		return 0, nil, fmt.Errorf("chunk %d: %s", ref, err.Error())
+	}
+	if crc32.Checksum(buf[:1+size], castagnoli) != binary.BigEndian.Uint32(buf[1+size:]) {
+		return 0, nil, fmt.Errorf("chunk %d: checksum mismatch", ref)
+	}
+	return buf[0], buf[1 : 1+size], nil
+}
+
+// readTombstones reads the deleted intervals of series, if any
+func (b *tsdbBlock) readTombstones() error {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, "tombstones"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) < 9 || binary.BigEndian.Uint32(data) != tsdbTombstonesMagic {
+		return fmt.Errorf("not a tombstones file")
+	}
+	body := data[5 : len(data)-4]
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	b.tombstones = make(map[uint64][]tsdbInterval)
+	d := &tsdbDecbuf{b: body}
+	for len(d.b) > 0 && d.err == nil {
+		ref := d.uvarint()
+		iv := tsdbInterval{mint: d.varint(), maxt: d.varint()}
+		b.tombstones[ref] = append(b.tombstones[ref], iv)
+	}
+	return d.err
+}
+
+// Deleted returns whether a sample of a series has been deleted
+func (b *tsdbBlock) Deleted(ref uint32, t int64) bool {
+	for _, iv := range b.tombstones[uint64(ref)] {
+		if t >= iv.mint && t <= iv.maxt {
+			return true
+		}
+	}
+	return false
+}
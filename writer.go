@@ -4,9 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"sort"
+	"strconv"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/kshvakov/clickhouse"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,26 +18,115 @@ var insertSQL = `INSERT INTO %s.%s
 	(date, name, tags, val, ts)
 	VALUES	(?, ?, ?, ?, ?)`
 
+var insertHistSQL = `INSERT INTO %s.%s
+	(date, name, tags, kind, bounds, bound_labels, counts, sum, count, ts)
+	VALUES	(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// writeAck is told whether a request was written once its batch is
+// committed, or failed
+type writeAck interface {
+	written(ok bool)
+}
+
+// p2cTable is a table requests are written to and how to insert one
+type p2cTable struct {
+	sql  string
+	exec func(smt *sql.Stmt, req *p2cRequest) error
+}
+
 type p2cWriter struct {
-	conf     *config
-	requests chan *p2cRequest
-	wg       sync.WaitGroup
-	db       *sql.DB
-	tx       prometheus.Counter
-	ko       prometheus.Counter
-	test     prometheus.Counter
-	timings  prometheus.Histogram
+	// failed counts samples that failed to write, as ko does. First for
+	// the 64 bit alignment atomic operations need on 32 bit platforms.
+	failed uint64
+
+	conf      *config
+	requests  chan *p2cRequest
+	wg        sync.WaitGroup
+	shards    []*p2cShard
+	dsn       *p2cShard
+	slots     []int
+	samples   *p2cTable
+	hists     *p2cTable
+	natives   *p2cTable
+	exemplars *p2cTable
+	metadata  *p2cTable
+	tx        prometheus.Counter
+	ko        prometheus.Counter
+	test      prometheus.Counter
+	timings   prometheus.Histogram
+	shardTx   *prometheus.CounterVec
+	shardKo   *prometheus.CounterVec
+	shardUp   *prometheus.GaugeVec
+	shardDrop *prometheus.CounterVec
+	// block rather than drop requests when a shard falls behind, set
+	// unless sharding so a slow clickhouse holds up the write endpoints and
+	// prometheus retries
+	block bool
 }
 
-func NewP2CWriter(conf *config, reqs chan *p2cRequest) (*p2cWriter, error) {
+// NewP2CWriter creates a writer for reqs, its metrics are registered with reg
+func NewP2CWriter(conf *config, reqs chan *p2cRequest, reg prometheus.Registerer) (*p2cWriter, error) {
 	var err error
 	w := new(p2cWriter)
 	w.conf = conf
 	w.requests = reqs
-	w.db, err = sql.Open("clickhouse", w.conf.ChDSN)
-	if err != nil {
-		fmt.Printf("Error connecting to clickhouse: %s\n", err.Error())
-		return w, err
+
+	// client side sharding writes directly to the local table on each shard,
+	// otherwise everything goes to ch.table via ch.dsn
+	table := w.conf.ChTable
+	if w.conf.ChShards != "" {
+		w.shards, err = parseShards(w.conf.ChShards, w.conf.ChShardWeights)
+		if err != nil {
+			fmt.Printf("Error parsing clickhouse shards: %s\n", err.Error())
+			return w, err
+		}
+		table = w.conf.ChShardTable
+	} else {
+		w.shards = []*p2cShard{{dsn: w.conf.ChDSN, weight: 1, healthy: 1}}
+		w.block = true
+	}
+	w.slots = shardSlots(w.shards)
+
+	// the histogram, exemplar and metadata tables aren't sharded, with
+	// ch.shards they're written through ch.dsn as an extra last shard
+	if w.conf.ChShards != "" {
+		w.dsn = &p2cShard{id: len(w.shards), dsn: w.conf.ChDSN, weight: 1, healthy: 1}
+		w.shards = append(w.shards, w.dsn)
+	} else {
+		w.dsn = w.shards[0]
+	}
+
+	w.samples = &p2cTable{
+		sql: fmt.Sprintf(insertSQL, w.conf.ChDB, table),
+		exec: func(smt *sql.Stmt, req *p2cRequest) error {
+			_, err := smt.Exec(req.ts, req.name, clickhouse.Array(req.tags),
+				req.val, req.ts)
+			return err
+		},
+	}
+
+	w.hists = &p2cTable{
+		sql: fmt.Sprintf(insertHistSQL, w.conf.ChDB, w.conf.ChHistTable),
+		exec: func(smt *sql.Stmt, req *p2cRequest) error {
+			h := req.hist
+			_, err := smt.Exec(req.ts, req.name, clickhouse.Array(req.tags), h.kind,
+				clickhouse.Array(h.bounds), clickhouse.Array(h.labels), clickhouse.Array(h.counts),
+				h.sum, h.count, req.ts)
+			return err
+		},
+	}
+
+	w.natives = w.nativeTable()
+	w.exemplars = w.exemplarTable()
+	w.metadata = w.metadataTable()
+
+	for _, s := range w.shards {
+		s.db, err = sql.Open("clickhouse", s.dsn)
+		if err != nil {
+			fmt.Printf("Error connecting to clickhouse shard %d: %s\n", s.id, err.Error())
+			return w, err
+		}
+		s.requests = make(chan *p2cRequest, w.conf.ChanSize)
 	}
 
 	w.tx = prometheus.NewCounter(
@@ -66,88 +157,256 @@ func NewP2CWriter(conf *config, reqs chan *p2cRequest) (*p2cWriter, error) {
 			Buckets: prometheus.DefBuckets,
 		},
 	)
-	prometheus.MustRegister(w.tx)
-	prometheus.MustRegister(w.ko)
-	prometheus.MustRegister(w.test)
-	prometheus.MustRegister(w.timings)
+
+	w.shardTx = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shard_sent_samples_total",
+			Help: "Total number of processed samples sent to each clickhouse shard.",
+		},
+		[]string{"shard"},
+	)
+
+	w.shardKo = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shard_failed_samples_total",
+			Help: "Total number of processed samples which failed on send to each clickhouse shard.",
+		},
+		[]string{"shard"},
+	)
+
+	w.shardDrop = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shard_dropped_samples_total",
+			Help: "Total number of processed samples dropped as the queue of each clickhouse shard was full.",
+		},
+		[]string{"shard"},
+	)
+
+	w.shardUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "shard_healthy",
+			Help: "Whether the last batch written to each clickhouse shard succeeded (1) or not (0).",
+		},
+		[]string{"shard"},
+	)
+	for _, s := range w.shards {
+		w.shardUp.WithLabelValues(strconv.Itoa(s.id)).Set(1)
+	}
+
+	reg.MustRegister(w.tx)
+	reg.MustRegister(w.ko)
+	reg.MustRegister(w.test)
+	reg.MustRegister(w.timings)
+	reg.MustRegister(w.shardTx)
+	reg.MustRegister(w.shardKo)
+	reg.MustRegister(w.shardUp)
+	reg.MustRegister(w.shardDrop)
 
 	return w, nil
 }
 
 func (w *p2cWriter) Start() {
+	fmt.Println("Writer starting..")
 
-	go func() {
+	// one batching writer per shard
+	for _, s := range w.shards {
 		w.wg.Add(1)
-		fmt.Println("Writer starting..")
-		sql := fmt.Sprintf(insertSQL, w.conf.ChDB, w.conf.ChTable)
-		ok := true
-		for ok {
-			w.test.Add(1)
-			// get next batch of requests
-			var reqs []*p2cRequest
-
-			tstart := time.Now()
-			for i := 0; i < w.conf.ChBatch; i++ {
-				var req *p2cRequest
-				// get requet and also check if channel is closed
-				req, ok = <-w.requests
-				if !ok {
-					fmt.Println("Writer stopping..")
-					break
-				}
-				reqs = append(reqs, req)
-			}
+		go w.runShard(s)
+	}
 
-			// ensure we have something to send..
-			nmetrics := len(reqs)
-			if nmetrics < 1 {
-				continue
+	// route samples to the owning shard, everything else to ch.dsn. Unless
+	// blocking, a shard that can't keep up has its requests dropped rather
+	// than holding up the others.
+	w.wg.Add(1)
+	go func() {
+		for req := range w.requests {
+			s := w.dsn
+			if w.tableFor(req) == w.samples {
+				s = w.shards[shardFor(w.slots, req.name)]
 			}
-
-			// post them to db all at once
-			tx, err := w.db.Begin()
-			if err != nil {
-				fmt.Printf("Error: begin transaction: %s\n", err.Error())
-				w.ko.Add(1.0)
+			if w.block {
+				s.requests <- req
 				continue
 			}
+			select {
+			case s.requests <- req:
+			default:
+				w.drop(s, req)
+			}
+		}
+		fmt.Println("Writer stopping..")
+		for _, s := range w.shards {
+			close(s.requests)
+		}
+		w.wg.Done()
+	}()
+}
 
-			// build statements
-			smt, err := tx.Prepare(sql)
-			for _, req := range reqs {
-				if err != nil {
-					fmt.Printf("Error: prepare statement: %s\n", err.Error())
-					w.ko.Add(1.0)
-					continue
-				}
+// tableFor returns the table req is written to
+func (w *p2cWriter) tableFor(req *p2cRequest) *p2cTable {
+	if req.hist != nil {
+		return w.hists
+	}
+	if req.native != nil {
+		return w.natives
+	}
+	if req.exemplar != nil {
+		return w.exemplars
+	}
+	if req.meta != nil {
+		return w.metadata
+	}
+	return w.samples
+}
 
-				// ensure tags are inserted in the same order each time
-				// possibly/probably impacts indexing?
-				sort.Strings(req.tags)
-				_, err = smt.Exec(req.ts, req.name, clickhouse.Array(req.tags),
-					req.val, req.ts)
+func (w *p2cWriter) runShard(s *p2cShard) {
+	defer w.wg.Done()
+	ok := true
+	for ok {
+		w.test.Add(1)
+		// get next batch of requests, grouped by destination table
+		batches := make(map[*p2cTable][]*p2cRequest)
 
-				if err != nil {
-					fmt.Printf("Error: statement exec: %s\n", err.Error())
-					w.ko.Add(1.0)
+		// a batch is written once full or ch.batchlinger after its first
+		// request, so the tail of an import or a kafka message isn't held
+		// back until more arrive
+		var linger *time.Timer
+	batch:
+		for i := 0; i < w.conf.ChBatch; i++ {
+			var req *p2cRequest
+			// get requet and also check if channel is closed
+			if linger == nil {
+				req, ok = <-s.requests
+				linger = time.NewTimer(w.conf.ChBatchLinger)
+			} else {
+				select {
+				case req, ok = <-s.requests:
+				case <-linger.C:
+					break batch
 				}
 			}
-
-			// commit and record metrics
-			if err = tx.Commit(); err != nil {
-				fmt.Printf("Error: commit failed: %s\n", err.Error())
-				w.ko.Add(1.0)
-			} else {
-				w.tx.Add(float64(nmetrics))
-				w.timings.Observe(float64(time.Since(tstart)))
+			if !ok {
+				break
 			}
+			t := w.tableFor(req)
+			batches[t] = append(batches[t], req)
+		}
+		if linger != nil {
+			linger.Stop()
+		}
 
+		// send each tables batch, if any
+		for t, reqs := range batches {
+			w.write(s, t, reqs)
+		}
+
+		// give a failing shard time to recover while its queue fills up and
+		// holds up further requests. Dropping shards keep writing instead,
+		// sleeping would only drop more.
+		if ok && w.block && !s.isHealthy() {
+			time.Sleep(s.backoff())
+		}
+	}
+	fmt.Printf("Writer stopped for shard %d..\n", s.id)
+}
+
+// drop records a request that couldn't be queued for shard s as failed
+func (w *p2cWriter) drop(s *p2cShard, req *p2cRequest) {
+	w.ko.Add(1.0)
+	atomic.AddUint64(&w.failed, 1)
+	w.shardDrop.WithLabelValues(strconv.Itoa(s.id)).Add(1.0)
+	if req.ack != nil {
+		req.ack.written(false)
+	}
+}
+
+// write posts a batch of requests to a table on a shard in a single
+// transaction and records the outcome in the writer and shard metrics
+func (w *p2cWriter) write(s *p2cShard, t *p2cTable, reqs []*p2cRequest) {
+	shard := strconv.Itoa(s.id)
+	nmetrics := float64(len(reqs))
+	tstart := time.Now()
+
+	fail := func(msg string, err error) {
+		fmt.Printf("Error: shard %d: %s: %s\n", s.id, msg, err.Error())
+		w.ko.Add(nmetrics)
+		atomic.AddUint64(&w.failed, uint64(nmetrics))
+		w.shardKo.WithLabelValues(shard).Add(nmetrics)
+		if s.setHealthy(false) {
+			fmt.Printf("Shard %d marked unhealthy\n", s.id)
+		}
+		w.shardUp.WithLabelValues(shard).Set(0)
+	}
+
+	// requests consumed from kafka or imported are acknowledged once the
+	// batch is committed, or failed along with rows that didn't exec
+	committed := false
+	execFailed := make([]bool, len(reqs))
+	defer func() {
+		for i, req := range reqs {
+			if req.ack != nil {
+				req.ack.written(committed && !execFailed[i])
+			}
 		}
-		fmt.Println("Writer stopped..")
-		w.wg.Done()
 	}()
+
+	// post them to db all at once
+	tx, err := s.db.Begin()
+	if err != nil {
+		fail("begin transaction", err)
+		return
+	}
+
+	// build statements
+	smt, err := tx.Prepare(t.sql)
+	if err != nil {
+		tx.Rollback()
+		fail("prepare statement", err)
+		return
+	}
+
+	for i, req := range reqs {
+		// ensure tags are inserted in the same order each time
+		// possibly/probably impacts indexing?
+		sort.Strings(req.tags)
+		if err = t.exec(smt, req); err != nil {
+			fmt.Printf("Error: shard %d: statement exec: %s\n", s.id, err.Error())
+			execFailed[i] = true
+			w.ko.Add(1.0)
+			atomic.AddUint64(&w.failed, 1)
+			w.shardKo.WithLabelValues(shard).Add(1.0)
+			nmetrics--
+		}
+	}
+
+	// commit and record metrics
+	if err = tx.Commit(); err != nil {
+		fail("commit failed", err)
+		return
+	}
+	committed = true
+
+	w.tx.Add(nmetrics)
+	w.shardTx.WithLabelValues(shard).Add(nmetrics)
+	w.timings.Observe(time.Since(tstart).Seconds())
+	if s.setHealthy(true) {
+		fmt.Printf("Shard %d marked healthy\n", s.id)
+	}
+	w.shardUp.WithLabelValues(shard).Set(1)
 }
 
 func (w *p2cWriter) Wait() {
 	w.wg.Wait()
 }
+
+// Failed returns the number of samples that failed to write so far
+func (w *p2cWriter) Failed() uint64 {
+	return atomic.LoadUint64(&w.failed)
+}
+
+// Close closes the shard connections, once the writer has stopped
+func (w *p2cWriter) Close() {
+	for _, s := range w.shards {
+		s.db.Close()
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Gorilla style XOR chunk encoding, byte for byte compatible with the
+// prometheus tsdb XOR chunk format used by streamed remote read.
+// see: https://github.com/prometheus/prometheus/blob/main/tsdb/chunkenc/xor.go
+
+// chunk encoding identifier for XOR chunks in remote read responses
+const chunkEncodingXOR = 1
+
+// maximum number of samples per chunk, same as the prometheus head block
+const maxChunkSamples = 120
+
+// bstream is a stream of bits
+type bstream struct {
+	stream []byte
+	// bits available in the last byte of stream
+	count uint8
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	i := len(b.stream) - 1
+	if bit {
+		b.stream[i] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	i := len(b.stream) - 1
+	// fill up b.stream[i] with the high bits of byt, the rest go in a new byte
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, 0)
+	b.stream[i+1] = byt << b.count
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+// xorChunk is an append only XOR encoded chunk. The first two bytes hold
+// the number of samples (big endian).
+type xorChunk struct {
+	b        bstream
+	num      uint16
+	mint     int64
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+}
+
+func newXORChunk() *xorChunk {
+	return &xorChunk{
+		b:       bstream{stream: make([]byte, 2, 128)},
+		leading: 0xff,
+	}
+}
+
+// Bytes returns the encoded chunk
+func (c *xorChunk) Bytes() []byte {
+	return c.b.stream
+}
+
+// NumSamples returns the number of samples in the chunk
+func (c *xorChunk) NumSamples() int {
+	return int(c.num)
+}
+
+// Append adds a sample, samples must be appended in timestamp order
+func (c *xorChunk) Append(t int64, v float64) {
+	var tDelta uint64
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	switch c.num {
+	case 0:
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+		c.mint = t
+
+	case 1:
+		tDelta = uint64(t - c.t)
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			c.b.writeByte(b)
+		}
+		c.writeVDelta(v)
+
+	default:
+		tDelta = uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+
+		// gorilla has a max resolution of seconds, prometheus milliseconds,
+		// so the bucket sizes are larger
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0x02, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0x06, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0x0e, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0x0f, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeVDelta(v)
+	}
+
+	c.t = t
+	c.v = v
+	c.tDelta = tDelta
+	c.num++
+	binary.BigEndian.PutUint16(c.b.stream, c.num)
+}
+
+func (c *xorChunk) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(c.v)
+
+	if vDelta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+
+	// clamp number of leading zeros to avoid overflow when encoding
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		c.b.writeBit(false)
+		c.b.writeBits(vDelta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+
+	// 64 significant bits is written as 0, the reader handles that
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(vDelta>>trailing, int(sigbits))
+}
+
+// bitRange returns whether x fits in a signed nbits wide field
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// bstreamReader reads a stream of bits
+type bstreamReader struct {
+	stream []byte
+	// bits consumed of stream[0]
+	pos uint8
+}
+
+func newBReader(b []byte) *bstreamReader {
+	return &bstreamReader{stream: b}
+}
+
+func (b *bstreamReader) readBit() (bool, error) {
+	if len(b.stream) == 0 {
+		return false, io.EOF
+	}
+	bit := b.stream[0]&(0x80>>b.pos) != 0
+	if b.pos++; b.pos == 8 {
+		b.stream, b.pos = b.stream[1:], 0
+	}
+	return bit, nil
+}
+
+// ReadByte reads the next 8 bits, so binary.ReadVarint works on a stream
+func (b *bstreamReader) ReadByte() (byte, error) {
+	v, err := b.readBits(8)
+	return byte(v), err
+}
+
+func (b *bstreamReader) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for ; nbits > 0; nbits-- {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+// xorIterator iterates the samples of an encoded XOR chunk
+type xorIterator struct {
+	br       *bstreamReader
+	total    uint16
+	read     uint16
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+	err      error
+}
+
+func newXORIterator(chunk []byte) *xorIterator {
+	if len(chunk) < 2 {
+		return &xorIterator{err: fmt.Errorf("xor chunk of %d bytes", len(chunk))}
+	}
+	return &xorIterator{br: newBReader(chunk[2:]), total: binary.BigEndian.Uint16(chunk)}
+}
+
+// At returns the current sample
+func (it *xorIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *xorIterator) Err() error {
+	return it.err
+}
+
+// Next advances to the next sample
+func (it *xorIterator) Next() bool {
+	if it.err != nil || it.read == it.total {
+		return false
+	}
+
+	switch it.read {
+	case 0:
+		t, err := binary.ReadVarint(it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t, it.v = t, math.Float64frombits(v)
+		it.read++
+		return true
+
+	case 1:
+		tDelta, err := binary.ReadUvarint(it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = tDelta
+		it.t += int64(tDelta)
+		return it.readValue()
+	}
+
+	// delta of delta prefix, 0, 10, 110, 1110 or 1111
+	var d byte
+	for i := 0; i < 4; i++ {
+		d <<= 1
+		bit, err := it.br.readBit()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !bit {
+			break
+		}
+		d |= 1
+	}
+
+	var (
+		sz  int
+		dod int64
+	)
+	switch d {
+	case 0x02:
+		sz = 14
+	case 0x06:
+		sz = 17
+	case 0x0e:
+		sz = 20
+	case 0x0f:
+		bits, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		dod = int64(bits)
+	}
+	if sz != 0 {
+		bits, err := it.br.readBits(sz)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		// sign extend, see bitRange
+		if bits > 1<<uint(sz-1) {
+			bits -= 1 << uint(sz)
+		}
+		dod = int64(bits)
+	}
+
+	it.tDelta = uint64(int64(it.tDelta) + dod)
+	it.t += int64(it.tDelta)
+	return it.readValue()
+}
+
+func (it *xorIterator) readValue() bool {
+	// 0: same value, 10: xor within the previous window, 11: new window
+	changed, err := it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if changed {
+		window, err := it.br.readBit()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if window {
+			leading, err := it.br.readBits(5)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			sigbits, err := it.br.readBits(6)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			it.leading = uint8(leading)
+			it.trailing = 64 - it.leading - uint8(sigbits)
+		}
+		bits, err := it.br.readBits(64 - int(it.leading) - int(it.trailing))
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.v = math.Float64frombits(math.Float64bits(it.v) ^ bits<<it.trailing)
+	}
+	it.read++
+	return true
+}